@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/pkg/errors"
+)
+
+// asgConfig is one ASG of the --asg-config file, with the options it overrides. Options left
+// out keep the value given on the command line, so the command line sets the defaults of a sweep.
+// ASGs of a higher priority are swept first, and so are the last deferred when the sweep is out
+// of --sweep-max-mutations.
+type asgConfig struct {
+	Name                 string   `json:"name"`
+	Priority             int      `json:"priority,omitempty"`
+	RotatePercent        *int     `json:"rotate_percent,omitempty"`
+	RotateOrder          *string  `json:"rotate_order,omitempty"`
+	MaxUnprotectSpot     *float64 `json:"max_unprotect_spot,omitempty"`
+	MaxUnprotectOnDemand *float64 `json:"max_unprotect_on_demand,omitempty"`
+	Deregister           *bool    `json:"deregister,omitempty"`
+	MinHealthyPerAZ      *int     `json:"min_healthy_per_az,omitempty"`
+}
+
+// asgConfigFile is the --asg-config file
+type asgConfigFile struct {
+	ASGs []asgConfig `json:"asgs"`
+}
+
+// loadASGConfig reads the ASGs to sweep from the --asg-config file, in the order to sweep them:
+// by priority, then as listed. Unknown fields are refused, so a misspelled override isn't
+// silently left at its default.
+func loadASGConfig(path string) ([]asgConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read ASG config %s", path)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var config asgConfigFile
+	if err := decoder.Decode(&config); err != nil {
+		return nil, errors.Wrapf(err, "could not parse ASG config %s", path)
+	}
+	if len(config.ASGs) == 0 {
+		return nil, errors.Errorf("ASG config %s lists no ASGs", path)
+	}
+	seen := make(map[string]bool)
+	for _, asg := range config.ASGs {
+		if asg.Name == "" {
+			return nil, errors.Errorf("ASG config %s has an ASG without a name", path)
+		}
+		if seen[asg.Name] {
+			return nil, errors.Errorf("ASG config %s lists %s twice", path, asg.Name)
+		}
+		seen[asg.Name] = true
+		if asg.RotatePercent != nil && (*asg.RotatePercent < 0 || *asg.RotatePercent > 100) {
+			return nil, errors.Errorf("ASG config %s: rotate_percent of %s must be between 0 and 100", path, asg.Name)
+		}
+		if asg.RotateOrder != nil && *asg.RotateOrder != "" && *asg.RotateOrder != "spot-first" && *asg.RotateOrder != "on-demand-first" {
+			return nil, errors.Errorf("ASG config %s: rotate_order of %s must be spot-first or on-demand-first", path, asg.Name)
+		}
+	}
+	sort.SliceStable(config.ASGs, func(i, j int) bool {
+		return config.ASGs[i].Priority > config.ASGs[j].Priority
+	})
+	return config.ASGs, nil
+}
+
+// asgRunOptions returns the options of the run of one ASG of the --asg-config file. The files
+// runs write and read get the ASG name appended to their names, so that ASGs don't overwrite
+// each other's.
+func asgRunOptions(options *Options, asg asgConfig) *Options {
+	asgOptions := *options
+	asgOptions.ASG = asg.Name
+	if asg.RotatePercent != nil {
+		asgOptions.RotatePercent = *asg.RotatePercent
+	}
+	if asg.RotateOrder != nil {
+		asgOptions.RotateOrder = *asg.RotateOrder
+	}
+	if asg.MaxUnprotectSpot != nil {
+		asgOptions.MaxUnprotectSpot = *asg.MaxUnprotectSpot
+	}
+	if asg.MaxUnprotectOnDemand != nil {
+		asgOptions.MaxUnprotectOnDemand = *asg.MaxUnprotectOnDemand
+	}
+	if asg.Deregister != nil {
+		asgOptions.Deregister = *asg.Deregister
+	}
+	if asg.MinHealthyPerAZ != nil {
+		asgOptions.MinHealthyPerAZ = *asg.MinHealthyPerAZ
+	}
+	for _, path := range runFiles(&asgOptions) {
+		*path = suffixPath(*path, asg.Name)
+	}
+	return &asgOptions
+}
+
+// runASGs updates the ASGs of the --asg-config file one after the other, sharing the target
+// health cache of the sweep. With --sweep-max-mutations each run may only make the mutations the
+// ASGs before it left, and the ASGs after the budget ran out are deferred to a later run. With
+// --keep-going a failed ASG doesn't stop the sweep. hooks report the run of each ASG.
+func runASGs(ctx context.Context, sess *session.Session, options *Options, hooks *runHooks, health *targetHealthCache) error {
+	asgs, err := loadASGConfig(options.ASGConfig)
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] sweeping %d ASGs", len(asgs))
+
+	var errs multiError
+	apiCalls := make(map[string]int)
+	defer func() {
+		total := 0
+		for _, n := range apiCalls {
+			total += n
+		}
+		log.Printf("[INFO] ---- aws api calls of %d ASGs: %d ----", len(asgs), total)
+		printAPICalls(apiCalls)
+	}()
+
+	remaining := options.SweepMaxMutations
+	deferred := 0
+	for _, asg := range asgs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		asgOptions := asgRunOptions(options, asg)
+		capped := false
+		if options.SweepMaxMutations > 0 {
+			if remaining <= 0 {
+				log.Printf("[INFO] the sweep is out of `--sweep-max-mutations`, deferring asg %s (priority %d) to a later run", asg.Name, asg.Priority)
+				deferred++
+				continue
+			}
+			if asgOptions.MaxMutations == 0 || remaining < asgOptions.MaxMutations {
+				asgOptions.MaxMutations = remaining
+				capped = true
+			}
+		}
+		log.Printf("[INFO] ---- asg %s ----", asg.Name)
+		err := doUpdate(ctx, sess, asgOptions, health)
+		remaining -= budget.mutationsMade()
+		result := currentRunResult()
+		hooks.finish(asgOptions, err, result)
+		for operation, n := range result.APICalls {
+			apiCalls[operation] += n
+		}
+		if err != nil && capped && remaining <= 0 && budget.exceeded() {
+			// the budget of the sweep ran out halfway through this ASG, not the budget of its run
+			log.Printf("[INFO] the sweep ran out of `--sweep-max-mutations` during asg %s, deferring the rest of it to a later run", asg.Name)
+			deferred++
+			continue
+		}
+		if err != nil {
+			err = errors.Wrapf(err, "asg %s", asg.Name)
+			if !options.KeepGoing {
+				return err
+			}
+			log.Printf("[ERROR] %v, continuing with `--keep-going`", err)
+			errs = append(errs, err)
+		}
+	}
+	if deferred > 0 {
+		log.Printf("[INFO] %d of %d ASGs deferred to a later run by `--sweep-max-mutations` %d", deferred, len(asgs), options.SweepMaxMutations)
+	}
+	if len(errs) > 0 {
+		return partialFailureError(errs, len(errs), len(asgs), "ASGs")
+	}
+	return nil
+}
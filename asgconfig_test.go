@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadASGConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asgconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		config  string
+		order   []string
+		wantErr string
+	}{
+		{"valid", `{"asgs": [{"name": "api", "rotate_percent": 10}, {"name": "workers"}]}`, []string{"api", "workers"}, ""},
+		{"priority", `{"asgs": [{"name": "workers"}, {"name": "batch", "priority": -1}, {"name": "api", "priority": 10}, {"name": "web"}]}`, []string{"api", "workers", "web", "batch"}, ""},
+		{"empty", `{"asgs": []}`, nil, "lists no ASGs"},
+		{"unnamed", `{"asgs": [{"rotate_percent": 10}]}`, nil, "without a name"},
+		{"duplicate", `{"asgs": [{"name": "api"}, {"name": "api"}]}`, nil, "lists api twice"},
+		{"misspelled", `{"asgs": [{"name": "api", "rotate_pct": 10}]}`, nil, "unknown field"},
+		{"percent", `{"asgs": [{"name": "api", "rotate_percent": 150}]}`, nil, "between 0 and 100"},
+		{"order", `{"asgs": [{"name": "api", "rotate_order": "oldest-first"}]}`, nil, "spot-first or on-demand-first"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, test.name+".json")
+			if err := ioutil.WriteFile(path, []byte(test.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			asgs, err := loadASGConfig(path)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			order := make([]string, 0, len(asgs))
+			for _, asg := range asgs {
+				order = append(order, asg.Name)
+			}
+			if strings.Join(order, " ") != strings.Join(test.order, " ") {
+				t.Errorf("ASGs %v, want %v", order, test.order)
+			}
+		})
+	}
+}
+
+func TestASGRunOptions(t *testing.T) {
+	percent, deregister := 10, false
+	options := &Options{RotatePercent: 50, RotateOrder: "spot-first", Deregister: true, MinHealthyPerAZ: 2, StateFile: "/var/lib/rip/state.json"}
+
+	overridden := asgRunOptions(options, asgConfig{Name: "api", RotatePercent: &percent, Deregister: &deregister})
+	if overridden.ASG != "api" || overridden.RotatePercent != 10 || overridden.Deregister {
+		t.Errorf("overrides not applied: asg %q, rotate percent %d, deregister %v", overridden.ASG, overridden.RotatePercent, overridden.Deregister)
+	}
+	if overridden.RotateOrder != "spot-first" || overridden.MinHealthyPerAZ != 2 {
+		t.Errorf("defaults not kept: rotate order %q, min healthy per az %d", overridden.RotateOrder, overridden.MinHealthyPerAZ)
+	}
+	if overridden.StateFile != "/var/lib/rip/state-api.json" {
+		t.Errorf("state file %q, want the ASG name appended", overridden.StateFile)
+	}
+	if overridden.ReportFile != "" {
+		t.Errorf("unset report file became %q", overridden.ReportFile)
+	}
+	if options.RotatePercent != 50 || options.StateFile != "/var/lib/rip/state.json" {
+		t.Errorf("the options of the sweep were changed")
+	}
+}
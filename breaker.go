@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/meirf/gopart"
+	"github.com/pkg/errors"
+)
+
+// exitCircuitOpen is the exit code used when the run aborted because the circuit breaker tripped
+const exitCircuitOpen = 3
+
+// errCircuitOpen is returned for mutating AWS calls once the circuit breaker has tripped
+var errCircuitOpen = errors.New("circuit breaker open after repeated AWS API errors, refusing to make changes")
+
+// circuitBreaker stops mutating AWS calls after too many consecutive API errors, so an expired
+// credential or regional outage mid-run doesn't leave a change half applied by retrying blindly.
+type circuitBreaker struct {
+	mu          sync.Mutex
+	max         int
+	consecutive int
+	open        bool
+	// recovering lets the re-protection of touched instances through an open breaker
+	recovering bool
+}
+
+// breaker is the circuit breaker of the current run
+var breaker = &circuitBreaker{}
+
+// readOnlyOperations are the operations outside the Describe, List and Get families that don't
+// change state. ReceiveMessage only hides the messages from other consumers for a while, and
+// the KMS operations only encrypt, decrypt and sign the files the run writes.
+var readOnlyOperations = map[string]bool{
+	"ReceiveMessage":  true,
+	"GenerateDataKey": true,
+	"Decrypt":         true,
+	"Sign":            true,
+}
+
+// recordOperations change nothing but the tool's own records: PutItem stores the run in
+// --history-table, which dry runs and runs stopped by the breaker are recorded to as well
+var recordOperations = map[string]bool{
+	"PutItem": true,
+}
+
+// isMutation reports whether an AWS operation changes state
+func isMutation(operation string) bool {
+	if readOnlyOperations[operation] || recordOperations[operation] {
+		return false
+	}
+	for _, prefix := range []string{"Describe", "List", "Get"} {
+		if strings.HasPrefix(operation, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// watch counts consecutive errors of requests made through the session, and refuses mutating
+// requests once more than max have occurred in a row. A max of 0 disables the breaker.
+func (b *circuitBreaker) watch(sess *session.Session, max int) {
+	b.max = max
+	sess.Handlers.Validate.PushBack(func(r *request.Request) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.open && !b.recovering && isMutation(r.Operation.Name) {
+			r.Error = errCircuitOpen
+		}
+	})
+	sess.Handlers.Complete.PushBack(func(r *request.Request) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if r.Error == nil {
+			b.consecutive = 0
+			return
+		}
+		if r.Error == errCircuitOpen {
+			return
+		}
+		b.consecutive++
+		if b.max > 0 && b.consecutive > b.max && !b.open {
+			log.Printf("[ERROR] %d consecutive AWS API errors, last from %s: %v", b.consecutive, r.Operation.Name, r.Error)
+			log.Printf("[ERROR] circuit breaker tripped, no further changes will be made")
+			b.open = true
+		}
+	})
+}
+
+// isOpen reports whether the breaker has tripped
+func (b *circuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+// reprotectInstances best-effort restores scale in protection on instances this run unprotected
+func reprotectInstances(asgClient *autoscaling.AutoScaling, ec2Client *ec2.EC2, asgName string, instanceIds []*string) {
+	breaker.mu.Lock()
+	breaker.recovering = true
+	breaker.mu.Unlock()
+	defer func() {
+		breaker.mu.Lock()
+		breaker.recovering = false
+		breaker.mu.Unlock()
+	}()
+
+	log.Printf("[WARN] re-enabling scale in protection on %d instances unprotected by this run", len(instanceIds))
+	for partition := range gopart.Partition(len(instanceIds), 50) {
+		req, _ := asgClient.SetInstanceProtectionRequest(&autoscaling.SetInstanceProtectionInput{
+			AutoScalingGroupName: aws.String(asgName),
+			InstanceIds:          instanceIds[partition.Low:partition.High],
+			ProtectedFromScaleIn: aws.Bool(true),
+		})
+		if err := mutate(req, false); err != nil {
+			log.Printf("[ERROR] could not re-enable scale in protection on %v: %v", aws.StringValueSlice(instanceIds[partition.Low:partition.High]), err)
+			continue
+		}
+		stats.action("protection restored", partition.High-partition.Low)
+		if err := tagProtectedAt(ec2Client, instanceIds[partition.Low:partition.High], false); err != nil {
+			log.Printf("[ERROR] %v", err)
+		}
+	}
+}
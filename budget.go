@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/pkg/errors"
+)
+
+// runBudget caps the AWS API calls and mutations of a run, limiting the blast radius of a
+// misconfigured run. Requests over budget fail before they are sent.
+type runBudget struct {
+	mu           sync.Mutex
+	maxCalls     int
+	maxMutations int
+	calls        int
+	mutations    int
+	tripped      bool
+}
+
+// budget is the budget of the current run
+var budget = &runBudget{}
+
+// watch enforces the budget on requests made through the session. A max of 0 is unlimited.
+func (b *runBudget) watch(sess *session.Session, maxCalls, maxMutations int) {
+	b.maxCalls = maxCalls
+	b.maxMutations = maxMutations
+	sess.Handlers.Validate.PushBack(func(r *request.Request) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.maxCalls > 0 && b.calls >= b.maxCalls {
+			b.tripped = true
+			r.Error = &runError{kind: errorKindGuardTripped, err: errors.Errorf("run exceeded `--max-api-calls` %d at %s", b.maxCalls, r.Operation.Name)}
+			return
+		}
+		mutation := isMutation(r.Operation.Name)
+		if mutation && b.maxMutations > 0 && b.mutations >= b.maxMutations {
+			b.tripped = true
+			r.Error = &runError{kind: errorKindGuardTripped, err: errors.Errorf("run exceeded `--max-mutations` %d at %s", b.maxMutations, r.Operation.Name)}
+			return
+		}
+		b.calls++
+		if mutation {
+			b.mutations++
+		}
+	})
+}
+
+// exceeded reports whether a request was refused for being over budget
+func (b *runBudget) exceeded() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tripped
+}
+
+// mutationsMade returns the mutations the run made so far
+func (b *runBudget) mutationsMade() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.mutations
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// capacityWeights holds the capacity units each instance contributes to the ASG. Instances that
+// aren't in the ASG, or ASGs without a MixedInstancesPolicy, count as one unit per instance.
+type capacityWeights map[string]float64
+
+// weight returns the capacity units of an instance
+func (w capacityWeights) weight(instanceID string) float64 {
+	if weight, ok := w[instanceID]; ok {
+		return weight
+	}
+	return 1
+}
+
+// total returns the combined capacity units of the instances
+func (w capacityWeights) total(instanceIds []string) float64 {
+	total := 0.0
+	for _, instanceID := range instanceIds {
+		total += w.weight(instanceID)
+	}
+	return total
+}
+
+// instanceWeights resolves the weighted capacity of every instance in the ASG, preferring the weight
+// reported on the instance and falling back to the MixedInstancesPolicy override for its type.
+func instanceWeights(asg *autoscaling.Group) capacityWeights {
+	typeWeights := make(map[string]float64)
+	if asg.MixedInstancesPolicy != nil && asg.MixedInstancesPolicy.LaunchTemplate != nil {
+		for _, override := range asg.MixedInstancesPolicy.LaunchTemplate.Overrides {
+			if weight, ok := parseWeight(override.WeightedCapacity); ok {
+				typeWeights[aws.StringValue(override.InstanceType)] = weight
+			}
+		}
+	}
+
+	weights := make(capacityWeights, len(asg.Instances))
+	for _, instance := range asg.Instances {
+		if weight, ok := parseWeight(instance.WeightedCapacity); ok {
+			weights[*instance.InstanceId] = weight
+		} else if weight, ok := typeWeights[aws.StringValue(instance.InstanceType)]; ok {
+			weights[*instance.InstanceId] = weight
+		}
+	}
+	return weights
+}
+
+func parseWeight(weightedCapacity *string) (float64, bool) {
+	if weightedCapacity == nil {
+		return 0, false
+	}
+	weight, err := strconv.ParseFloat(*weightedCapacity, 64)
+	if err != nil || weight <= 0 {
+		return 0, false
+	}
+	return weight, true
+}
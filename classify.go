@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/pkg/errors"
+)
+
+// classification is how a run sorted the ASG's instances by their Launch Template version
+type classification struct {
+	// toRemove are the protected stale instances to remove protection from
+	toRemove []*string
+	// latest are the instances on the latest version, or a newer one
+	latest []string
+	// invalid are the stale instances, protected or not
+	invalid []string
+	// old are the stale instances that are already unprotected
+	old []*string
+}
+
+// classifyInstances records a decision for every instance of the ASG and sorts them by their
+// Launch Template version. excluded instances are left alone, templateReplaced ones follow
+// --template-replaced-policy, and those in recycle are stale regardless of their version.
+func classifyInstances(asg *autoscaling.Group, lt launchTemplateRef, latestVersion int64, excluded map[string]bool, templateReplaced map[string]bool, recycle map[string]string, options *Options) (*classification, error) {
+	// sized for the whole ASG up front and reading each instance's fields once keeps sweeps of
+	// large ASGs from reallocating and re-dereferencing on every instance
+	c := &classification{
+		toRemove: make([]*string, 0, len(asg.Instances)),
+		latest:   make([]string, 0, len(asg.Instances)),
+		invalid:  make([]string, 0, len(asg.Instances)),
+		old:      make([]*string, 0, len(asg.Instances)),
+	}
+
+	// markStale classifies a stale instance by its protection, reporting recycled ones at INFO
+	markStale := func(instance *autoscaling.Instance, instanceID, versionString, reason string, protected bool) {
+		c.invalid = append(c.invalid, instanceID)
+		if !protected {
+			recordDecision("DEBUG", instanceID, versionString, stateStaleUnprotected, reason+"already not protected from scale-in, skipping")
+			c.old = append(c.old, instance.InstanceId)
+		} else {
+			level := "DEBUG"
+			if reason != "" {
+				level = "INFO"
+			}
+			recordDecision(level, instanceID, versionString, stateStaleProtected, reason+"will remove protection")
+			c.toRemove = append(c.toRemove, instance.InstanceId)
+		}
+	}
+
+	for _, instance := range asg.Instances {
+		instanceID := *instance.InstanceId
+		if instance.LaunchTemplate == nil || instance.LaunchTemplate.Version == nil {
+			recordDecision("WARN", instanceID, "-", stateUnknown, "missing Launch Template version, leaving it alone")
+			continue
+		}
+		versionString := *instance.LaunchTemplate.Version
+		protected := aws.BoolValue(instance.ProtectedFromScaleIn)
+		if excluded[instanceID] {
+			recordDecision("INFO", instanceID, versionString, stateExcluded, "excluded, leaving it alone")
+			continue
+		}
+		if !lt.matches(instance.LaunchTemplate) {
+			policy := options.ForeignTemplatePolicy
+			protectedState, unprotectedState := stateForeignProtected, stateForeignUnprotected
+			what := "belongs to another Launch Template"
+			if templateReplaced[instanceID] {
+				if options.TemplateReplacedPolicy != "foreign" {
+					policy = options.TemplateReplacedPolicy
+				}
+				protectedState, unprotectedState = stateTemplateReplacedProtected, stateTemplateReplacedUnprotected
+				what = "launched from the ASG's previous Launch Template"
+			}
+			level := "WARN"
+			if policy == "skip" {
+				level = "DEBUG"
+			}
+			log.Printf(
+				"[%s] instance %s has different Launch Template than ASG: %s:%s",
+				level,
+				instanceID,
+				aws.StringValue(instance.LaunchTemplate.LaunchTemplateName),
+				versionString,
+			)
+			if policy != "recycle" {
+				state := unprotectedState
+				if protected {
+					state = protectedState
+				}
+				recordDecision(level, instanceID, versionString, state, what+", leaving it alone")
+			} else if !protected {
+				recordDecision("DEBUG", instanceID, versionString, unprotectedState, what+", already not protected from scale-in, skipping")
+				c.old = append(c.old, instance.InstanceId)
+			} else {
+				recordDecision("DEBUG", instanceID, versionString, protectedState, what+", will remove protection")
+				c.toRemove = append(c.toRemove, instance.InstanceId)
+			}
+			continue
+		}
+
+		version, err := strconv.ParseInt(versionString, 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid instance Launch Template Version")
+		}
+
+		if reason, ok := recycle[instanceID]; ok && version >= latestVersion {
+			markStale(instance, instanceID, versionString, reason+", ", protected)
+			continue
+		}
+
+		if version > latestVersion {
+			if options.NewerVersionPolicy == "error" {
+				return nil, guardError("instance %s has Launch Template version %d newer than latest version %d", instanceID, version, latestVersion)
+			}
+			recordDecision("WARN", instanceID, versionString, stateNewer, "newer than latest version, treating as current")
+			c.latest = append(c.latest, instanceID)
+		} else if version != latestVersion {
+			markStale(instance, instanceID, versionString, "", protected)
+		} else {
+			recordDecision("DEBUG", instanceID, versionString, stateLatest, "")
+			c.latest = append(c.latest, instanceID)
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// largeASG returns an ASG of n instances on Launch Template "web", one in four of them on an
+// older version than latestVersion and every other one protected
+func largeASG(n int, latestVersion int64) *autoscaling.Group {
+	instances := make([]*autoscaling.Instance, 0, n)
+	for i := 0; i < n; i++ {
+		version := latestVersion
+		if i%4 == 0 {
+			version--
+		}
+		instances = append(instances, &autoscaling.Instance{
+			InstanceId:           aws.String(fmt.Sprintf("i-%017d", i)),
+			LifecycleState:       aws.String(autoscaling.LifecycleStateInService),
+			ProtectedFromScaleIn: aws.Bool(i%2 == 0),
+			LaunchTemplate: &autoscaling.LaunchTemplateSpecification{
+				LaunchTemplateName: aws.String("web"),
+				Version:            aws.String(strconv.FormatInt(version, 10)),
+			},
+		})
+	}
+	return &autoscaling.Group{AutoScalingGroupName: aws.String("web"), Instances: instances}
+}
+
+func TestClassifyInstances(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	stats = newRunStats()
+
+	asg := largeASG(8, 5)
+	c, err := classifyInstances(asg, launchTemplateRef{Name: "web"}, 5, map[string]bool{}, map[string]bool{}, map[string]string{}, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// instances 0 and 4 are stale and protected, none is stale and unprotected
+	if got := aws.StringValueSlice(c.toRemove); fmt.Sprint(got) != fmt.Sprint([]string{"i-00000000000000000", "i-00000000000000004"}) {
+		t.Errorf("toRemove = %v", got)
+	}
+	if len(c.latest) != 6 || len(c.invalid) != 2 || len(c.old) != 0 {
+		t.Errorf("latest %d, invalid %d, old %d instances, want 6, 2 and 0", len(c.latest), len(c.invalid), len(c.old))
+	}
+	if got := stats.instanceState("i-00000000000000004"); got != stateStaleProtected {
+		t.Errorf("state of a stale protected instance = %q, want %q", got, stateStaleProtected)
+	}
+}
+
+// BenchmarkClassifyInstances classifies a 10,000 instance ASG with DEBUG lines written and with
+// them dropped by the log filter, which skips formatting them
+func BenchmarkClassifyInstances(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func() { logDebug = true }()
+
+	asg := largeASG(10000, 5)
+	lt := launchTemplateRef{Name: "web"}
+	for _, bench := range []struct {
+		name  string
+		debug bool
+	}{
+		{"debug-logged", true},
+		{"debug-filtered", false},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			logDebug = bench.debug
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				stats = newRunStats()
+				if _, err := classifyInstances(asg, lt, 5, map[string]bool{}, map[string]bool{}, map[string]string{}, &Options{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
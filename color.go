@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorYellow = "\033[33m"
+	colorCyan   = "\033[36m"
+	colorGray   = "\033[90m"
+)
+
+// levelColors are the log level prefixes and the ANSI color used to render their lines, if any
+var levelColors = []struct {
+	level string
+	color string
+}{
+	{"[SPAM]", colorGray},
+	{"[DEBUG]", colorGray},
+	{"[INFO]", ""},
+	{"[WARN]", colorYellow},
+	{"[ERROR]", colorRed},
+	{"[FATAL]", colorRed},
+	{"[DRYRUN]", colorCyan},
+}
+
+// colorWriter wraps each log line in the color of its level
+type colorWriter struct {
+	w io.Writer
+}
+
+// Write colors p by the level tag that appears first in it, since a message can quote another
+// tag, e.g. an [INFO] line mentioning [WARN]
+func (c *colorWriter) Write(p []byte) (int, error) {
+	color, first := "", -1
+	for _, lc := range levelColors {
+		if i := bytes.Index(p, []byte(lc.level)); i >= 0 && (first < 0 || i < first) {
+			color, first = lc.color, i
+		}
+	}
+	if color == "" {
+		return c.w.Write(p)
+	}
+	line := bytes.TrimSuffix(p, []byte("\n"))
+	buf := make([]byte, 0, len(p)+len(color)+len(colorReset))
+	buf = append(buf, color...)
+	buf = append(buf, line...)
+	buf = append(buf, colorReset...)
+	if len(line) != len(p) {
+		buf = append(buf, '\n')
+	}
+	if _, err := c.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// useColor reports whether log output to f should be colored.
+// Color is disabled by --no-color, by a non-empty NO_COLOR env var (https://no-color.org),
+// or when f is not a terminal.
+func useColor(f *os.File, noColor bool) bool {
+	if noColor || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
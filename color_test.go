@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestColorWriter(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"warn", "2020/08/01 00:00:00 [WARN] slow\n", colorYellow + "2020/08/01 00:00:00 [WARN] slow" + colorReset + "\n"},
+		{"error", "[ERROR] failed\n", colorRed + "[ERROR] failed" + colorReset + "\n"},
+		{"dry run", "[DRYRUN] would unprotect i-1\n", colorCyan + "[DRYRUN] would unprotect i-1" + colorReset + "\n"},
+		{"debug", "[DEBUG] detail\n", colorGray + "[DEBUG] detail" + colorReset + "\n"},
+		{"no newline", "[WARN] slow", colorYellow + "[WARN] slow" + colorReset},
+		{"info", "[INFO] done\n", "[INFO] done\n"},
+		{"no level", "plain\n", "plain\n"},
+		// the first tag of the line decides, not one quoted in the message
+		{"info quoting warn", "[INFO] the last run logged [WARN] lines\n", "[INFO] the last run logged [WARN] lines\n"},
+		{"warn quoting error", "[WARN] hook printed [ERROR] boom\n", colorYellow + "[WARN] hook printed [ERROR] boom" + colorReset + "\n"},
+		{"debug quoting fatal", "[DEBUG] output: [FATAL] x\n", colorGray + "[DEBUG] output: [FATAL] x" + colorReset + "\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			n, err := (&colorWriter{w: &out}).Write([]byte(test.line))
+			if err != nil || n != len(test.line) {
+				t.Fatalf("Write() = %d, %v, want %d, nil", n, err, len(test.line))
+			}
+			if out.String() != test.want {
+				t.Errorf("wrote %q, want %q", out.String(), test.want)
+			}
+		})
+	}
+}
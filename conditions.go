@@ -0,0 +1,380 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/meirf/gopart"
+	"github.com/pkg/errors"
+)
+
+// healthCondition decides which latest instances count as healthy replacement capacity. Teams
+// define healthy differently, so the conditions applied are chosen with --health-condition,
+// including CloudWatch metrics and SSM commands of their own.
+type healthCondition interface {
+	name() string
+	healthy(instanceIds []string) ([]string, error)
+}
+
+// asgHealthCondition keeps instances the ASG reports as InService and Healthy
+type asgHealthCondition struct {
+	asg *autoscaling.Group
+}
+
+func (c asgHealthCondition) name() string { return "asg" }
+
+func (c asgHealthCondition) healthy(instanceIds []string) ([]string, error) {
+	return filterASGHealthy(c.asg, instanceIds), nil
+}
+
+// warmupCondition keeps instances launched longer ago than the ASG's warmup plus the slow start
+// of its target groups
+type warmupCondition struct {
+	ec2Client *ec2.EC2
+	asg       *autoscaling.Group
+	slowStart time.Duration
+	options   *Options
+}
+
+func (c warmupCondition) name() string { return "warmup" }
+
+func (c warmupCondition) healthy(instanceIds []string) ([]string, error) {
+	return filterWarmedUp(c.ec2Client, c.asg, instanceIds, c.slowStart, c.options)
+}
+
+// targetHealthCondition keeps instances that are healthy in every target group of the ASG they
+// are registered in by instance id
+type targetHealthCondition struct {
+	asg    *autoscaling.Group
+	health *targetHealthCache
+}
+
+func (c targetHealthCondition) name() string { return "target-health" }
+
+func (c targetHealthCondition) healthy(instanceIds []string) ([]string, error) {
+	unhealthy, err := unhealthyTargets(c.asg, c.health)
+	if err != nil {
+		return nil, err
+	}
+	return filterStrings(instanceIds, func(instanceID string) bool {
+		if reason, ok := unhealthy[instanceID]; ok {
+			log.Printf("[WARN] latest instance %s is %s, not counting it as healthy", instanceID, reason)
+			return false
+		}
+		return true
+	}), nil
+}
+
+// unhealthyTargets returns the targets registered by instance id that aren't healthy in some
+// target group of the ASG, with the target group's reason
+func unhealthyTargets(asg *autoscaling.Group, health *targetHealthCache) (map[string]string, error) {
+	unhealthy := make(map[string]string)
+	for _, tg := range asg.TargetGroupARNs {
+		descriptions, err := health.describe(*tg)
+		if err != nil {
+			return nil, err
+		}
+		for _, description := range descriptions {
+			state := aws.StringValue(description.TargetHealth.State)
+			if state == elbv2.TargetHealthStateEnumHealthy {
+				continue
+			}
+			if state == elbv2.TargetHealthStateEnumUnavailable {
+				// health checks are disabled, which says nothing about the target
+				log.Printf("[WARN] target %s is %s in %s, health checks are disabled so its health is unknown", aws.StringValue(description.Target.Id), state, *tg)
+				continue
+			}
+			reason := state + " in " + *tg
+			if aws.StringValue(description.TargetHealth.Reason) != "" {
+				reason += " (" + aws.StringValue(description.TargetHealth.Reason) + ")"
+			}
+			unhealthy[aws.StringValue(description.Target.Id)] = reason
+		}
+	}
+	return unhealthy, nil
+}
+
+// reportUnhealthyLatest marks latest instances past their warmup that are unhealthy in a target
+// group of the ASG, since counting them as replacement capacity defeats the latest instances
+// check. They are only excluded from that check with --exclude-unhealthy-latest.
+func reportUnhealthyLatest(ec2Client *ec2.EC2, asg *autoscaling.Group, health *targetHealthCache, instanceIds []string, options *Options) error {
+	if len(asg.TargetGroupARNs) == 0 || len(instanceIds) == 0 {
+		return nil
+	}
+	unhealthy, err := unhealthyTargets(asg, health)
+	if err != nil {
+		return err
+	}
+	warm, err := filterWarmedUp(ec2Client, asg, instanceIds, 0, options)
+	if err != nil {
+		return err
+	}
+	for _, instanceID := range warm {
+		if reason, ok := unhealthy[instanceID]; ok {
+			log.Printf("[WARN] latest instance %s is %s", instanceID, reason)
+			stats.markState(instanceID, stateLatestUnhealthy)
+		}
+	}
+	return nil
+}
+
+// probeCondition keeps instances answering the --health-url-template probe
+type probeCondition struct {
+	ec2Client *ec2.EC2
+	options   *Options
+}
+
+func (c probeCondition) name() string { return "probe" }
+
+func (c probeCondition) healthy(instanceIds []string) ([]string, error) {
+	return probeInstances(c.ec2Client, instanceIds, c.options)
+}
+
+// metricCondition keeps instances whose latest datapoint of a CloudWatch metric with their
+// InstanceId dimension passes a comparison. Instances without a recent datapoint don't pass.
+type metricCondition struct {
+	cwClient  *cloudwatch.CloudWatch
+	spec      string
+	namespace string
+	metric    string
+	statistic string
+	op        string
+	threshold float64
+}
+
+// metricOperators are the comparisons of cloudwatch: conditions, two-character ones first
+var metricOperators = []string{"<=", ">=", "<", ">"}
+
+// parseMetricCondition parses cloudwatch:<namespace>:<metric>:<statistic><op><threshold>
+func parseMetricCondition(cwClient *cloudwatch.CloudWatch, spec string) (metricCondition, error) {
+	c := metricCondition{cwClient: cwClient, spec: spec}
+	parts := strings.SplitN(strings.TrimPrefix(spec, "cloudwatch:"), ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return c, errors.Errorf("invalid health condition %q, expected cloudwatch:<namespace>:<metric>:<statistic><op><threshold>", spec)
+	}
+	c.namespace, c.metric = parts[0], parts[1]
+	for _, op := range metricOperators {
+		if i := strings.Index(parts[2], op); i > 0 {
+			c.statistic, c.op = parts[2][:i], op
+			threshold, err := strconv.ParseFloat(parts[2][i+len(op):], 64)
+			if err != nil {
+				return c, errors.Errorf("invalid threshold in health condition %q", spec)
+			}
+			c.threshold = threshold
+			break
+		}
+	}
+	switch c.statistic {
+	case cloudwatch.StatisticMaximum, cloudwatch.StatisticAverage, cloudwatch.StatisticSum, cloudwatch.StatisticMinimum, cloudwatch.StatisticSampleCount:
+	default:
+		return c, errors.Errorf("invalid health condition %q, expected a statistic like Maximum followed by one of %v and a threshold", spec, metricOperators)
+	}
+	return c, nil
+}
+
+func (c metricCondition) name() string { return c.spec }
+
+func (c metricCondition) passes(value float64) bool {
+	switch c.op {
+	case "<=":
+		return value <= c.threshold
+	case ">=":
+		return value >= c.threshold
+	case "<":
+		return value < c.threshold
+	default:
+		return value > c.threshold
+	}
+}
+
+func (c metricCondition) healthy(instanceIds []string) ([]string, error) {
+	healthy := make([]string, 0, len(instanceIds))
+	for _, instanceID := range instanceIds {
+		value, ok, err := latestInstanceMetric(c.cwClient, c.namespace, c.metric, c.statistic, instanceID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			log.Printf("[WARN] latest instance %s has no recent %s/%s datapoint, not counting it as healthy", instanceID, c.namespace, c.metric)
+			continue
+		}
+		if !c.passes(value) {
+			log.Printf("[WARN] latest instance %s has %s %s/%s %v, not %s %v, not counting it as healthy", instanceID, c.statistic, c.namespace, c.metric, value, c.op, c.threshold)
+			continue
+		}
+		healthy = append(healthy, instanceID)
+	}
+	return healthy, nil
+}
+
+// commandPollInterval is how often the invocations of an ssm: condition's command are checked
+const commandPollInterval = 5 * time.Second
+
+// commandCondition keeps instances on which an SSM document, e.g. a team's own health check
+// script, runs successfully within --health-command-timeout
+type commandCondition struct {
+	ssmClient *ssm.SSM
+	spec      string
+	document  string
+	command   string
+	options   *Options
+}
+
+// parseCommandCondition parses ssm:<document>[:<command>], the command being passed as the
+// commands parameter of documents like AWS-RunShellScript
+func parseCommandCondition(ssmClient *ssm.SSM, spec string, options *Options) (commandCondition, error) {
+	parts := strings.SplitN(strings.TrimPrefix(spec, "ssm:"), ":", 2)
+	if parts[0] == "" {
+		return commandCondition{}, errors.Errorf("invalid health condition %q, expected ssm:<document>[:<command>]", spec)
+	}
+	c := commandCondition{ssmClient: ssmClient, spec: spec, document: parts[0], options: options}
+	if len(parts) == 2 {
+		c.command = parts[1]
+	}
+	return c, nil
+}
+
+func (c commandCondition) name() string { return c.spec }
+
+func (c commandCondition) healthy(instanceIds []string) ([]string, error) {
+	if len(instanceIds) == 0 {
+		return instanceIds, nil
+	}
+	var parameters map[string][]*string
+	if c.command != "" {
+		parameters = map[string][]*string{"commands": {aws.String(c.command)}}
+	}
+	commandIds := make([]string, 0)
+	for partition := range gopart.Partition(len(instanceIds), 50) {
+		req, resp := c.ssmClient.SendCommandRequest(&ssm.SendCommandInput{
+			DocumentName:   aws.String(c.document),
+			InstanceIds:    aws.StringSlice(instanceIds[partition.Low:partition.High]),
+			Parameters:     parameters,
+			TimeoutSeconds: aws.Int64(int64(c.options.HealthCommandTimeout / time.Second)),
+		})
+		if err := mutate(req, c.options.DryRun); err != nil {
+			return nil, errors.Wrapf(err, "could not run %s on latest instances", c.document)
+		}
+		if !c.options.DryRun {
+			commandIds = append(commandIds, aws.StringValue(resp.Command.CommandId))
+		}
+	}
+	if c.options.DryRun {
+		log.Printf("[DRYRUN] counting %d latest instances as passing %s", len(instanceIds), c.spec)
+		return instanceIds, nil
+	}
+
+	statuses := make(map[string]string, len(instanceIds))
+	deadline := time.Now().Add(c.options.HealthCommandTimeout)
+	for {
+		pending := 0
+		for _, commandID := range commandIds {
+			err := c.ssmClient.ListCommandInvocationsPages(&ssm.ListCommandInvocationsInput{
+				CommandId: aws.String(commandID),
+			}, func(page *ssm.ListCommandInvocationsOutput, lastPage bool) bool {
+				for _, invocation := range page.CommandInvocations {
+					status := aws.StringValue(invocation.Status)
+					statuses[aws.StringValue(invocation.InstanceId)] = status
+					switch status {
+					case ssm.CommandInvocationStatusPending, ssm.CommandInvocationStatusInProgress, ssm.CommandInvocationStatusDelayed, ssm.CommandInvocationStatusCancelling:
+						pending++
+					}
+				}
+				return true
+			})
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not list invocations of %s", c.document)
+			}
+		}
+		if pending == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(commandPollInterval)
+	}
+
+	return filterStrings(instanceIds, func(instanceID string) bool {
+		if status := statuses[instanceID]; status != ssm.CommandInvocationStatusSuccess {
+			if status == "" {
+				status = "not run"
+			}
+			log.Printf("[WARN] %s on latest instance %s is %s, not counting it as healthy", c.document, instanceID, status)
+			return false
+		}
+		return true
+	}), nil
+}
+
+// healthConditions returns the conditions named by --health-condition. Without any, the ASG's
+// own health is used when it has no target groups, warmup always, and the probe when
+// --health-url-template is set. slowStart extends the warmup.
+func healthConditions(sess *session.Session, ec2Client *ec2.EC2, asg *autoscaling.Group, health *targetHealthCache, slowStart time.Duration, options *Options) ([]healthCondition, error) {
+	names := options.HealthConditions
+	if len(names) == 0 {
+		if len(asg.TargetGroupARNs) == 0 {
+			names = append(names, "asg")
+		}
+		names = append(names, "warmup")
+		if options.HealthURLTemplate != "" {
+			names = append(names, "probe")
+		}
+	}
+	if options.ExcludeUnhealthyLatest && len(asg.TargetGroupARNs) > 0 {
+		names = append(names, "target-health")
+	}
+
+	conditions := make([]healthCondition, 0, len(names))
+	for _, name := range names {
+		switch name {
+		case "asg":
+			conditions = append(conditions, asgHealthCondition{asg: asg})
+		case "warmup":
+			conditions = append(conditions, warmupCondition{ec2Client: ec2Client, asg: asg, slowStart: slowStart, options: options})
+		case "target-health":
+			conditions = append(conditions, targetHealthCondition{asg: asg, health: health})
+		case "probe":
+			if options.HealthURLTemplate == "" {
+				return nil, errors.New("health condition probe needs --health-url-template")
+			}
+			conditions = append(conditions, probeCondition{ec2Client: ec2Client, options: options})
+		default:
+			var condition healthCondition
+			var err error
+			switch {
+			case strings.HasPrefix(name, "cloudwatch:"):
+				condition, err = parseMetricCondition(cloudwatch.New(sess), name)
+			case strings.HasPrefix(name, "ssm:"):
+				condition, err = parseCommandCondition(ssm.New(sess), name, options)
+			default:
+				err = errors.Errorf("invalid health condition %q, expected asg, warmup, target-health, probe, cloudwatch:... or ssm:...", name)
+			}
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, condition)
+		}
+	}
+	return conditions, nil
+}
+
+// filterHealthy returns the instances passing every condition, in order
+func filterHealthy(conditions []healthCondition, instanceIds []string) ([]string, error) {
+	for _, condition := range conditions {
+		before := len(instanceIds)
+		var err error
+		instanceIds, err = condition.healthy(instanceIds)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("[DEBUG] health condition %s: %d of %d latest instances healthy", condition.name(), len(instanceIds), before)
+	}
+	return instanceIds, nil
+}
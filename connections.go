@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/pkg/errors"
+)
+
+// drainMetricPollInterval is how often the drain metric is re-queried while waiting
+const drainMetricPollInterval = 30 * time.Second
+
+// latestDrainMetric returns the most recent datapoint of the drain metric for an instance, and
+// false if there is no recent datapoint.
+func latestDrainMetric(cwClient *cloudwatch.CloudWatch, instanceID string, options *Options) (float64, bool, error) {
+	return latestInstanceMetric(cwClient, options.DrainMetricNamespace, options.DrainMetricName, options.DrainMetricStatistic, instanceID)
+}
+
+// latestInstanceMetric returns the most recent datapoint of the last 5 minutes of a metric with
+// the instance's InstanceId dimension, and false if there is none
+func latestInstanceMetric(cwClient *cloudwatch.CloudWatch, namespace, metric, statistic, instanceID string) (float64, bool, error) {
+	now := time.Now()
+	resp, err := cwClient.GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String(namespace),
+		MetricName: aws.String(metric),
+		Dimensions: []*cloudwatch.Dimension{
+			{Name: aws.String("InstanceId"), Value: aws.String(instanceID)},
+		},
+		StartTime:  aws.Time(now.Add(-5 * time.Minute)),
+		EndTime:    aws.Time(now),
+		Period:     aws.Int64(60),
+		Statistics: []*string{aws.String(statistic)},
+	})
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "could not get %s/%s for instance %s", namespace, metric, instanceID)
+	}
+
+	var latest *cloudwatch.Datapoint
+	for _, dp := range resp.Datapoints {
+		if latest == nil || dp.Timestamp.After(*latest.Timestamp) {
+			latest = dp
+		}
+	}
+	if latest == nil {
+		return 0, false, nil
+	}
+	switch statistic {
+	case cloudwatch.StatisticAverage:
+		return aws.Float64Value(latest.Average), true, nil
+	case cloudwatch.StatisticSum:
+		return aws.Float64Value(latest.Sum), true, nil
+	case cloudwatch.StatisticMinimum:
+		return aws.Float64Value(latest.Minimum), true, nil
+	case cloudwatch.StatisticSampleCount:
+		return aws.Float64Value(latest.SampleCount), true, nil
+	default:
+		return aws.Float64Value(latest.Maximum), true, nil
+	}
+}
+
+// waitForConnectionDrain waits until the drain metric of each instance falls to or below
+// options.DrainMetricThreshold. Instances still above the threshold after options.DrainMetricTimeout
+// are dropped so they keep their protection. An instance without a recent datapoint isn't known
+// to be drained and is waited on too, unless options.DrainMetricMissingDrained is set.
+func waitForConnectionDrain(cwClient *cloudwatch.CloudWatch, instanceIds []*string, options *Options) ([]*string, error) {
+	deadline := time.Now().Add(options.DrainMetricTimeout)
+	pending := make(map[string]bool, len(instanceIds))
+	for _, instanceID := range instanceIds {
+		pending[*instanceID] = true
+	}
+
+	for {
+		for instanceID := range pending {
+			value, ok, err := latestDrainMetric(cwClient, instanceID, options)
+			if err != nil {
+				return nil, err
+			}
+			if !ok && !options.DrainMetricMissingDrained {
+				log.Printf("[INFO] waiting for instance %s to drain: no recent %s datapoint", instanceID, options.DrainMetricName)
+				continue
+			}
+			if !ok || value <= options.DrainMetricThreshold {
+				log.Printf("[DEBUG] instance %s drained: %s=%v", instanceID, options.DrainMetricName, value)
+				delete(pending, instanceID)
+				continue
+			}
+			log.Printf("[INFO] waiting for instance %s to drain: %s=%v > %v", instanceID, options.DrainMetricName, value, options.DrainMetricThreshold)
+		}
+
+		if len(pending) == 0 {
+			return instanceIds, nil
+		}
+		if options.DryRun {
+			log.Printf("[DRYRUN] would wait up to %s for %d instances to drain", options.DrainMetricTimeout, len(pending))
+			return instanceIds, nil
+		}
+		if time.Now().Add(drainMetricPollInterval).After(deadline) {
+			break
+		}
+		time.Sleep(drainMetricPollInterval)
+	}
+
+	return filterInstanceIds(instanceIds, func(instanceID string) bool {
+		if pending[instanceID] {
+			log.Printf("[WARN] instance %s did not drain within %s, keeping scale in protection", instanceID, options.DrainMetricTimeout)
+			return false
+		}
+		return true
+	}), nil
+}
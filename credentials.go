@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/pkg/errors"
+)
+
+// assumeRole returns a copy of the session using credentials of the role, which the SDK refreshes
+// shortly before they expire so long runs outlive the STS session duration.
+func assumeRole(sess *session.Session, roleARN string, runID string) *session.Session {
+	creds := stscreds.NewCredentials(sess, roleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = "remove-instance-protection-" + runID
+		p.ExpiryWindow = time.Minute
+	})
+	return sess.Copy(&aws.Config{Credentials: creds})
+}
+
+// checkCredentialExpiry fails early, or warns, if the session's credentials will expire before the
+// run is expected to finish. Credentials that are refreshed automatically are not a concern.
+func checkCredentialExpiry(sess *session.Session, options *Options) error {
+	creds, err := sess.Config.Credentials.Get()
+	if err != nil {
+		return errors.Wrap(err, "could not load AWS credentials")
+	}
+	if options.AssumeRoleARN != "" {
+		log.Printf("[DEBUG] credentials for %s are refreshed automatically", options.AssumeRoleARN)
+		return nil
+	}
+
+	expiresAt, err := sess.Config.Credentials.ExpiresAt()
+	if err != nil {
+		log.Printf("[SPAM] credentials from %s don't report an expiry", creds.ProviderName)
+		return nil
+	}
+
+	expected := options.ExpectedRunDuration
+	if options.Timeout > 0 {
+		expected = options.Timeout
+	}
+	remaining := time.Until(expiresAt)
+	log.Printf("[DEBUG] credentials from %s expire in %s", creds.ProviderName, remaining.Round(time.Second))
+	if remaining > expected {
+		return nil
+	}
+	if options.RefuseExpiringCredentials {
+		return guardError("credentials from %s expire in %s, before the expected run duration of %s", creds.ProviderName, remaining.Round(time.Second), expected)
+	}
+	log.Printf("[WARN] credentials from %s expire in %s, before the expected run duration of %s", creds.ProviderName, remaining.Round(time.Second), expected)
+	return nil
+}
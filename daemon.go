@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	mathrand "math/rand"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// exitInterrupted is the exit code used when a second signal forces an immediate exit
+const exitInterrupted = 130
+
+// signalContext returns a context canceled on the first SIGINT or SIGTERM, so in-flight AWS calls
+// are abandoned and the daemon loop stops. A second signal exits immediately. Handling the signals
+// explicitly also matters when running as PID 1 in a container, where the default handlers don't apply.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("[WARN] received %s, stopping", sig)
+		cancel()
+		sig = <-signals
+		log.Printf("[ERROR] received %s again, exiting immediately", sig)
+		os.Exit(exitInterrupted)
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// writeHealth records the outcome of the last run for container health checks. The file holds
+// "ok <time>" after a successful run and "error <time> <message>" after a failed one.
+func writeHealth(path string, runErr error) {
+	if path == "" {
+		return
+	}
+	status := fmt.Sprintf("ok %s\n", time.Now().UTC().Format(time.RFC3339))
+	if runErr != nil {
+		status = fmt.Sprintf("error %s %v\n", time.Now().UTC().Format(time.RFC3339), runErr)
+	}
+	if err := ioutil.WriteFile(path, []byte(status), 0644); err != nil {
+		log.Printf("[ERROR] could not write health file %s: %v", path, err)
+	}
+}
+
+// splay waits a random time up to max, so many scheduled replicas don't call the AWS APIs at
+// the same instant. It returns false if the context was canceled while waiting.
+func splay(ctx context.Context, max time.Duration) bool {
+	if max <= 0 {
+		return true
+	}
+	delay := time.Duration(mathrand.Int63n(int64(max)))
+	log.Printf("[DEBUG] waiting %s before starting the run", delay.Round(time.Second))
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
+
+// runResult is what is kept of the run of one ASG once the next one resets stats. Child
+// processes of parallel organization sweeps hand it to their parent, including their error.
+type runResult struct {
+	Start     time.Time      `json:"start"`
+	Stale     int            `json:"stale"`
+	APICalls  map[string]int `json:"api_calls"`
+	ErrorKind string         `json:"error_kind,omitempty"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// currentRunResult returns the result of the run recorded in stats
+func currentRunResult() runResult {
+	return runResult{Start: stats.start, Stale: staleInstances(), APICalls: stats.apiCallCounts()}
+}
+
+// runHooks report the run of each ASG, which an organization sweep does once per account: its
+// report file, notification and history record, and in daemon mode its drift
+type runHooks struct {
+	daemon bool
+	// drifts are the drift trackers by asgLabel, since a sweep runs several accounts or ASGs.
+	// Accounts swept in parallel are observed concurrently, so mu guards the map.
+	mu     sync.Mutex
+	drifts map[string]*driftTracker
+}
+
+// finish reports the run of an ASG just done, while stats still holds it
+func (h *runHooks) finish(options *Options, err error, result runResult) {
+	if h == nil {
+		return
+	}
+	sess := stats.session
+	if sess == nil {
+		sess = newSession(options)
+	}
+	writeReport(sess, options, err)
+	notify(sess, options, err)
+	saveHistory(sess, options, err)
+	h.observe(sess, options, err, result)
+}
+
+// observe tracks the drift of the ASG after a successful daemon run
+func (h *runHooks) observe(sess *session.Session, options *Options, err error, result runResult) {
+	if h == nil || !h.daemon || err != nil {
+		return
+	}
+	h.mu.Lock()
+	drift, ok := h.drifts[asgLabel(options)]
+	if !ok {
+		drift = &driftTracker{}
+		h.drifts[asgLabel(options)] = drift
+	}
+	h.mu.Unlock()
+	drift.observe(sess, options, result)
+}
+
+// runLoop runs the update once, or with --daemon every --interval until a signal arrives.
+// In daemon mode a failed run is logged and retried at the next interval.
+func runLoop(options *Options) error {
+	ctx, stop := signalContext()
+	defer stop()
+	mathrand.Seed(time.Now().UnixNano())
+
+	daemon := options.Daemon && !options.Once
+	hooks := &runHooks{daemon: daemon, drifts: make(map[string]*driftTracker)}
+	for {
+		if !splay(ctx, options.Splay) {
+			log.Printf("[INFO] stopped before the run started")
+			return nil
+		}
+		err := runOnce(ctx, options, hooks)
+		writeHealth(options.HealthFile, err)
+		if !daemon {
+			return err
+		}
+		if err != nil {
+			log.Printf("[ERROR] error updating: %v", err)
+		}
+
+		log.Printf("[DEBUG] next run in %s", options.Interval)
+		select {
+		case <-ctx.Done():
+			log.Printf("[INFO] daemon stopped")
+			return nil
+		case <-time.After(options.Interval):
+		}
+	}
+}
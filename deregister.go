@@ -0,0 +1,363 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/meirf/gopart"
+	"github.com/pkg/errors"
+)
+
+// multiError collects errors from concurrent work so that one failure doesn't hide the others
+type multiError []error
+
+func (m multiError) Error() string {
+	msgs := make([]string, 0, len(m))
+	for _, err := range m {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Outcomes of deregistering a target, as recorded in the report
+const (
+	targetDeregistered = "deregistered"
+	targetGone         = "gone"
+	targetFailed       = "failed"
+)
+
+// targetOutcome is the result of deregistering one target from one target group
+type targetOutcome struct {
+	TargetGroup string `json:"target_group"`
+	Target      string `json:"target"`
+	Instance    string `json:"instance"`
+	Outcome     string `json:"outcome"`
+	Error       string `json:"error,omitempty"`
+}
+
+// drainer removes old instances from the ASG's target groups
+type drainer struct {
+	albClient *elbv2.ELBV2
+	ec2Client *ec2.EC2
+	health    *targetHealthCache
+	options   *Options
+
+	// instanceAZs maps instance ids to their availability zone, for per-AZ healthy accounting
+	instanceAZs map[string]string
+	// weights are the capacity units of the ASG's instances, for per-AZ healthy accounting
+	weights capacityWeights
+	// targetTypes maps target group ARNs to their target type (instance, ip or lambda)
+	targetTypes map[string]string
+	// ipInstances maps private IPs of old instances to their instance id, for ip target groups
+	ipInstances map[string]string
+
+	mu sync.Mutex
+	// deferred holds instances kept in a target group to protect an AZ's healthy floor
+	deferred map[string]bool
+}
+
+func newDrainer(albClient *elbv2.ELBV2, ec2Client *ec2.EC2, health *targetHealthCache, options *Options, instanceAZs map[string]string, weights capacityWeights) *drainer {
+	return &drainer{
+		albClient:   albClient,
+		ec2Client:   ec2Client,
+		health:      health,
+		options:     options,
+		instanceAZs: instanceAZs,
+		weights:     weights,
+		targetTypes: make(map[string]string),
+		ipInstances: make(map[string]string),
+		deferred:    make(map[string]bool),
+	}
+}
+
+// loadTargetTypes looks up the target type of every target group, and if any of them register
+// targets by IP, the private IPs of the given instances.
+func (d *drainer) loadTargetTypes(targetGroupARNs []*string, instanceIds []*string) error {
+	hasIPTargets := false
+	for partition := range gopart.Partition(len(targetGroupARNs), 20) {
+		resp, err := d.albClient.DescribeTargetGroups(&elbv2.DescribeTargetGroupsInput{
+			TargetGroupArns: targetGroupARNs[partition.Low:partition.High],
+		})
+		if err != nil {
+			return errors.Wrap(err, "could not describe target groups")
+		}
+		for _, tg := range resp.TargetGroups {
+			targetType := aws.StringValue(tg.TargetType)
+			d.targetTypes[*tg.TargetGroupArn] = targetType
+			if targetType == elbv2.TargetTypeEnumIp {
+				hasIPTargets = true
+			}
+		}
+	}
+	if !hasIPTargets || len(instanceIds) == 0 {
+		return nil
+	}
+
+	log.Printf("[DEBUG] describing %d instances to map them to ip targets", len(instanceIds))
+	err := d.ec2Client.DescribeInstancesPages(&ec2.DescribeInstancesInput{
+		InstanceIds: instanceIds,
+	}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				for _, eni := range instance.NetworkInterfaces {
+					for _, ip := range eni.PrivateIpAddresses {
+						if ip.PrivateIpAddress != nil {
+							d.ipInstances[*ip.PrivateIpAddress] = *instance.InstanceId
+						}
+					}
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not describe instances for ip target groups")
+	}
+	return nil
+}
+
+// instanceFor returns the instance id behind a target, resolving ip targets to their instance
+func (d *drainer) instanceFor(target *elbv2.TargetDescription) string {
+	if instanceID, ok := d.ipInstances[*target.Id]; ok {
+		return instanceID
+	}
+	return *target.Id
+}
+
+// instancesFor returns the instance ids behind targets
+func (d *drainer) instancesFor(targets []*elbv2.TargetDescription) []string {
+	instanceIds := make([]string, 0, len(targets))
+	for _, target := range targets {
+		instanceIds = append(instanceIds, d.instanceFor(target))
+	}
+	return instanceIds
+}
+
+// isDeferred reports whether the instance was left registered in at least one target group
+func (d *drainer) isDeferred(instanceID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.deferred[instanceID]
+}
+
+// deregisterFromTargetGroups removes the given instances from every target group, working on at
+// most options.TargetGroupConcurrency target groups at once.
+func (d *drainer) deregisterFromTargetGroups(targetGroupARNs []*string, instanceIds []*string) error {
+	if err := d.loadTargetTypes(targetGroupARNs, instanceIds); err != nil {
+		return err
+	}
+	if !d.options.DryRun {
+		stats.timelineStep(stepDrainStarted, aws.StringValueSlice(instanceIds))
+	}
+
+	concurrency := d.options.TargetGroupConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs multiError
+	)
+	sem := make(chan struct{}, concurrency)
+	for _, tg := range targetGroupARNs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(tg *string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := keepGoing(d.options, d.deregisterFromTargetGroup(tg, instanceIds)); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(tg)
+	}
+	wg.Wait()
+
+	if len(errs) == len(targetGroupARNs) {
+		return errors.Wrapf(errs, "%d of %d target groups failed", len(errs), len(targetGroupARNs))
+	}
+	if len(errs) > 0 {
+		return partialFailureError(errs, len(errs), len(targetGroupARNs), "target groups")
+	}
+	return nil
+}
+
+func (d *drainer) deregisterFromTargetGroup(tg *string, instanceIds []*string) error {
+	if targetType := d.targetTypes[*tg]; targetType == elbv2.TargetTypeEnumLambda {
+		log.Printf("[DEBUG] skipping target group %s with target type %s", *tg, targetType)
+		return nil
+	}
+
+	descriptions, err := d.health.describe(*tg)
+	if err != nil {
+		return err
+	}
+
+	old := make(map[string]bool, len(instanceIds))
+	for _, instanceID := range instanceIds {
+		old[*instanceID] = true
+	}
+	targets := make([]*elbv2.TargetDescription, 0)
+	for _, h := range descriptions {
+		if old[d.instanceFor(h.Target)] {
+			targets = append(targets, h.Target)
+		}
+	}
+	targets = d.paceByAZ(*tg, descriptions, targets)
+
+	for partition := range gopart.Partition(len(targets), 50) {
+		targets := targets[partition.Low:partition.High]
+
+		req, _ := d.albClient.DeregisterTargetsRequest(&elbv2.DeregisterTargetsInput{
+			TargetGroupArn: tg,
+			Targets:        targets,
+		})
+		if err := mutate(req, d.options.DryRun); err != nil {
+			d.health.invalidate(*tg)
+			if !isInvalidTarget(err) {
+				return errors.Wrapf(err, "could not deregister targets from %s", *tg)
+			}
+			log.Printf("[WARN] could not deregister %d targets from %s at once, retrying one by one: %v", len(targets), *tg, err)
+			if err := d.deregisterEach(tg, targets); err != nil {
+				return err
+			}
+			continue
+		}
+		d.recordTargets(*tg, targets, targetDeregistered, nil)
+		if d.options.DryRun {
+			stats.action("targets deregistered (dry-run)", len(targets))
+			continue
+		}
+		d.health.invalidate(*tg)
+		stats.timelineStep(stepDeregistered, d.instancesFor(targets))
+		log.Printf("[INFO] Removed %d instances from %s", len(targets), *tg)
+		stats.action("targets deregistered", len(targets))
+	}
+	return nil
+}
+
+// deregisterEach deregisters targets one at a time after a batch failed with InvalidTarget,
+// which fails the whole batch when any one target is gone. Targets that are gone are already
+// out of the target group, so only the others count as failures.
+func (d *drainer) deregisterEach(tg *string, targets []*elbv2.TargetDescription) error {
+	var errs multiError
+	for _, target := range targets {
+		req, _ := d.albClient.DeregisterTargetsRequest(&elbv2.DeregisterTargetsInput{
+			TargetGroupArn: tg,
+			Targets:        []*elbv2.TargetDescription{target},
+		})
+		err := mutate(req, d.options.DryRun)
+		switch {
+		case err == nil:
+			d.recordTargets(*tg, []*elbv2.TargetDescription{target}, targetDeregistered, nil)
+			stats.timelineStep(stepDeregistered, []string{d.instanceFor(target)})
+			stats.action("targets deregistered", 1)
+		case isInvalidTarget(err):
+			log.Printf("[INFO] target %s is no longer registered in %s, nothing to deregister", *target.Id, *tg)
+			d.recordTargets(*tg, []*elbv2.TargetDescription{target}, targetGone, nil)
+			stats.action("targets already gone", 1)
+		default:
+			d.recordTargets(*tg, []*elbv2.TargetDescription{target}, targetFailed, err)
+			errs = append(errs, errors.Wrapf(err, "could not deregister %s from %s", *target.Id, *tg))
+		}
+	}
+	d.health.invalidate(*tg)
+	if len(errs) > 0 {
+		return partialFailureError(errs, len(errs), len(targets), "targets in "+*tg)
+	}
+	return nil
+}
+
+// recordTargets records the outcome of deregistering targets from a target group for the report
+func (d *drainer) recordTargets(tg string, targets []*elbv2.TargetDescription, outcome string, err error) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	for _, target := range targets {
+		result := targetOutcome{
+			TargetGroup: tg,
+			Target:      *target.Id,
+			Instance:    d.instanceFor(target),
+			Outcome:     outcome,
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		stats.targets = append(stats.targets, result)
+	}
+}
+
+// isInvalidTarget reports whether DeregisterTargets failed because a target is not, or no
+// longer, a valid target, as happens for instances terminated since they were described
+func isInvalidTarget(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == elbv2.ErrCodeInvalidTargetException
+}
+
+// targetAZ returns the availability zone of a target, or "" if unknown
+func (d *drainer) targetAZ(target *elbv2.TargetDescription) string {
+	if az, ok := d.instanceAZs[d.instanceFor(target)]; ok {
+		return az
+	}
+	if target.AvailabilityZone != nil {
+		return *target.AvailabilityZone
+	}
+	return ""
+}
+
+// paceByAZ drops targets whose removal would leave their availability zone with fewer than
+// options.MinHealthyPerAZ capacity units of healthy targets in the target group. Dropped
+// instances are recorded as deferred so their protection is left in place until a later run.
+func (d *drainer) paceByAZ(tg string, descriptions []*elbv2.TargetHealthDescription, targets []*elbv2.TargetDescription) []*elbv2.TargetDescription {
+	if d.options.MinHealthyPerAZ <= 0 {
+		return targets
+	}
+
+	minHealthy := float64(d.options.MinHealthyPerAZ)
+	healthyByAZ := make(map[string]float64)
+	healthyTargets := make(map[string]bool)
+	unavailable := 0
+	for _, h := range descriptions {
+		if h.TargetHealth != nil && aws.StringValue(h.TargetHealth.State) == elbv2.TargetHealthStateEnumUnavailable {
+			unavailable++
+		}
+		if h.TargetHealth == nil || h.TargetHealth.State == nil || *h.TargetHealth.State != elbv2.TargetHealthStateEnumHealthy {
+			continue
+		}
+		healthyByAZ[d.targetAZ(h.Target)] += d.weights.weight(d.instanceFor(h.Target))
+		healthyTargets[*h.Target.Id] = true
+	}
+	if unavailable > 0 {
+		log.Printf("[WARN] %d targets in %s are unavailable because health checks are disabled, `--min-healthy-per-az` can't tell how many of them are healthy", unavailable, tg)
+	}
+
+	allowed := make([]*elbv2.TargetDescription, 0, len(targets))
+	for _, target := range targets {
+		if !healthyTargets[*target.Id] {
+			// removing an unhealthy target doesn't reduce healthy capacity
+			allowed = append(allowed, target)
+			continue
+		}
+		az := d.targetAZ(target)
+		instanceID := d.instanceFor(target)
+		weight := d.weights.weight(instanceID)
+		if healthyByAZ[az]-weight < minHealthy {
+			log.Printf("[WARN] deferring instance %s: AZ %q of target group %s would drop below %v healthy capacity units", instanceID, az, tg, minHealthy)
+			d.mu.Lock()
+			d.deferred[instanceID] = true
+			d.mu.Unlock()
+			stats.action("targets deferred", 1)
+			continue
+		}
+		healthyByAZ[az] -= weight
+		allowed = append(allowed, target)
+	}
+	return allowed
+}
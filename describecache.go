@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// describeBatchSize is how many ids are described per request, to keep requests for very large
+// ASGs well within the API's size limits
+const describeBatchSize = 200
+
+// describeCache memoizes lookups that don't change during a run: instance descriptions, AMIs and
+// the launch template's latest version. Several checks describe the same instances, which for
+// ASGs with hundreds of instances adds up to many calls.
+type describeCache struct {
+	mu             sync.Mutex
+	instances      map[string]*ec2.Instance
+	images         map[string]*ec2.Image
+	latestVersions map[string]int64
+}
+
+func newDescribeCache() *describeCache {
+	return &describeCache{
+		instances:      make(map[string]*ec2.Instance),
+		images:         make(map[string]*ec2.Image),
+		latestVersions: make(map[string]int64),
+	}
+}
+
+// describes is reset at the start of each run
+var describes = newDescribeCache()
+
+// cachedInstances returns the cached instances among instanceIds and the ids still to describe
+func (c *describeCache) cachedInstances(instanceIds []*string) (map[string]*ec2.Instance, []*string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached := make(map[string]*ec2.Instance, len(instanceIds))
+	missing := make([]*string, 0)
+	for _, instanceID := range instanceIds {
+		if instance, ok := c.instances[*instanceID]; ok {
+			cached[*instanceID] = instance
+		} else {
+			missing = append(missing, instanceID)
+		}
+	}
+	if len(cached) > 0 {
+		log.Printf("[SPAM] using %d cached instance descriptions", len(cached))
+	}
+	return cached, missing
+}
+
+func (c *describeCache) addInstances(instances map[string]*ec2.Instance) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for instanceID, instance := range instances {
+		c.instances[instanceID] = instance
+	}
+}
+
+// cachedImages returns the cached AMIs among imageIds and the ids still to describe
+func (c *describeCache) cachedImages(imageIds []*string) (map[string]*ec2.Image, []*string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached := make(map[string]*ec2.Image, len(imageIds))
+	missing := make([]*string, 0)
+	for _, imageID := range imageIds {
+		if image, ok := c.images[*imageID]; ok {
+			cached[*imageID] = image
+		} else {
+			missing = append(missing, imageID)
+		}
+	}
+	return cached, missing
+}
+
+func (c *describeCache) addImages(images []*ec2.Image) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, image := range images {
+		c.images[*image.ImageId] = image
+	}
+}
+
+func (c *describeCache) latestVersion(lt launchTemplateRef) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	version, ok := c.latestVersions[lt.ID+"/"+lt.Name]
+	return version, ok
+}
+
+func (c *describeCache) setLatestVersion(lt launchTemplateRef, version int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.latestVersions[lt.ID+"/"+lt.Name] = version
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/pkg/errors"
+)
+
+// DoctorCommand checks the environment a run depends on
+type DoctorCommand struct{}
+
+// doctorCheck is one line of the doctor checklist. A check without an error passed; hint says
+// how to fix a failed one.
+type doctorCheck struct {
+	name   string
+	detail string
+	err    error
+	hint   string
+}
+
+// requiredActions are the IAM actions a run needs, by the options that need them
+func requiredActions(options *Options) []string {
+	actions := []string{
+		"autoscaling:DescribeAutoScalingGroups",
+		"autoscaling:SetInstanceProtection",
+		"ec2:DescribeLaunchTemplates",
+		"ec2:DescribeLaunchTemplateVersions",
+		"ec2:DescribeInstances",
+		"ec2:DescribeImages",
+	}
+	if options.Deregister || options.DeregisterOnly {
+		actions = append(actions,
+			"elasticloadbalancing:DescribeTargetGroups",
+			"elasticloadbalancing:DescribeTargetHealth",
+			"elasticloadbalancing:DeregisterTargets",
+		)
+	}
+	for _, condition := range options.HealthConditions {
+		switch {
+		case strings.HasPrefix(condition, "cloudwatch:"):
+			actions = append(actions, "cloudwatch:GetMetricStatistics")
+		case strings.HasPrefix(condition, "ssm:"):
+			actions = append(actions, "ssm:SendCommand", "ssm:ListCommandInvocations")
+		}
+	}
+	return actions
+}
+
+// principalARN returns the IAM ARN of the caller to simulate policies for. Assumed role session
+// ARNs are turned into the role's ARN, which loses any path the role has.
+func principalARN(callerARN string) (string, error) {
+	parsed, err := arn.Parse(callerARN)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Service == "sts" && strings.HasPrefix(parsed.Resource, "assumed-role/") {
+		parts := strings.Split(parsed.Resource, "/")
+		parsed.Service = "iam"
+		parsed.Resource = "role/" + parts[1]
+	}
+	return parsed.String(), nil
+}
+
+// runDoctor runs every check in order, skipping those that depend on a failed one
+func runDoctor(sess *session.Session, options *Options) []doctorCheck {
+	checks := make([]doctorCheck, 0)
+
+	creds, err := sess.Config.Credentials.Get()
+	checks = append(checks, doctorCheck{name: "credentials", detail: creds.ProviderName, err: err,
+		hint: "configure credentials with environment variables, a profile or an instance role"})
+	if err != nil {
+		return checks
+	}
+
+	region := aws.StringValue(sess.Config.Region)
+	check := doctorCheck{name: "region", detail: region, hint: "set AWS_REGION or the region of your profile"}
+	if region == "" {
+		check.err = errors.New("no region configured")
+	} else if partition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		check.detail += " (partition " + partition.ID() + ")"
+	} else {
+		check.err = errors.Errorf("unknown region %s", region)
+	}
+	checks = append(checks, check)
+	if check.err != nil {
+		return checks
+	}
+
+	identity, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	check = doctorCheck{name: "identity", err: err, hint: "check that the credentials are valid and not expired"}
+	if err == nil {
+		check.detail = aws.StringValue(identity.Arn)
+	}
+	checks = append(checks, check)
+	if err != nil {
+		return checks
+	}
+
+	check = doctorCheck{name: "permissions", hint: "grant the missing actions to " + aws.StringValue(identity.Arn)}
+	if principal, err := principalARN(aws.StringValue(identity.Arn)); err != nil {
+		check.err = err
+	} else {
+		resp, err := iam.New(sess).SimulatePrincipalPolicy(&iam.SimulatePrincipalPolicyInput{
+			PolicySourceArn: aws.String(principal),
+			ActionNames:     aws.StringSlice(requiredActions(options)),
+		})
+		if err != nil {
+			check.err = errors.Wrap(err, "could not simulate policies")
+			check.hint = "grant iam:SimulatePrincipalPolicy to check permissions, or check them by hand: " + strings.Join(requiredActions(options), ", ")
+		} else {
+			denied := make([]string, 0)
+			for _, result := range resp.EvaluationResults {
+				if aws.StringValue(result.EvalDecision) != iam.PolicyEvaluationDecisionTypeAllowed {
+					denied = append(denied, aws.StringValue(result.EvalActionName))
+				}
+			}
+			check.detail = fmt.Sprintf("%d actions allowed", len(resp.EvaluationResults)-len(denied))
+			if len(denied) > 0 {
+				check.err = errors.Errorf("denied: %s", strings.Join(denied, ", "))
+			}
+		}
+	}
+	checks = append(checks, check)
+
+	resp, err := autoscaling.New(sess).DescribeAutoScalingGroups(&autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []*string{aws.String(options.ASG)},
+	})
+	check = doctorCheck{name: "auto scaling group", detail: options.ASG, err: err, hint: "check --asg and that the region and account are the ASG's"}
+	if err == nil && len(resp.AutoScalingGroups) != 1 {
+		check.err = errors.New("not found")
+	}
+	checks = append(checks, check)
+	if check.err != nil {
+		return checks
+	}
+	asg := resp.AutoScalingGroups[0]
+
+	lt := asgLaunchTemplate(asg)
+	check = doctorCheck{name: "launch template", hint: "the ASG must use a Launch Template, shared templates must be shared with this account"}
+	if lt == nil {
+		check.err = errors.New("the ASG doesn't use a Launch Template")
+	} else if version, err := describeLatestVersion(ec2.New(sess), *lt); err != nil {
+		check.err = err
+	} else {
+		check.detail = fmt.Sprintf("%s, latest version %d", lt, version)
+	}
+	checks = append(checks, check)
+
+	albClient := elbv2.New(sess)
+	for _, tg := range asg.TargetGroupARNs {
+		resp, err := albClient.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{TargetGroupArn: tg})
+		check = doctorCheck{name: "target group", detail: *tg, err: err, hint: "grant elasticloadbalancing:DescribeTargetHealth on the ASG's target groups"}
+		if err == nil {
+			check.detail += fmt.Sprintf(", %d targets", len(resp.TargetHealthDescriptions))
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// printDoctor writes the checklist and returns an error if any check failed
+func printDoctor(w io.Writer, checks []doctorCheck) error {
+	failed := 0
+	for _, check := range checks {
+		if check.err == nil {
+			fmt.Fprintf(w, "[ok]   %s: %s\n", check.name, check.detail)
+			continue
+		}
+		failed++
+		fmt.Fprintf(w, "[FAIL] %s: %v\n", check.name, check.err)
+		fmt.Fprintf(w, "       %s\n", check.hint)
+	}
+	if failed > 0 {
+		return errors.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// doDoctor checks the environment of a run and prints a checklist of what to fix
+func doDoctor(w io.Writer, options *Options) error {
+	return printDoctor(w, runDoctor(newSession(options), options))
+}
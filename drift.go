@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// driftTracker follows, across daemon runs, how long the ASG of an account has had stale instances
+type driftTracker struct {
+	since   time.Time
+	alerted bool
+}
+
+// staleInstances counts the instances of the last run that were stale or foreign, or that are on
+// the latest version but unhealthy, since the ASG hasn't converged while any are left
+func staleInstances() int {
+	n := 0
+	for _, s := range stats.instanceStates() {
+		if isStale(s[1]) || s[1] == stateLatestUnhealthy {
+			n++
+		}
+	}
+	return n
+}
+
+// observe updates the drift age after a run and alerts once per breach of --drift-slo
+func (d *driftTracker) observe(sess *session.Session, options *Options, result runResult) {
+	stale := result.Stale
+	if stale == 0 {
+		if !d.since.IsZero() {
+			log.Printf("[INFO] ASG %s has no stale instances anymore after %s", asgLabel(options), time.Since(d.since).Round(time.Minute))
+		}
+		d.since = time.Time{}
+		d.alerted = false
+		return
+	}
+	if d.since.IsZero() {
+		d.since = result.Start
+	}
+	age := time.Since(d.since)
+	log.Printf("[DEBUG] ASG %s has had stale instances for %s", asgLabel(options), age.Round(time.Minute))
+	if options.DriftSLO == 0 || age < options.DriftSLO || d.alerted {
+		return
+	}
+
+	d.alerted = true
+	message := fmt.Sprintf("ASG %s has had stale instances for %s, longer than the drift SLO of %s (%d stale now)", asgLabel(options), age.Round(time.Minute), options.DriftSLO, stale)
+	log.Printf("[WARN] %s", message)
+	if options.TeamsWebhookURL != "" {
+		payload := teamsCard([]map[string]interface{}{
+			{"type": "TextBlock", "text": "remove-instance-protection: drift SLO breached", "weight": "bolder", "size": "medium"},
+			{"type": "TextBlock", "text": message, "color": "attention", "wrap": true},
+		})
+		url, err := resolveSecret(sess, options, options.TeamsWebhookURL)
+		if err != nil {
+			log.Printf("[ERROR] %v", err)
+			return
+		}
+		if err := postTeams(httpClient, url, payload); err != nil {
+			log.Printf("[ERROR] %v", err)
+		}
+	}
+}
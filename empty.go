@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/pkg/errors"
+)
+
+// emptyReason returns why the ASG can't be rotated at all: it has no instances, or the processes
+// that launch and terminate instances are suspended. It returns "" for other ASGs.
+func emptyReason(asg *autoscaling.Group) string {
+	if len(asg.Instances) == 0 {
+		return "has no instances"
+	}
+	suspended := make(map[string]bool, len(asg.SuspendedProcesses))
+	for _, process := range asg.SuspendedProcesses {
+		suspended[aws.StringValue(process.ProcessName)] = true
+	}
+	if suspended["Launch"] && suspended["Terminate"] {
+		return "has the Launch and Terminate processes suspended"
+	}
+	return ""
+}
+
+// checkEmptyASG applies --empty-asg-policy to an empty or fully suspended ASG, recording it for
+// the report. It returns true if the run should stop without error.
+func checkEmptyASG(asg *autoscaling.Group, options *Options) (bool, error) {
+	reason := emptyReason(asg)
+	if reason == "" {
+		return false, nil
+	}
+	stats.mu.Lock()
+	stats.empty = reason
+	stats.mu.Unlock()
+
+	switch options.EmptyASGPolicy {
+	case "error":
+		return false, &runError{kind: errorKindEmpty, err: errors.Errorf("auto scaling group \"%s\" %s", options.ASG, reason)}
+	case "skip":
+		log.Printf("[INFO] ASG %s %s, nothing to do", options.ASG, reason)
+		return true, nil
+	}
+	log.Printf("[WARN] ASG %s %s", options.ASG, reason)
+	return false, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// impactEstimate is the expected impact of a rotation, for reviewers deciding whether to approve it
+type impactEstimate struct {
+	// Instances is how many instances the ASG may replace: those unprotected by this run and the
+	// stale ones that were already unprotected
+	Instances int `json:"instances"`
+	// CapacityUnits is the weighted capacity of those instances, and CapacityShare its share of
+	// the ASG's current capacity, which is at risk while replacements warm up
+	CapacityUnits float64 `json:"capacity_units"`
+	CapacityShare float64 `json:"capacity_share"`
+	// Warmup is how long each replacement needs before it counts as healthy
+	Warmup string `json:"warmup"`
+	// ExpectedDuration is a lower bound of the rotation, assuming the ASG replaces all instances
+	// at once: draining plus warmup
+	ExpectedDuration string `json:"expected_duration"`
+}
+
+// estimateImpact estimates the rotation that follows unprotecting instanceIds
+func estimateImpact(asg *autoscaling.Group, weights capacityWeights, instanceIds []string, options *Options) *impactEstimate {
+	churn := append([]string{}, instanceIds...)
+	for _, s := range stats.instanceStates() {
+		if s[1] == stateStaleUnprotected || s[1] == stateForeignUnprotected || s[1] == stateTemplateReplacedUnprotected {
+			churn = append(churn, s[0])
+		}
+	}
+	all := make([]string, 0, len(asg.Instances))
+	for _, instance := range asg.Instances {
+		all = append(all, *instance.InstanceId)
+	}
+
+	estimate := &impactEstimate{
+		Instances:     len(churn),
+		CapacityUnits: weights.total(churn),
+	}
+	if total := weights.total(all); total > 0 {
+		estimate.CapacityShare = estimate.CapacityUnits / total
+	}
+	warmup := instanceWarmup(asg, options)
+	duration := warmup
+	if options.DrainMetricName != "" {
+		duration += options.DrainMetricTimeout
+	}
+	estimate.Warmup = warmup.String()
+	estimate.ExpectedDuration = duration.Round(time.Second).String()
+
+	level := "INFO"
+	if options.DryRun {
+		level = "DRYRUN"
+	}
+	log.Printf("[%s] impact: %d instances (%.1f capacity units, %.0f%% of the ASG) may be replaced, each needing %s to warm up, taking at least %s",
+		level, estimate.Instances, estimate.CapacityUnits, estimate.CapacityShare*100, estimate.Warmup, estimate.ExpectedDuration)
+	return estimate
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/pkg/errors"
+)
+
+// parseInstanceList splits a list of instance ids separated by whitespace or commas, ignoring
+// everything after a # on each line. JSON arrays of instance ids are accepted too.
+func parseInstanceList(data string) []string {
+	instanceIds := make([]string, 0)
+	for _, line := range strings.Split(data, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		instanceIds = append(instanceIds, strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\r' || r == '[' || r == ']' || r == '"'
+		})...)
+	}
+	return instanceIds
+}
+
+// fetchInstanceList reads a list of instance ids from "ssm:<parameter-name>", "s3://<bucket>/<key>"
+// or "file:<path>"
+func fetchInstanceList(sess *session.Session, source string) ([]string, error) {
+	switch {
+	case strings.HasPrefix(source, "file:"):
+		path := strings.TrimPrefix(source, "file:")
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read %s", path)
+		}
+		return parseInstanceList(string(data)), nil
+	case strings.HasPrefix(source, "ssm:"):
+		name := strings.TrimPrefix(source, "ssm:")
+		resp, err := ssm.New(sess).GetParameter(&ssm.GetParameterInput{
+			Name:           aws.String(name),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get SSM parameter %s", name)
+		}
+		return parseInstanceList(aws.StringValue(resp.Parameter.Value)), nil
+	case strings.HasPrefix(source, "s3://"):
+		parts := strings.SplitN(strings.TrimPrefix(source, "s3://"), "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("invalid instance list source %q, expected s3://<bucket>/<key>", source)
+		}
+		resp, err := s3.New(sess).GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(parts[0]),
+			Key:    aws.String(parts[1]),
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get %s", source)
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read %s", source)
+		}
+		return parseInstanceList(string(data)), nil
+	default:
+		return nil, errors.Errorf("invalid instance list source %q, expected ssm:<parameter-name>, s3://<bucket>/<key> or file:<path>", source)
+	}
+}
+
+// excludedInstances returns the instances given with --exclude-instance and read from every
+// --exclude-source. A source that can't be read fails the run, so a pinned instance is never
+// recycled because of a transient error.
+func excludedInstances(sess *session.Session, options *Options) (map[string]bool, error) {
+	excluded := make(map[string]bool)
+	for _, instanceID := range options.ExcludeInstances {
+		excluded[instanceID] = true
+	}
+	for _, source := range options.ExcludeSources {
+		instanceIds, err := fetchInstanceList(sess, source)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("[DEBUG] %d instances excluded by %s", len(instanceIds), source)
+		for _, instanceID := range instanceIds {
+			excluded[instanceID] = true
+		}
+	}
+	return excluded, nil
+}
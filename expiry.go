@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/meirf/gopart"
+	"github.com/pkg/errors"
+)
+
+// protectedAtTag is the instance tag recording when this tool enabled scale in protection
+const protectedAtTag = "remove-instance-protection:protected-at"
+
+// tagProtectedAt records on the instances that their protection was enabled now
+func tagProtectedAt(ec2Client *ec2.EC2, instanceIds []*string, dryRun bool) error {
+	req, _ := ec2Client.CreateTagsRequest(&ec2.CreateTagsInput{
+		Resources: instanceIds,
+		Tags: []*ec2.Tag{
+			{Key: aws.String(protectedAtTag), Value: aws.String(time.Now().UTC().Format(time.RFC3339))},
+		},
+	})
+	if err := mutate(req, dryRun); err != nil {
+		return errors.Wrap(err, "could not tag protected instances")
+	}
+	return nil
+}
+
+// untagProtectedAt removes the protected-at tag from instances whose protection was removed, so
+// reconcile doesn't take them for instances that lost their protection by accident
+func untagProtectedAt(ec2Client *ec2.EC2, instanceIds []*string, dryRun bool) error {
+	req, _ := ec2Client.DeleteTagsRequest(&ec2.DeleteTagsInput{
+		Resources: instanceIds,
+		Tags:      []*ec2.Tag{{Key: aws.String(protectedAtTag)}},
+	})
+	if err := mutate(req, dryRun); err != nil {
+		return errors.Wrap(err, "could not remove protected-at tags")
+	}
+	return nil
+}
+
+// expireProtection removes scale in protection, regardless of Launch Template version, from
+// instances whose protectedAtTag is older than --protection-max-age, so protection used as a
+// temporary deploy gate doesn't leak. Instances without the tag are left alone.
+func expireProtection(asgClient *autoscaling.AutoScaling, ec2Client *ec2.EC2, instanceIds []*string, options *Options) error {
+	instances, err := describeInstances(ec2Client, instanceIds)
+	if err != nil {
+		return err
+	}
+	expired := filterInstanceIds(instanceIds, func(instanceID string) bool {
+		instance, ok := instances[instanceID]
+		if !ok {
+			return false
+		}
+		for _, tag := range instance.Tags {
+			if aws.StringValue(tag.Key) != protectedAtTag {
+				continue
+			}
+			protectedAt, err := time.Parse(time.RFC3339, aws.StringValue(tag.Value))
+			if err != nil {
+				log.Printf("[WARN] instance %s has invalid %s tag %q", instanceID, protectedAtTag, aws.StringValue(tag.Value))
+				return false
+			}
+			if age := time.Since(protectedAt); age > options.ProtectionMaxAge {
+				log.Printf("[INFO] instance %s was protected %s ago, longer than `--protection-max-age` %s", instanceID, age.Round(time.Second), options.ProtectionMaxAge)
+				return true
+			}
+		}
+		return false
+	})
+	if len(expired) == 0 {
+		return nil
+	}
+
+	for partition := range gopart.Partition(len(expired), 50) {
+		batch := expired[partition.Low:partition.High]
+		req, _ := asgClient.SetInstanceProtectionRequest(&autoscaling.SetInstanceProtectionInput{
+			AutoScalingGroupName: aws.String(options.ASG),
+			InstanceIds:          batch,
+			ProtectedFromScaleIn: aws.Bool(false),
+		})
+		if err := mutate(req, options.DryRun); err != nil {
+			return errors.Wrap(err, "could not remove expired protection")
+		}
+		if err := untagProtectedAt(ec2Client, batch, options.DryRun); err != nil {
+			return err
+		}
+		for _, instanceID := range batch {
+			stats.markState(*instanceID, stateExpired)
+		}
+		if options.DryRun {
+			stats.action("expired protection removed (dry-run)", len(batch))
+		} else {
+			stats.action("expired protection removed", len(batch))
+		}
+	}
+	return nil
+}
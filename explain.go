@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+)
+
+// ExplainCommand shows why a run does or doesn't act on one instance
+type ExplainCommand struct {
+	Instance string `long:"instance" description:"instance id to explain" required:"true"`
+}
+
+// explainWriter passes log output through, keeping the lines that mention any of matches
+type explainWriter struct {
+	next    io.Writer
+	matches []string
+
+	mu    sync.Mutex
+	lines []string
+}
+
+func (w *explainWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		for _, match := range w.matches {
+			if strings.Contains(line, match) {
+				// drop the date and time log.Printf prefixes lines with
+				if fields := strings.SplitN(line, " ", 3); len(fields) == 3 {
+					line = fields[2]
+				}
+				w.mu.Lock()
+				w.lines = append(w.lines, line)
+				w.mu.Unlock()
+				break
+			}
+		}
+	}
+	return w.next.Write(p)
+}
+
+// doExplain runs a dry run and prints every step that concerned the instance, including those
+// logged below --log-level: its classification against the Launch Template, the filters and
+// guards that applied to it, and what the run would have done
+func doExplain(ctx context.Context, w io.Writer, cmd *ExplainCommand, options *Options) error {
+	dryRun := *options
+	dryRun.DryRun = true
+	capture := &explainWriter{
+		next:    log.Writer(),
+		matches: []string{cmd.Instance, "ASG " + options.ASG + " "},
+	}
+	log.SetOutput(capture)
+	previous := logDebug
+	logDebug = true
+	runErr := runOnce(ctx, &dryRun, nil)
+	logDebug = previous
+	log.SetOutput(capture.next)
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "instance %s in ASG %s\n", cmd.Instance, options.ASG)
+	for _, line := range capture.lines {
+		fmt.Fprintf(&out, "  %s\n", line)
+	}
+	state := stats.instanceState(cmd.Instance)
+	if state == "" {
+		state = "not in the ASG"
+	}
+	fmt.Fprintf(&out, "final state: %s\n", state)
+	if runErr != nil {
+		fmt.Fprintf(&out, "the run failed (%s): %v\n", classifyError(runErr), runErr)
+	}
+	_, err := w.Write(out.Bytes())
+	return err
+}
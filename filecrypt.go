@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/pkg/errors"
+)
+
+// sealedFile is the on-disk format of a file encrypted with --kms-key-id: the file is encrypted
+// with AES-GCM under a data key, which is stored encrypted by the KMS key
+type sealedFile struct {
+	KMSKeyID     string `json:"kms_key_id"`
+	EncryptedKey []byte `json:"encrypted_key"`
+	Nonce        []byte `json:"nonce"`
+	Ciphertext   []byte `json:"ciphertext"`
+}
+
+// sealFile encrypts data for writing to a state, plan or report file when --kms-key-id is set,
+// and returns it unchanged otherwise
+func sealFile(sess *session.Session, options *Options, data []byte) ([]byte, error) {
+	if options.KMSKeyID == "" {
+		return data, nil
+	}
+	key, err := kms.New(sess).GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:   aws.String(options.KMSKeyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not generate data key")
+	}
+	gcm, err := newGCM(key.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "could not generate nonce")
+	}
+	return json.MarshalIndent(&sealedFile{
+		KMSKeyID:     aws.StringValue(key.KeyId),
+		EncryptedKey: key.CiphertextBlob,
+		Nonce:        nonce,
+		Ciphertext:   gcm.Seal(nil, nonce, data, nil),
+	}, "", "  ")
+}
+
+// openFile decrypts data read from a state or plan file if it was written with --kms-key-id, and
+// returns it unchanged otherwise
+func openFile(sess *session.Session, options *Options, data []byte) ([]byte, error) {
+	var sealed sealedFile
+	if err := json.Unmarshal(data, &sealed); err != nil || len(sealed.EncryptedKey) == 0 || len(sealed.Ciphertext) == 0 {
+		return data, nil
+	}
+	key, err := kms.New(sess).Decrypt(&kms.DecryptInput{
+		KeyId:          aws.String(sealed.KMSKeyID),
+		CiphertextBlob: sealed.EncryptedKey,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decrypt data key")
+	}
+	gcm, err := newGCM(key.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, sealed.Nonce, sealed.Ciphertext, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decrypt file")
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid data key")
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid data key")
+	}
+	return gcm, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// flapThreshold is how many times protection this tool removed must be re-enabled by something
+// else before the instance is left alone as a conflict
+const flapThreshold = 2
+
+// protectionFlaps tracks, across the runs of a daemon, the instances whose scale in protection
+// this tool removed and another controller (ECS managed termination protection, custom scripts)
+// enabled again, so the two don't fight over them forever
+type protectionFlaps struct {
+	mu sync.Mutex
+	// unprotected are the instances the previous run of each ASG unprotected, by asgLabel
+	unprotected map[string]map[string]bool
+	// counts are how often the protection of each instance was enabled again, by asgLabel
+	counts map[string]map[string]int
+}
+
+// flaps outlives the runs of a daemon, unlike stats
+var flaps = &protectionFlaps{
+	unprotected: make(map[string]map[string]bool),
+	counts:      make(map[string]map[string]int),
+}
+
+// observe compares the protection of the ASG's instances at the start of a run with what the
+// previous run unprotected, and returns the instances that flapped often enough to be conflicts
+func (f *protectionFlaps) observe(asg string, before map[string]bool) map[string]bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	counts := make(map[string]int)
+	for instanceID, count := range f.counts[asg] {
+		// instances that left the ASG are forgotten
+		if _, ok := before[instanceID]; ok {
+			counts[instanceID] = count
+		}
+	}
+	for instanceID := range f.unprotected[asg] {
+		if before[instanceID] {
+			counts[instanceID]++
+			log.Printf("[WARN] instance %s is protected from scale in again after this tool removed its protection (%d times)", instanceID, counts[instanceID])
+		}
+	}
+	f.counts[asg] = counts
+
+	conflicts := make(map[string]bool)
+	for instanceID, count := range counts {
+		if count >= flapThreshold {
+			conflicts[instanceID] = true
+		}
+	}
+	return conflicts
+}
+
+// record remembers the instances a run unprotected, for the next run of the ASG to observe
+func (f *protectionFlaps) record(asg string, unprotected map[string]bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unprotected[asg] = unprotected
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestProtectionFlaps(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	f := &protectionFlaps{unprotected: make(map[string]map[string]bool), counts: make(map[string]map[string]int)}
+	runs := []struct {
+		before      map[string]bool
+		unprotected map[string]bool
+		conflicts   []string
+	}{
+		// i-a is unprotected by the first run and protected again by the time of each next one
+		{map[string]bool{"i-a": true, "i-b": true}, map[string]bool{"i-a": true, "i-b": true}, nil},
+		{map[string]bool{"i-a": true, "i-b": false}, map[string]bool{"i-a": true}, nil},
+		{map[string]bool{"i-a": true, "i-b": false}, map[string]bool{}, []string{"i-a"}},
+		// a conflict is remembered while the instance is in the ASG, and forgotten after
+		{map[string]bool{"i-a": true}, map[string]bool{}, []string{"i-a"}},
+		{map[string]bool{"i-c": true}, map[string]bool{}, nil},
+	}
+	for i, run := range runs {
+		conflicts := f.observe("web", run.before)
+		if len(conflicts) != len(run.conflicts) {
+			t.Fatalf("run %d: conflicts %v, want %v", i, conflicts, run.conflicts)
+		}
+		for _, instanceID := range run.conflicts {
+			if !conflicts[instanceID] {
+				t.Errorf("run %d: %s is not a conflict", i, instanceID)
+			}
+		}
+		f.record("web", run.unprotected)
+	}
+
+	if conflicts := f.observe("api", map[string]bool{"i-a": true}); len(conflicts) != 0 {
+		t.Errorf("conflicts of another ASG leaked: %v", conflicts)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/pkg/errors"
+)
+
+// isFreezeValue reports whether a parameter or tag value declares a freeze
+func isFreezeValue(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true", "1", "yes", "on", "frozen":
+		return true
+	}
+	return false
+}
+
+// calendarFrozen reads a freeze calendar with one "<YYYY-MM-DD> <YYYY-MM-DD> [comment]" range per
+// line, both days inclusive in UTC, and returns the comment of the range containing now
+func calendarFrozen(path string, now time.Time) (bool, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, "", errors.Wrapf(err, "could not open freeze calendar %s", path)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return false, "", errors.Errorf("invalid freeze calendar %s line %d, expected \"<from> <to> [comment]\"", path, line)
+		}
+		from, err := time.Parse("2006-01-02", fields[0])
+		if err != nil {
+			return false, "", errors.Wrapf(err, "invalid freeze calendar %s line %d", path, line)
+		}
+		to, err := time.Parse("2006-01-02", fields[1])
+		if err != nil {
+			return false, "", errors.Wrapf(err, "invalid freeze calendar %s line %d", path, line)
+		}
+		if !now.Before(from) && now.Before(to.AddDate(0, 0, 1)) {
+			return true, strings.Join(fields[2:], " "), nil
+		}
+	}
+	return false, "", errors.Wrapf(scanner.Err(), "could not read freeze calendar %s", path)
+}
+
+// checkFreeze reports whether any --freeze-source declares a change freeze, and why. Sources are
+// "ssm:<parameter-name>", "tag:<asg-tag-key>" or "file:<calendar-path>". A source that can't be
+// read fails the run rather than risk changes during a freeze.
+func checkFreeze(sess *session.Session, asg *autoscaling.Group, options *Options) (bool, string, error) {
+	for _, source := range options.FreezeSources {
+		switch {
+		case strings.HasPrefix(source, "ssm:"):
+			name := strings.TrimPrefix(source, "ssm:")
+			resp, err := ssm.New(sess).GetParameter(&ssm.GetParameterInput{Name: aws.String(name)})
+			if err != nil {
+				return false, "", errors.Wrapf(err, "could not get freeze parameter %s", name)
+			}
+			if isFreezeValue(aws.StringValue(resp.Parameter.Value)) {
+				return true, "SSM parameter " + name, nil
+			}
+		case strings.HasPrefix(source, "tag:"):
+			key := strings.TrimPrefix(source, "tag:")
+			for _, tag := range asg.Tags {
+				if aws.StringValue(tag.Key) == key && isFreezeValue(aws.StringValue(tag.Value)) {
+					return true, "ASG tag " + key, nil
+				}
+			}
+		case strings.HasPrefix(source, "file:"):
+			path := strings.TrimPrefix(source, "file:")
+			frozen, comment, err := calendarFrozen(path, time.Now().UTC())
+			if err != nil {
+				return false, "", err
+			}
+			if frozen {
+				return true, strings.TrimSpace("calendar " + path + " " + comment), nil
+			}
+		default:
+			return false, "", errors.Errorf("invalid freeze source %q, expected ssm:<parameter-name>, tag:<asg-tag-key> or file:<calendar-path>", source)
+		}
+	}
+	return false, "", nil
+}
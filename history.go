@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/pkg/errors"
+)
+
+// HistoryCommand contains the flag options of the history command
+type HistoryCommand struct {
+	Limit   int64  `long:"limit" description:"how many of the most recent runs to show" default:"10"`
+	JSON    bool   `long:"json" description:"print the full JSON report of each run instead of a summary line"`
+	Account string `long:"account" description:"show the runs of the ASG in this account of an --org-discover sweep"`
+}
+
+// LastRunCommand contains the flag options of the last-run command
+type LastRunCommand struct {
+	Account string `long:"account" description:"show the last run of the ASG in this account of an --org-discover sweep"`
+}
+
+// historyKey is the partition key of the runs of an ASG, prefixed with the account of
+// organization sweeps so same-named ASGs of different accounts are kept apart
+func historyKey(account string, asg string) string {
+	if account == "" {
+		return asg
+	}
+	return account + "/" + asg
+}
+
+// historyRecord is one run stored in --history-table. The table's partition key is "asg", the
+// historyKey of the run, and its sort key "time", both strings.
+type historyRecord struct {
+	ASG    string `dynamodbav:"asg"`
+	Time   string `dynamodbav:"time"`
+	RunID  string `dynamodbav:"run_id"`
+	Status string `dynamodbav:"status"`
+	DryRun bool   `dynamodbav:"dry_run"`
+	// Report is the JSON report of the run
+	Report string `dynamodbav:"report"`
+}
+
+// newSession returns the session commands outside a run use, assuming --assume-role-arn if set
+func newSession(options *Options) *session.Session {
+	sess := newAWSSession(options)
+	if options.AssumeRoleARN != "" {
+		sess = assumeRole(sess, options.AssumeRoleARN, newRunID())
+	}
+	return sess
+}
+
+// saveHistory stores the report of the last run in --history-table. Dry runs are stored too,
+// marked as such. Failures are logged but don't fail the run.
+func saveHistory(sess *session.Session, options *Options, runErr error) {
+	if options.HistoryTable == "" {
+		return
+	}
+	report := newRunReport(options, runErr)
+	data, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("[ERROR] could not encode report: %v", err)
+		return
+	}
+	item, err := dynamodbattribute.MarshalMap(historyRecord{
+		ASG:    historyKey(report.Account, report.ASG),
+		Time:   report.Time.Format(time.RFC3339Nano),
+		RunID:  report.RunID,
+		Status: report.Status,
+		DryRun: report.DryRun,
+		Report: string(data),
+	})
+	if err != nil {
+		log.Printf("[ERROR] could not encode history record: %v", err)
+		return
+	}
+	_, err = dynamodb.New(sess).PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(options.HistoryTable),
+		Item:      item,
+	})
+	if err != nil {
+		log.Printf("[ERROR] could not save run %s to %s: %v", report.RunID, options.HistoryTable, err)
+	}
+}
+
+// loadHistory returns the most recent runs of the ASG, newest first
+func loadHistory(client *dynamodb.DynamoDB, table string, asg string, limit int64) ([]historyRecord, error) {
+	resp, err := client.Query(&dynamodb.QueryInput{
+		TableName:              aws.String(table),
+		KeyConditionExpression: aws.String("asg = :asg"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":asg": {S: aws.String(asg)},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int64(limit),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not query %s", table)
+	}
+	records := make([]historyRecord, 0, len(resp.Items))
+	if err := dynamodbattribute.UnmarshalListOfMaps(resp.Items, &records); err != nil {
+		return nil, errors.Wrap(err, "could not decode history records")
+	}
+	return records, nil
+}
+
+// printHistory writes one tab separated line per run with its outcome
+func printHistory(w io.Writer, records []historyRecord) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tRUN\tSTATUS\tDRY-RUN\tINSTANCES\tACTIONS\tERROR")
+	for _, record := range records {
+		var report runReport
+		if err := json.Unmarshal([]byte(record.Report), &report); err != nil {
+			return errors.Wrapf(err, "could not decode report of run %s", record.RunID)
+		}
+		actions := make([]string, 0, len(report.Actions))
+		for action, n := range report.Actions {
+			actions = append(actions, fmt.Sprintf("%s=%d", action, n))
+		}
+		sort.Strings(actions)
+		message := ""
+		if report.Error != nil {
+			message = report.Error.Kind + ": " + report.Error.Message
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%t\t%d\t%s\t%s\n",
+			report.Time.Format(time.RFC3339), report.RunID, report.Status, report.DryRun,
+			len(report.Instances), strings.Join(actions, ", "), strings.Replace(message, "\n", " ", -1))
+	}
+	return tw.Flush()
+}
+
+// doHistory prints the most recent runs of the ASG, newest first
+func doHistory(w io.Writer, cmd *HistoryCommand, options *Options) error {
+	if options.HistoryTable == "" {
+		return errors.New("the history command requires `--history-table`")
+	}
+	records, err := loadHistory(dynamodb.New(newSession(options)), options.HistoryTable, historyKey(cmd.Account, options.ASG), cmd.Limit)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		log.Printf("[INFO] no runs of %s recorded in %s", options.ASG, options.HistoryTable)
+		return nil
+	}
+	if !cmd.JSON {
+		return printHistory(w, records)
+	}
+	for _, record := range records {
+		fmt.Fprintln(w, record.Report)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+)
+
+// checkPendingLaunchHooks reports instances of the ASG held in Pending:Wait by launch lifecycle
+// hooks, which stalls the rotation until the hook completes or times out. With
+// --pending-hook-timeout, an instance waiting longer than that fails the run.
+func checkPendingLaunchHooks(asgClient *autoscaling.AutoScaling, ec2Client *ec2.EC2, asg *autoscaling.Group, options *Options) error {
+	pending := make([]*string, 0)
+	for _, instance := range asg.Instances {
+		if aws.StringValue(instance.LifecycleState) == autoscaling.LifecycleStatePendingWait {
+			pending = append(pending, instance.InstanceId)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	resp, err := asgClient.DescribeLifecycleHooks(&autoscaling.DescribeLifecycleHooksInput{
+		AutoScalingGroupName: asg.AutoScalingGroupName,
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not describe lifecycle hooks")
+	}
+	for _, hook := range resp.LifecycleHooks {
+		if aws.StringValue(hook.LifecycleTransition) != "autoscaling:EC2_INSTANCE_LAUNCHING" {
+			continue
+		}
+		log.Printf("[INFO] launch lifecycle hook %s has heartbeat timeout %s, global timeout %s, default result %s",
+			aws.StringValue(hook.LifecycleHookName),
+			time.Duration(aws.Int64Value(hook.HeartbeatTimeout))*time.Second,
+			time.Duration(aws.Int64Value(hook.GlobalTimeout))*time.Second,
+			aws.StringValue(hook.DefaultResult),
+		)
+	}
+
+	instances, err := describeInstances(ec2Client, pending)
+	if err != nil {
+		return err
+	}
+	for _, instanceID := range pending {
+		instance, ok := instances[*instanceID]
+		if !ok || instance.LaunchTime == nil {
+			log.Printf("[WARN] instance %s is waiting on a launch lifecycle hook", *instanceID)
+			continue
+		}
+		waiting := time.Since(*instance.LaunchTime)
+		log.Printf("[WARN] instance %s has been waiting on a launch lifecycle hook for %s", *instanceID, waiting.Round(time.Second))
+		if options.PendingHookTimeout > 0 && waiting > options.PendingHookTimeout {
+			return guardError("instance %s has been waiting on a launch lifecycle hook for %s, longer than `--pending-hook-timeout` %s", *instanceID, waiting.Round(time.Second), options.PendingHookTimeout)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/meirf/gopart"
+	"github.com/pkg/errors"
+)
+
+// describeInstances returns the EC2 details of the given instances keyed by instance id.
+// Instances already described during this run are served from the run's cache.
+func describeInstances(ec2Client *ec2.EC2, instanceIds []*string) (map[string]*ec2.Instance, error) {
+	instances, missing := describes.cachedInstances(instanceIds)
+	described := make(map[string]*ec2.Instance, len(missing))
+	for partition := range gopart.Partition(len(missing), describeBatchSize) {
+		err := ec2Client.DescribeInstancesPages(&ec2.DescribeInstancesInput{
+			InstanceIds: missing[partition.Low:partition.High],
+		}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+			for _, reservation := range page.Reservations {
+				for _, instance := range reservation.Instances {
+					described[*instance.InstanceId] = instance
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "could not describe instances")
+		}
+	}
+	describes.addInstances(described)
+	for instanceID, instance := range described {
+		instances[instanceID] = instance
+	}
+	return instances, nil
+}
+
+// filterInstanceIds returns the instance ids for which keep returns true
+func filterInstanceIds(instanceIds []*string, keep func(instanceID string) bool) []*string {
+	kept := make([]*string, 0, len(instanceIds))
+	for _, instanceID := range instanceIds {
+		if keep(*instanceID) {
+			kept = append(kept, instanceID)
+		}
+	}
+	return kept
+}
+
+// uniqueInstanceIds returns the instance ids without duplicates, in the order first seen
+func uniqueInstanceIds(instanceIds []*string) []*string {
+	seen := make(map[string]bool, len(instanceIds))
+	return filterInstanceIds(instanceIds, func(instanceID string) bool {
+		if seen[instanceID] {
+			return false
+		}
+		seen[instanceID] = true
+		return true
+	})
+}
+
+// filterASGHealthy returns the instances the ASG itself reports as InService and Healthy
+func filterASGHealthy(asg *autoscaling.Group, instanceIds []string) []string {
+	states := make(map[string]*autoscaling.Instance, len(asg.Instances))
+	for _, instance := range asg.Instances {
+		states[*instance.InstanceId] = instance
+	}
+
+	healthy := make([]string, 0, len(instanceIds))
+	for _, instanceID := range instanceIds {
+		instance, ok := states[instanceID]
+		if !ok {
+			continue
+		}
+		lifecycleState := aws.StringValue(instance.LifecycleState)
+		healthStatus := aws.StringValue(instance.HealthStatus)
+		if lifecycleState != autoscaling.LifecycleStateInService || healthStatus != "Healthy" {
+			log.Printf("[WARN] latest instance %s is %s/%s, not counting it as healthy", instanceID, lifecycleState, healthStatus)
+			continue
+		}
+		healthy = append(healthy, instanceID)
+	}
+	return healthy
+}
+
+// filterStrings returns the instance ids for which keep returns true
+func filterStrings(instanceIds []string, keep func(instanceID string) bool) []string {
+	kept := make([]string, 0, len(instanceIds))
+	for _, instanceID := range instanceIds {
+		if keep(instanceID) {
+			kept = append(kept, instanceID)
+		}
+	}
+	return kept
+}
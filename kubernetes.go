@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os/exec"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/pkg/errors"
+)
+
+// scaleDownDisabledAnnotation is set on nodes Cluster Autoscaler must never scale down
+const scaleDownDisabledAnnotation = "cluster-autoscaler.kubernetes.io/scale-down-disabled"
+
+// isClusterAutoscalerManaged reports whether the ASG is tagged for Kubernetes Cluster Autoscaler
+func isClusterAutoscalerManaged(asg *autoscaling.Group) bool {
+	for _, tag := range asg.Tags {
+		if strings.HasPrefix(aws.StringValue(tag.Key), "k8s.io/cluster-autoscaler/") {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeList is the subset of `kubectl get nodes -o json` output needed to map nodes to instances
+type nodeList struct {
+	Items []struct {
+		Metadata struct {
+			Name        string            `json:"name"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Spec struct {
+			ProviderID string `json:"providerID"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// scaleDownDisabledInstances returns the instance ids of nodes annotated with scale-down-disabled,
+// queried with kubectl against options.Kubeconfig.
+func scaleDownDisabledInstances(options *Options) (map[string]bool, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(options.Kubectl, "--kubeconfig", options.Kubeconfig, "get", "nodes", "-o", "json")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "could not list kubernetes nodes: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	var nodes nodeList
+	if err := json.Unmarshal(stdout.Bytes(), &nodes); err != nil {
+		return nil, errors.Wrap(err, "could not parse kubernetes nodes")
+	}
+
+	disabled := make(map[string]bool)
+	for _, node := range nodes.Items {
+		if node.Metadata.Annotations[scaleDownDisabledAnnotation] != "true" {
+			continue
+		}
+		// providerID has the form aws:///<az>/<instance-id>
+		providerID := node.Spec.ProviderID
+		instanceID := providerID[strings.LastIndex(providerID, "/")+1:]
+		if !strings.HasPrefix(instanceID, "i-") {
+			log.Printf("[WARN] node %s has unexpected providerID %q", node.Metadata.Name, providerID)
+			continue
+		}
+		disabled[instanceID] = true
+	}
+	return disabled, nil
+}
+
+// checkClusterAutoscaler applies options.ClusterAutoscalerPolicy to ASGs managed by Cluster
+// Autoscaler, before anything is drained. It returns false if the ASG must be skipped entirely,
+// and otherwise the instances whose nodes are annotated scale-down-disabled.
+func checkClusterAutoscaler(asg *autoscaling.Group, options *Options) (map[string]bool, bool, error) {
+	if !isClusterAutoscalerManaged(asg) {
+		return nil, true, nil
+	}
+
+	switch options.ClusterAutoscalerPolicy {
+	case "skip":
+		log.Printf("[INFO] ASG %s is managed by Cluster Autoscaler, skipping it", options.ASG)
+		return nil, false, nil
+	case "require-kubeconfig":
+		if options.Kubeconfig == "" {
+			return nil, false, errors.Errorf("auto scaling group \"%s\" is managed by Cluster Autoscaler, `--kubeconfig` is required to check for scale-down-disabled nodes", options.ASG)
+		}
+	}
+	if options.Kubeconfig == "" {
+		log.Printf("[WARN] ASG %s is managed by Cluster Autoscaler, scale-down-disabled nodes aren't checked without `--kubeconfig`", options.ASG)
+		return nil, true, nil
+	}
+
+	disabled, err := scaleDownDisabledInstances(options)
+	if err != nil {
+		return nil, false, err
+	}
+	return disabled, true, nil
+}
+
+// keepScaleDownDisabled drops the instances whose nodes are annotated scale-down-disabled, so they
+// are neither drained nor unprotected
+func keepScaleDownDisabled(instanceIds []*string, disabled map[string]bool) []*string {
+	if len(disabled) == 0 {
+		return instanceIds
+	}
+	return filterInstanceIds(instanceIds, func(instanceID string) bool {
+		if disabled[instanceID] {
+			log.Printf("[INFO] keeping scale in protection on instance %s, its node is annotated %s", instanceID, scaleDownDisabledAnnotation)
+			return false
+		}
+		return true
+	})
+}
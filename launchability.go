@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+)
+
+// launchTemplateData returns the launch data of a version of the launch template
+func launchTemplateData(ec2Client *ec2.EC2, lt launchTemplateRef, version int64) (*ec2.ResponseLaunchTemplateData, error) {
+	input := &ec2.DescribeLaunchTemplateVersionsInput{
+		Versions: []*string{aws.String(strconv.FormatInt(version, 10))},
+	}
+	if lt.ID != "" {
+		input.LaunchTemplateId = aws.String(lt.ID)
+	} else {
+		input.LaunchTemplateName = aws.String(lt.Name)
+	}
+	resp, err := ec2Client.DescribeLaunchTemplateVersions(input)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not describe version %d of Launch Template %s", version, lt)
+	}
+	if len(resp.LaunchTemplateVersions) != 1 || resp.LaunchTemplateVersions[0].LaunchTemplateData == nil {
+		return nil, notFoundError("version %d of Launch Template %s not found", version, lt)
+	}
+	return resp.LaunchTemplateVersions[0].LaunchTemplateData, nil
+}
+
+// asgInstanceTypes returns the instance types the ASG launches: the Launch Template's, and those
+// of the MixedInstancesPolicy overrides
+func asgInstanceTypes(asg *autoscaling.Group, data *ec2.ResponseLaunchTemplateData) []string {
+	types := make([]string, 0)
+	if data.InstanceType != nil {
+		types = append(types, *data.InstanceType)
+	}
+	if asg.MixedInstancesPolicy != nil && asg.MixedInstancesPolicy.LaunchTemplate != nil {
+		for _, override := range asg.MixedInstancesPolicy.LaunchTemplate.Overrides {
+			if override.InstanceType != nil {
+				types = append(types, *override.InstanceType)
+			}
+		}
+	}
+	return types
+}
+
+// checkLaunchability refuses to recycle instances when the latest version of the Launch Template
+// couldn't launch their replacements: its AMI is gone or not available, an instance type isn't
+// offered in one of the ASG's availability zones, or a security group or subnet doesn't exist.
+func checkLaunchability(ec2Client *ec2.EC2, asg *autoscaling.Group, lt launchTemplateRef, version int64) error {
+	data, err := launchTemplateData(ec2Client, lt, version)
+	if err != nil {
+		return err
+	}
+	problems := make([]string, 0)
+
+	// AMIs resolved from SSM parameters at launch can't be checked here
+	if imageID := aws.StringValue(data.ImageId); imageID != "" && !strings.HasPrefix(imageID, "resolve:ssm:") {
+		images, err := describeImages(ec2Client, []*string{data.ImageId})
+		if err != nil {
+			return err
+		}
+		if image, ok := images[imageID]; !ok {
+			problems = append(problems, "AMI "+imageID+" does not exist")
+		} else if state := aws.StringValue(image.State); state != ec2.ImageStateAvailable {
+			problems = append(problems, "AMI "+imageID+" is "+state)
+		}
+	}
+
+	if types := asgInstanceTypes(asg, data); len(types) > 0 && len(asg.AvailabilityZones) > 0 {
+		offered := make(map[string]bool)
+		err := ec2Client.DescribeInstanceTypeOfferingsPages(&ec2.DescribeInstanceTypeOfferingsInput{
+			LocationType: aws.String(ec2.LocationTypeAvailabilityZone),
+			Filters: []*ec2.Filter{
+				{Name: aws.String("instance-type"), Values: aws.StringSlice(types)},
+				{Name: aws.String("location"), Values: asg.AvailabilityZones},
+			},
+		}, func(page *ec2.DescribeInstanceTypeOfferingsOutput, lastPage bool) bool {
+			for _, offering := range page.InstanceTypeOfferings {
+				offered[aws.StringValue(offering.InstanceType)+"/"+aws.StringValue(offering.Location)] = true
+			}
+			return true
+		})
+		if err != nil {
+			return errors.Wrap(err, "could not describe instance type offerings")
+		}
+		for _, instanceType := range types {
+			for _, az := range aws.StringValueSlice(asg.AvailabilityZones) {
+				if !offered[instanceType+"/"+az] {
+					problems = append(problems, "instance type "+instanceType+" is not offered in "+az)
+				}
+			}
+		}
+	}
+
+	groupIds := append([]*string{}, data.SecurityGroupIds...)
+	for _, eni := range data.NetworkInterfaces {
+		groupIds = append(groupIds, eni.Groups...)
+	}
+	for _, groupID := range groupIds {
+		_, err := ec2Client.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{GroupIds: []*string{groupID}})
+		if err != nil {
+			problems = append(problems, "security group "+*groupID+" can't be described: "+err.Error())
+		}
+	}
+
+	for _, subnetID := range strings.Split(aws.StringValue(asg.VPCZoneIdentifier), ",") {
+		if subnetID = strings.TrimSpace(subnetID); subnetID == "" {
+			continue
+		}
+		_, err := ec2Client.DescribeSubnets(&ec2.DescribeSubnetsInput{SubnetIds: []*string{aws.String(subnetID)}})
+		if err != nil {
+			problems = append(problems, "subnet "+subnetID+" can't be described: "+err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return guardError("version %d of Launch Template %s can't launch replacements: %s", version, lt, strings.Join(problems, "; "))
+	}
+	log.Printf("[INFO] version %d of Launch Template %s can launch replacements", version, lt)
+	return nil
+}
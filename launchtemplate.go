@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+)
+
+// launchTemplateRef identifies the ASG's launch template. Templates shared from another account
+// can only be described by id, so the id is preferred whenever the ASG reports it.
+type launchTemplateRef struct {
+	ID   string
+	Name string
+}
+
+func (r launchTemplateRef) String() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.ID
+}
+
+// asgLaunchTemplate returns the launch template the ASG launches instances from, or nil if it
+// doesn't use launch templates.
+func asgLaunchTemplate(asg *autoscaling.Group) *launchTemplateRef {
+	spec := asg.LaunchTemplate
+	if spec == nil && asg.MixedInstancesPolicy != nil && asg.MixedInstancesPolicy.LaunchTemplate != nil {
+		spec = asg.MixedInstancesPolicy.LaunchTemplate.LaunchTemplateSpecification
+	}
+	if spec == nil || (spec.LaunchTemplateId == nil && spec.LaunchTemplateName == nil) {
+		return nil
+	}
+	return &launchTemplateRef{
+		ID:   aws.StringValue(spec.LaunchTemplateId),
+		Name: aws.StringValue(spec.LaunchTemplateName),
+	}
+}
+
+// matches reports whether an instance's launch template is this one
+func (r launchTemplateRef) matches(spec *autoscaling.LaunchTemplateSpecification) bool {
+	if r.ID != "" && spec.LaunchTemplateId != nil {
+		return r.ID == *spec.LaunchTemplateId
+	}
+	return r.Name == aws.StringValue(spec.LaunchTemplateName)
+}
+
+// describeLatestVersion returns the latest version number of the launch template. If the template
+// itself can't be described, as happens for templates shared from another account, its $Latest
+// version is looked up instead.
+func describeLatestVersion(ec2Client *ec2.EC2, lt launchTemplateRef) (int64, error) {
+	input := &ec2.DescribeLaunchTemplatesInput{}
+	if lt.ID != "" {
+		input.LaunchTemplateIds = []*string{aws.String(lt.ID)}
+	} else {
+		input.LaunchTemplateNames = []*string{aws.String(lt.Name)}
+	}
+	ltResponse, err := ec2Client.DescribeLaunchTemplates(input)
+	if err == nil && ltResponse != nil && len(ltResponse.LaunchTemplates) == 1 && ltResponse.LaunchTemplates[0].LatestVersionNumber != nil {
+		return *ltResponse.LaunchTemplates[0].LatestVersionNumber, nil
+	}
+	if err != nil {
+		log.Printf("[DEBUG] could not describe Launch Template %s, trying its $Latest version: %v", lt, err)
+	}
+
+	versionsInput := &ec2.DescribeLaunchTemplateVersionsInput{
+		Versions: []*string{aws.String("$Latest")},
+	}
+	if lt.ID != "" {
+		versionsInput.LaunchTemplateId = aws.String(lt.ID)
+	} else {
+		versionsInput.LaunchTemplateName = aws.String(lt.Name)
+	}
+	versionsResponse, err := ec2Client.DescribeLaunchTemplateVersions(versionsInput)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not describe Launch Template "+lt.String())
+	}
+	if versionsResponse == nil || len(versionsResponse.LaunchTemplateVersions) != 1 || versionsResponse.LaunchTemplateVersions[0].VersionNumber == nil {
+		return 0, errors.New("no latest version for Launch Template " + lt.String())
+	}
+	return *versionsResponse.LaunchTemplateVersions[0].VersionNumber, nil
+}
+
+// maxInstanceVersion returns the highest launch template version of the ASG's instances using lt
+func maxInstanceVersion(asg *autoscaling.Group, lt launchTemplateRef) int64 {
+	max := int64(0)
+	for _, instance := range asg.Instances {
+		if instance.LaunchTemplate == nil || !lt.matches(instance.LaunchTemplate) {
+			continue
+		}
+		version, err := strconv.ParseInt(aws.StringValue(instance.LaunchTemplate.Version), 10, 64)
+		if err == nil && version > max {
+			max = version
+		}
+	}
+	return max
+}
+
+// resolveLatestVersion describes the launch template's latest version, re-describing it a bounded
+// number of times while instances report a newer version than it. Right after a new version is
+// published the two APIs can briefly disagree. If the template can't be described at all, the
+// newest version reported by the instances is used instead. The version is resolved once per run.
+func resolveLatestVersion(ec2Client *ec2.EC2, asg *autoscaling.Group, lt launchTemplateRef, options *Options) (int64, error) {
+	if version, ok := describes.latestVersion(lt); ok {
+		return version, nil
+	}
+	latestVersion, err := describeResolvedVersion(ec2Client, asg, lt, options)
+	if err == nil {
+		describes.setLatestVersion(lt, latestVersion)
+	}
+	return latestVersion, err
+}
+
+func describeResolvedVersion(ec2Client *ec2.EC2, asg *autoscaling.Group, lt launchTemplateRef, options *Options) (int64, error) {
+	newest := maxInstanceVersion(asg, lt)
+	latestVersion, err := describeLatestVersion(ec2Client, lt)
+	if err != nil {
+		if newest == 0 {
+			return 0, err
+		}
+		log.Printf("[WARN] %v", err)
+		log.Printf("[WARN] falling back to the newest version reported by instances, %d, as the latest version of Launch Template %s", newest, lt)
+		return newest, nil
+	}
+
+	for attempt := 1; newest > latestVersion && attempt <= options.ConsistencyRetries; attempt++ {
+		log.Printf("[WARN] instances report Launch Template version %d but latest is %d, re-describing in %s (%d/%d)", newest, latestVersion, options.ConsistencyRetryDelay, attempt, options.ConsistencyRetries)
+		time.Sleep(options.ConsistencyRetryDelay)
+		latestVersion, err = describeLatestVersion(ec2Client, lt)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if newest > latestVersion {
+		log.Printf("[WARN] instances still report Launch Template version %d newer than latest %d", newest, latestVersion)
+	}
+	return latestVersion, nil
+}
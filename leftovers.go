@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/pkg/errors"
+)
+
+// CleanupCommand contains the flag options of the cleanup command
+type CleanupCommand struct{}
+
+// leftover is an instance in Standby or detached from the ASG that still carries scale in
+// protection or target group registrations from a previous operation
+type leftover struct {
+	instanceID string
+	state      string
+	protected  bool
+	// targets are the registrations of the instance, keyed by target group ARN
+	targets map[string]*elbv2.TargetDescription
+}
+
+// findLeftovers returns Standby instances of the ASG, and running instances tagged with the ASG
+// but no longer part of it, that are protected or registered in one of its target groups.
+func findLeftovers(ec2Client *ec2.EC2, asg *autoscaling.Group, health *targetHealthCache) ([]leftover, error) {
+	candidates := make(map[string]*leftover)
+	inASG := make(map[string]bool, len(asg.Instances))
+	for _, instance := range asg.Instances {
+		inASG[*instance.InstanceId] = true
+		if aws.StringValue(instance.LifecycleState) == autoscaling.LifecycleStateStandby {
+			candidates[*instance.InstanceId] = &leftover{
+				instanceID: *instance.InstanceId,
+				state:      autoscaling.LifecycleStateStandby,
+				protected:  aws.BoolValue(instance.ProtectedFromScaleIn),
+				targets:    make(map[string]*elbv2.TargetDescription),
+			}
+		}
+	}
+
+	privateIPs := make(map[string]string)
+	err := ec2Client.DescribeInstancesPages(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag:aws:autoscaling:groupName"), Values: []*string{asg.AutoScalingGroupName}},
+			{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{ec2.InstanceStateNameRunning, ec2.InstanceStateNameStopped})},
+		},
+	}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				if _, ok := candidates[*instance.InstanceId]; !ok && !inASG[*instance.InstanceId] {
+					candidates[*instance.InstanceId] = &leftover{
+						instanceID: *instance.InstanceId,
+						state:      autoscaling.LifecycleStateDetached,
+						targets:    make(map[string]*elbv2.TargetDescription),
+					}
+				}
+				if _, ok := candidates[*instance.InstanceId]; ok && instance.PrivateIpAddress != nil {
+					privateIPs[*instance.PrivateIpAddress] = *instance.InstanceId
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not describe instances tagged with the ASG")
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	for _, tg := range asg.TargetGroupARNs {
+		descriptions, err := health.describe(*tg)
+		if err != nil {
+			return nil, err
+		}
+		for _, description := range descriptions {
+			id := aws.StringValue(description.Target.Id)
+			if instanceID, ok := privateIPs[id]; ok {
+				id = instanceID
+			}
+			if candidate, ok := candidates[id]; ok {
+				candidate.targets[*tg] = description.Target
+			}
+		}
+	}
+
+	leftovers := make([]leftover, 0)
+	for _, candidate := range candidates {
+		if candidate.protected || len(candidate.targets) > 0 {
+			log.Printf("[WARN] %s instance %s is protected: %t, registered in %d target groups", candidate.state, candidate.instanceID, candidate.protected, len(candidate.targets))
+			leftovers = append(leftovers, *candidate)
+		}
+	}
+	return leftovers, nil
+}
+
+// doCleanup removes the protection and target group registrations of Standby and detached
+// instances of the ASG
+func doCleanup(ctx context.Context, options *Options) error {
+	runID := newRunID()
+	sess := newAWSSession(options)
+	if options.AssumeRoleARN != "" {
+		sess = assumeRole(sess, options.AssumeRoleARN, runID)
+	}
+	if options.DryRun {
+		guardDryRun(sess)
+	}
+	_, cancel := applyTimeouts(ctx, sess, options)
+	defer cancel()
+
+	asgClient := autoscaling.New(sess)
+	albClient := elbv2.New(sess)
+	resp, err := asgClient.DescribeAutoScalingGroups(&autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []*string{aws.String(options.ASG)},
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not describe Auto Scaling Group")
+	}
+	if len(resp.AutoScalingGroups) != 1 {
+		return notFoundError("auto scaling group \"%s\" not found", options.ASG)
+	}
+	asg := resp.AutoScalingGroups[0]
+
+	leftovers, err := findLeftovers(ec2.New(sess), asg, newTargetHealthCache(options.TargetHealthTTL).forRun(albClient))
+	if err != nil {
+		return err
+	}
+	if len(leftovers) == 0 {
+		log.Printf("[INFO] no Standby or detached instances left to clean up")
+		return nil
+	}
+
+	for _, l := range leftovers {
+		for tg, target := range l.targets {
+			req, _ := albClient.DeregisterTargetsRequest(&elbv2.DeregisterTargetsInput{
+				TargetGroupArn: aws.String(tg),
+				Targets:        []*elbv2.TargetDescription{target},
+			})
+			if err := mutate(req, options.DryRun); err != nil {
+				return errors.Wrapf(err, "could not deregister %s instance %s from %s", l.state, l.instanceID, tg)
+			}
+			log.Printf("[INFO] removed %s instance %s from %s", l.state, l.instanceID, tg)
+		}
+		if l.protected {
+			req, _ := asgClient.SetInstanceProtectionRequest(&autoscaling.SetInstanceProtectionInput{
+				AutoScalingGroupName: aws.String(options.ASG),
+				InstanceIds:          []*string{aws.String(l.instanceID)},
+				ProtectedFromScaleIn: aws.Bool(false),
+			})
+			if err := mutate(req, options.DryRun); err != nil {
+				return errors.Wrapf(err, "could not remove protection from %s instance %s", l.state, l.instanceID)
+			}
+			log.Printf("[INFO] removed protection from %s instance %s", l.state, l.instanceID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// checkMaxInstanceLifetime reports old instances that the ASG's MaxInstanceLifetime will replace
+// soon anyway, and with options.SkipNearLifetime keeps those within that window protected to avoid
+// churning them twice.
+func checkMaxInstanceLifetime(ec2Client *ec2.EC2, asg *autoscaling.Group, instanceIds []*string, options *Options) ([]*string, error) {
+	if aws.Int64Value(asg.MaxInstanceLifetime) <= 0 || len(instanceIds) == 0 {
+		return instanceIds, nil
+	}
+	lifetime := time.Duration(*asg.MaxInstanceLifetime) * time.Second
+
+	instances, err := describeInstances(ec2Client, instanceIds)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return filterInstanceIds(instanceIds, func(instanceID string) bool {
+		instance, ok := instances[instanceID]
+		if !ok || instance.LaunchTime == nil {
+			return true
+		}
+		remaining := instance.LaunchTime.Add(lifetime).Sub(now)
+		log.Printf("[DEBUG] instance %s reaches MaxInstanceLifetime %s in %s", instanceID, lifetime, remaining.Round(time.Minute))
+		if options.SkipNearLifetime <= 0 || remaining > options.SkipNearLifetime {
+			return true
+		}
+		log.Printf("[INFO] keeping scale in protection on instance %s, MaxInstanceLifetime will replace it in %s", instanceID, remaining.Round(time.Minute))
+		return false
+	}), nil
+}
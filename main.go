@@ -1,17 +1,24 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"strconv"
-	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/hashicorp/logutils"
 	flags "github.com/jessevdk/go-flags"
 	"github.com/meirf/gopart"
@@ -20,14 +27,135 @@ import (
 
 // Options contains the flag options
 type Options struct {
-	LogLevel              string `long:"log-level" description:"The minimum log level to output (DEBUG, INFO, WARN, ERROR, FATAL)" default:"INFO"`
-	ASG                   string `long:"asg" description:"The ASG to update." required:"true"`
-	DryRun                bool   `long:"dry-run" description:"If set updates are not actually performed."`
-	Version               bool   `long:"version" description:"print version and exit"`
-	Force                 bool   `long:"force" description:"by default if no instances are found at latest version tool does nothing"`
-	PrintLatestInstances  bool   `long:"output-latest-instances" description:"print up-to-date instances to stdout"`
-	PrintInvalidInstances bool   `long:"output-invalid-instances" description:"print out-of-date instances to stdout"`
-	Deregister            bool   `long:"deregister-from-target-groups" description:"remove old instances from target groups as well"`
+	LogLevel                  string        `long:"log-level" env:"RIP_LOG_LEVEL" description:"The minimum log level to output (DEBUG, INFO, WARN, ERROR, FATAL)" default:"INFO"`
+	ASG                       string        `long:"asg" env:"RIP_ASG" description:"The ASG to update. Required unless running a command."`
+	ASGConfig                 string        `long:"asg-config" env:"RIP_ASG_CONFIG" description:"update the ASGs listed in this JSON file one after the other instead of --asg, each optionally overriding rotate_percent, rotate_order, max_unprotect_spot, max_unprotect_on_demand, deregister and min_healthy_per_az of the command line, and setting a priority to be swept earlier; report, state, plan and instance list files get the ASG name appended to their names"`
+	DryRun                    bool          `long:"dry-run" env:"RIP_DRY_RUN" description:"If set updates are not actually performed."`
+	OfflinePlan               string        `long:"offline-plan" env:"RIP_OFFLINE_PLAN" description:"classify and plan from AWS responses captured as JSON in this directory, one <service>.<Operation>.json file per API call (e.g. autoscaling.DescribeAutoScalingGroups.json, as printed by the AWS CLI), without calling AWS; implies --dry-run"`
+	Record                    string        `long:"record" env:"RIP_RECORD" description:"capture the response of every AWS call of each run as JSON into this directory, with account ids and user data scrubbed, to replay the run with --offline-plan or attach to a bug report"`
+	Version                   bool          `long:"version" env:"RIP_VERSION" description:"print version and exit"`
+	Force                     bool          `long:"force" env:"RIP_FORCE" description:"by default if no instances are found at latest version tool does nothing"`
+	PrintLatestInstances      bool          `long:"output-latest-instances" env:"RIP_OUTPUT_LATEST_INSTANCES" description:"print up-to-date instances to stdout"`
+	PrintInvalidInstances     bool          `long:"output-invalid-instances" env:"RIP_OUTPUT_INVALID_INSTANCES" description:"print out-of-date instances to stdout"`
+	LatestFile                string        `long:"latest-file" env:"RIP_LATEST_FILE" description:"write up-to-date instances to this file, one per line"`
+	InvalidFile               string        `long:"invalid-file" env:"RIP_INVALID_FILE" description:"write out-of-date instances to this file, one per line"`
+	PrintAllInstances         bool          `long:"output-all-instances" env:"RIP_OUTPUT_ALL_INSTANCES" description:"print every instance with its state (latest, newer, stale-protected, stale-unprotected, foreign-protected, foreign-unprotected, unknown, skipped, excluded, latest-unhealthy, expired, reaped, conflict) to stdout, tab separated"`
+	Deregister                bool          `long:"deregister-from-target-groups" env:"RIP_DEREGISTER_FROM_TARGET_GROUPS" description:"remove old instances from target groups as well"`
+	DeregisterOnly            bool          `long:"deregister-only" env:"RIP_DEREGISTER_ONLY" description:"remove old instances from target groups but leave scale in protection untouched"`
+	DeregisterEvenIfNoLatest  bool          `long:"deregister-even-if-no-latest" env:"RIP_DEREGISTER_EVEN_IF_NO_LATEST" description:"remove old instances from target groups even if no instances at the latest version exist"`
+	MinHealthyPerAZ           int           `long:"min-healthy-per-az" env:"RIP_MIN_HEALTHY_PER_AZ" description:"when deregistering, keep at least this many capacity units (instance weights from the MixedInstancesPolicy, otherwise instances) of healthy targets per availability zone in each target group, deferring the rest to a later run (0 disables)" default:"0"`
+	TargetGroupConcurrency    int           `long:"target-group-concurrency" env:"RIP_TARGET_GROUP_CONCURRENCY" description:"maximum number of target groups to deregister from in parallel" default:"4"`
+	TargetHealthTTL           time.Duration `long:"target-health-ttl" env:"RIP_TARGET_HEALTH_TTL" description:"how long DescribeTargetHealth responses are reused before being refreshed" default:"30s"`
+	Route53Cleanup            bool          `long:"route53-cleanup" env:"RIP_ROUTE53_CLEANUP" description:"delete per-instance Route 53 records of old instances once they were drained or their protection was removed"`
+	Route53Tag                string        `long:"route53-tag" env:"RIP_ROUTE53_TAG" description:"instance tag naming the per-instance record as <hosted-zone-id>/<record-name>" default:"remove-instance-protection:route53-record"`
+	SkipInstancesWithEIP      bool          `long:"skip-instances-with-eip" env:"RIP_SKIP_INSTANCES_WITH_EIP" description:"keep scale in protection on old instances holding Elastic IPs or secondary network interfaces"`
+	AllowDataVolumes          bool          `long:"allow-data-volumes" env:"RIP_ALLOW_DATA_VOLUMES" description:"remove protection from old instances even if they have non-root EBS volumes that survive termination or are tagged as data volumes"`
+	DataVolumeTag             string        `long:"data-volume-tag" env:"RIP_DATA_VOLUME_TAG" description:"tag key marking EBS volumes as data volumes" default:"data-volume"`
+	SnapshotBeforeUnprotect   bool          `long:"snapshot-before-unprotect" env:"RIP_SNAPSHOT_BEFORE_UNPROTECT" description:"snapshot the EBS volumes of old instances, tagged with the run id, before removing their protection"`
+	SnapshotExcludeBootVolume bool          `long:"snapshot-exclude-boot-volume" env:"RIP_SNAPSHOT_EXCLUDE_BOOT_VOLUME" description:"only snapshot non-root volumes with --snapshot-before-unprotect"`
+	RequireSSMOnline          bool          `long:"require-ssm-online" env:"RIP_REQUIRE_SSM_ONLINE" description:"only remove protection from as many old instances as there are latest instances online in SSM, and report old instances not managed by SSM"`
+	DrainMetricName           string        `long:"drain-metric-name" env:"RIP_DRAIN_METRIC_NAME" description:"CloudWatch metric with an InstanceId dimension to wait on before removing protection, e.g. a per-instance connection count"`
+	DrainMetricNamespace      string        `long:"drain-metric-namespace" env:"RIP_DRAIN_METRIC_NAMESPACE" description:"namespace of --drain-metric-name" default:"CWAgent"`
+	DrainMetricStatistic      string        `long:"drain-metric-statistic" env:"RIP_DRAIN_METRIC_STATISTIC" description:"statistic of --drain-metric-name to compare" choice:"Maximum" choice:"Average" choice:"Sum" choice:"Minimum" choice:"SampleCount" default:"Maximum"`
+	DrainMetricThreshold      float64       `long:"drain-metric-threshold" env:"RIP_DRAIN_METRIC_THRESHOLD" description:"an instance is drained once --drain-metric-name is at or below this value" default:"0"`
+	DrainMetricTimeout        time.Duration `long:"drain-metric-timeout" env:"RIP_DRAIN_METRIC_TIMEOUT" description:"how long to wait for --drain-metric-name before keeping an instance protected" default:"10m"`
+	DrainMetricMissingDrained bool          `long:"drain-metric-missing-drained" env:"RIP_DRAIN_METRIC_MISSING_DRAINED" description:"count an instance without a recent --drain-metric-name datapoint as drained, for metrics that are only published while non-zero; by default it is waited on until --drain-metric-timeout"`
+	SessionDrain              bool          `long:"session-drain" env:"RIP_SESSION_DRAIN" description:"before removing protection, wait for active Session Manager sessions on old instances to end, e.g. for bastion ASGs (use --drain-metric-name for SSH connections counted by a CloudWatch metric)"`
+	SessionDrainTimeout       time.Duration `long:"session-drain-timeout" env:"RIP_SESSION_DRAIN_TIMEOUT" description:"how long to wait for --session-drain before keeping an instance protected" default:"30m"`
+	HealthURLTemplate         string        `long:"health-url-template" env:"RIP_HEALTH_URL_TEMPLATE" description:"only count latest instances as healthy if this URL answers with a 2xx status; {instance-id}, {private-ip}, {public-ip} and {private-dns} are replaced per instance, e.g. http://{private-ip}:8080/healthz"`
+	HealthURLTimeout          time.Duration `long:"health-url-timeout" env:"RIP_HEALTH_URL_TIMEOUT" description:"timeout of each --health-url-template probe" default:"5s"`
+	RotateOrder               string        `long:"rotate-order" env:"RIP_ROTATE_ORDER" description:"remove protection from spot or on-demand old instances first" choice:"spot-first" choice:"on-demand-first"`
+	MaxUnprotectSpot          float64       `long:"max-unprotect-spot" env:"RIP_MAX_UNPROTECT_SPOT" description:"maximum capacity units of spot instances to remove protection from per run (0 is unlimited)" default:"0"`
+	MaxUnprotectOnDemand      float64       `long:"max-unprotect-on-demand" env:"RIP_MAX_UNPROTECT_ON_DEMAND" description:"maximum capacity units of on-demand instances to remove protection from per run (0 is unlimited)" default:"0"`
+	RotatePercent             int           `long:"rotate-percent" env:"RIP_ROTATE_PERCENT" description:"only deregister and remove protection from the oldest this percent (by launch time) of the stale instances still protected, for a slow rotation over several scheduled runs (0 rotates all)" default:"0"`
+	SkipNearLifetime          time.Duration `long:"skip-near-lifetime" env:"RIP_SKIP_NEAR_LIFETIME" description:"keep protection on old instances the ASG MaxInstanceLifetime will replace within this duration, e.g. 24h (0 disables)" default:"0"`
+	IgnoreManagedASG          bool          `long:"ignore-managed-asg" env:"RIP_IGNORE_MANAGED_ASG" description:"act on ASGs tagged as managed by ECS capacity providers or EKS node groups; ASGs tagged for Kubernetes Cluster Autoscaler are governed by --cluster-autoscaler-policy alone, with or without this flag"`
+	ClusterAutoscalerPolicy   string        `long:"cluster-autoscaler-policy" env:"RIP_CLUSTER_AUTOSCALER_POLICY" description:"how to treat ASGs managed by Kubernetes Cluster Autoscaler: skip them, require --kubeconfig to check scale-down-disabled nodes, or check nodes only when --kubeconfig is provided" choice:"skip" choice:"require-kubeconfig" choice:"check" default:"require-kubeconfig"`
+	Kubeconfig                string        `long:"kubeconfig" env:"RIP_KUBECONFIG" description:"kubeconfig used to find nodes annotated cluster-autoscaler.kubernetes.io/scale-down-disabled, which are never unprotected"`
+	Kubectl                   string        `long:"kubectl" env:"RIP_KUBECTL" description:"kubectl binary used with --kubeconfig" default:"kubectl"`
+	StateFile                 string        `long:"state-file" env:"RIP_STATE_FILE" description:"JSON file recording each instance state of this run; if it exists, changes since the previous run are reported"`
+	ConsistencyRetries        int           `long:"consistency-retries" env:"RIP_CONSISTENCY_RETRIES" description:"how many times to re-describe the Launch Template while instances report a version newer than its latest" default:"3"`
+	ConsistencyRetryDelay     time.Duration `long:"consistency-retry-delay" env:"RIP_CONSISTENCY_RETRY_DELAY" description:"delay between --consistency-retries" default:"5s"`
+	CheckLaunchability        bool          `long:"check-launchability" env:"RIP_CHECK_LAUNCHABILITY" description:"before recycling, check that the latest Launch Template version can launch replacements: its AMI is available, its instance types are offered in the ASG's availability zones, and its security groups and the ASG's subnets exist"`
+	CheckQuotas               bool          `long:"check-quotas" env:"RIP_CHECK_QUOTAS" description:"before removing protection, warn when the On-Demand vCPU quotas of the instance families involved, given the vCPUs already running in the region, likely can't fit a replacement for each instance"`
+	CheckSpotCapacity         bool          `long:"check-spot-capacity" env:"RIP_CHECK_SPOT_CAPACITY" description:"for ASGs launching Spot instances, warn before draining when the last day of scaling activities shows launches failing for lack of capacity or Spot interruptions"`
+	NewerVersionPolicy        string        `long:"newer-version-policy" env:"RIP_NEWER_VERSION_POLICY" description:"how to treat instances reporting a Launch Template version newer than the latest: count them as current, or fail the run" choice:"current" choice:"error" default:"current"`
+	EmptyASGPolicy            string        `long:"empty-asg-policy" env:"RIP_EMPTY_ASG_POLICY" description:"how to treat an ASG with no instances, or with the Launch and Terminate processes suspended so it can't replace any: continue as usual, skip the run, or error with exit code 8, reporting status empty in --report-file when it doesn't error" choice:"continue" choice:"skip" choice:"error" default:"continue"`
+	APITimeout                time.Duration `long:"api-timeout" env:"RIP_API_TIMEOUT" description:"timeout of each AWS API call, including its retries (0 disables)" default:"30s"`
+	Timeout                   time.Duration `long:"timeout" env:"RIP_TIMEOUT" description:"timeout of the whole run; AWS API calls fail once it has passed (0 disables)" default:"0"`
+	MaxIdleConns              int           `long:"max-idle-conns" env:"RIP_MAX_IDLE_CONNS" description:"maximum number of idle connections to AWS kept open, shared by all accounts and ASGs of the run" default:"100"`
+	MaxIdleConnsPerHost       int           `long:"max-idle-conns-per-host" env:"RIP_MAX_IDLE_CONNS_PER_HOST" description:"maximum number of idle connections kept open to each AWS endpoint; raise it with parallel sweeps so connections are reused instead of reopened" default:"16"`
+	IdleConnTimeout           time.Duration `long:"idle-conn-timeout" env:"RIP_IDLE_CONN_TIMEOUT" description:"close idle connections to AWS after this duration (0 keeps them open)" default:"90s"`
+	HTTPKeepAlive             time.Duration `long:"http-keep-alive" env:"RIP_HTTP_KEEP_ALIVE" description:"TCP keep-alive period of connections to AWS (0 disables TCP keep-alive)" default:"30s"`
+	HTTPTimeout               time.Duration `long:"http-timeout" env:"RIP_HTTP_TIMEOUT" description:"timeout of each HTTP request to AWS, not counting retries (0 disables, leaving it to --api-timeout)" default:"0"`
+	MaxConsecutiveErrors      int           `long:"max-consecutive-errors" env:"RIP_MAX_CONSECUTIVE_ERRORS" description:"after more than this many consecutive AWS API errors, stop making changes and exit with code 3 (0 disables)" default:"5"`
+	ReprotectOnAbort          bool          `long:"reprotect-on-abort" env:"RIP_REPROTECT_ON_ABORT" description:"when the circuit breaker trips, re-enable scale in protection on instances this run already unprotected"`
+	AssumeRoleARN             string        `long:"assume-role-arn" env:"RIP_ASSUME_ROLE_ARN" description:"assume this role for all AWS calls, refreshing its credentials automatically before they expire"`
+	ExpectedRunDuration       time.Duration `long:"expected-run-duration" env:"RIP_EXPECTED_RUN_DURATION" description:"warn if credentials expire sooner than this (--timeout is used instead when set)" default:"15m"`
+	RefuseExpiringCredentials bool          `long:"refuse-expiring-credentials" env:"RIP_REFUSE_EXPIRING_CREDENTIALS" description:"fail instead of warning when credentials expire before the expected run duration"`
+	NoVersionCheck            bool          `long:"no-version-check" env:"RIP_NO_VERSION_CHECK" description:"do not check GitHub for a newer release on startup"`
+	Daemon                    bool          `long:"daemon" env:"RIP_DAEMON" description:"keep running, updating the ASG every --interval until SIGINT or SIGTERM"`
+	Once                      bool          `long:"once" env:"RIP_ONCE" description:"run a single update even if --daemon is set, e.g. by the environment of a shared image"`
+	Interval                  time.Duration `long:"interval" env:"RIP_INTERVAL" description:"time between updates with --daemon" default:"10m"`
+	HealthFile                string        `long:"health-file" env:"RIP_HEALTH_FILE" description:"after each run write \"ok <time>\" or \"error <time> <message>\" to this file, for container health checks"`
+	ForeignTemplatePolicy     string        `long:"foreign-template-policy" env:"RIP_FOREIGN_TEMPLATE_POLICY" description:"how to treat instances launched from a different Launch Template than the ASG, e.g. by another blue/green rollout: leave them alone quietly, leave them alone with a warning, or recycle them like stale instances" choice:"skip" choice:"warn" choice:"recycle" default:"recycle"`
+	TemplateReplacedPolicy    string        `long:"template-replaced-policy" env:"RIP_TEMPLATE_REPLACED_POLICY" description:"how to treat instances the ASG launched from a Launch Template it has since been switched away from, a blue/green template swap that calls for a full rotation: like --foreign-template-policy, leave them alone quietly, leave them alone with a warning, or recycle them like stale instances" choice:"foreign" choice:"skip" choice:"warn" choice:"recycle" default:"foreign"`
+	ReportFile                string        `long:"report-file" env:"RIP_REPORT_FILE" description:"write a JSON report of each run, with instance states, actions taken and any error with its kind and exit code, to this file"`
+	ReportSigningKey          string        `long:"report-signing-key" env:"RIP_REPORT_SIGNING_KEY" description:"also sign the SHA-256 digest of --report-file with this asymmetric KMS key, writing the base64 signature next to it with a .sig suffix"`
+	ReportSigningAlgorithm    string        `long:"report-signing-algorithm" env:"RIP_REPORT_SIGNING_ALGORITHM" description:"KMS signing algorithm for --report-signing-key" choice:"RSASSA_PSS_SHA_256" choice:"RSASSA_PKCS1_V1_5_SHA_256" choice:"ECDSA_SHA_256" default:"RSASSA_PSS_SHA_256"`
+	KMSKeyID                  string        `long:"kms-key-id" env:"RIP_KMS_KEY_ID" description:"encrypt the state, plan and report files with a data key from this KMS key; encrypted files are decrypted when read whether or not this is set"`
+	KeepGoing                 bool          `long:"keep-going" env:"RIP_KEEP_GOING" description:"record failures of single accounts or ASGs of a sweep, target groups, Route 53 records and protection batches and continue with the rest, exiting non-zero with a failure summary at the end"`
+	InstanceWarmup            time.Duration `long:"instance-warmup" env:"RIP_INSTANCE_WARMUP" description:"minimum time since launch before a latest instance counts as healthy replacement capacity; the ASG health check grace period applies if it is longer"`
+	PendingHookTimeout        time.Duration `long:"pending-hook-timeout" env:"RIP_PENDING_HOOK_TIMEOUT" description:"fail if a new instance has been waiting on a launch lifecycle hook (Pending:Wait) for longer than this"`
+	HealthConditions          []string      `long:"health-condition" env:"RIP_HEALTH_CONDITION" description:"condition a latest instance must pass to count as healthy replacement capacity: asg, warmup, target-health, probe, cloudwatch:<namespace>:<metric>:<statistic><op><threshold> (e.g. cloudwatch:CWAgent:mem_used_percent:Maximum<90) or ssm:<document>[:<command>]; may be repeated (default: asg without target groups, warmup, and probe with --health-url-template)"`
+	HealthCommandTimeout      time.Duration `long:"health-command-timeout" env:"RIP_HEALTH_COMMAND_TIMEOUT" description:"how long to wait for the command of an ssm: --health-condition before counting the instances it hasn't finished on as unhealthy" default:"2m"`
+	WaitForTermination        bool          `long:"wait-for-termination" env:"RIP_WAIT_FOR_TERMINATION" description:"after removing protection, follow the instances until the ASG terminates and replaces them, recording a per-instance timeline in --report-file"`
+	TerminationTimeout        time.Duration `long:"termination-timeout" env:"RIP_TERMINATION_TIMEOUT" description:"how long --wait-for-termination follows the instances" default:"30m"`
+	VerifyProtection          bool          `long:"verify-protection" env:"RIP_VERIFY_PROTECTION" description:"after removing protection, re-describe the ASG and retry instances that are still protected, failing if they stay protected"`
+	VerifyRetries             int           `long:"verify-retries" env:"RIP_VERIFY_RETRIES" description:"how many times --verify-protection retries instances that are still protected" default:"3"`
+	VerifyDelay               time.Duration `long:"verify-delay" env:"RIP_VERIFY_DELAY" description:"how long --verify-protection waits before each recheck" default:"5s"`
+	SNSTopicARN               string        `long:"sns-topic-arn" env:"RIP_SNS_TOPIC_ARN" description:"publish a JSON message per instance to this SNS topic when it is about to be drained, drained, and unprotected"`
+	OrgDiscover               bool          `long:"org-discover" env:"RIP_ORG_DISCOVER" description:"run in every active account of the AWS Organization, assuming --org-role-name in each; report, state, plan and instance list files get the account id appended to their names"`
+	OrgRoleName               string        `long:"org-role-name" env:"RIP_ORG_ROLE_NAME" description:"name of the role to assume in each account with --org-discover"`
+	OrgIncludeOUs             []string      `long:"org-include-ou" env:"RIP_ORG_INCLUDE_OU" description:"with --org-discover, only sweep accounts in this organizational unit or below it, may be repeated"`
+	OrgExcludeOUs             []string      `long:"org-exclude-ou" env:"RIP_ORG_EXCLUDE_OU" description:"with --org-discover, skip accounts in this organizational unit or below it, may be repeated"`
+	OrgConcurrency            int           `long:"org-concurrency" env:"RIP_ORG_CONCURRENCY" description:"with --org-discover, how many accounts to sweep at once; with more than one, every account runs in a child process of its own" default:"1"`
+	OrgWindow                 time.Duration `long:"org-window" env:"RIP_ORG_WINDOW" description:"with --org-discover, spread the start of the accounts evenly over this window, e.g. 4h for a nightly sweep (0 starts each as soon as a slot is free)" default:"0"`
+	MaxAPICalls               int           `long:"max-api-calls" env:"RIP_MAX_API_CALLS" description:"abort the run before making more than this many AWS API calls; with --org-discover this is the budget of each account"`
+	MaxMutations              int           `long:"max-mutations" env:"RIP_MAX_MUTATIONS" description:"abort the run before making more than this many state-changing AWS API calls"`
+	SweepMaxMutations         int           `long:"sweep-max-mutations" env:"RIP_SWEEP_MAX_MUTATIONS" description:"with --asg-config, make at most this many state-changing AWS API calls over all ASGs of a sweep, sweeping ASGs of a higher priority first and deferring the rest to later runs (0 is unlimited)"`
+	ExcludeInstances          []string      `long:"exclude-instance" env:"RIP_EXCLUDE_INSTANCE" description:"never remove protection from or deregister this instance, may be repeated"`
+	ExcludeSources            []string      `long:"exclude-source" env:"RIP_EXCLUDE_SOURCE" description:"read instance ids to exclude at runtime from ssm:<parameter-name>, s3://<bucket>/<key> or file:<path>, separated by commas or whitespace, may be repeated"`
+	ProtectionMaxAge          time.Duration `long:"protection-max-age" env:"RIP_PROTECTION_MAX_AGE" description:"also remove protection, regardless of Launch Template version, from instances this tool protected longer ago than this (tracked by the remove-instance-protection:protected-at tag)"`
+	ReapZombies               bool          `long:"reap-zombies" env:"RIP_REAP_ZOMBIES" description:"remove protection from latest instances that are registered in none of the ASG's target groups"`
+	ExcludeUnhealthyLatest    bool          `long:"exclude-unhealthy-latest" env:"RIP_EXCLUDE_UNHEALTHY_LATEST" description:"don't count latest instances that are unhealthy in a target group as replacement capacity (same as adding --health-condition target-health)"`
+	StatsdAddr                string        `long:"statsd-addr" env:"RIP_STATSD_ADDR" description:"send run metrics and AWS call timings to the StatsD agent at this host:port"`
+	StatsdPrefix              string        `long:"statsd-prefix" env:"RIP_STATSD_PREFIX" description:"prefix of the StatsD metric names" default:"remove_instance_protection"`
+	StatsdFormat              string        `long:"statsd-format" env:"RIP_STATSD_FORMAT" description:"send plain StatsD, or DogStatsD with asg, service and operation tags" choice:"statsd" choice:"dogstatsd" default:"statsd"`
+	TeamsWebhookURL           string        `long:"teams-webhook-url" env:"RIP_TEAMS_WEBHOOK_URL" description:"post an adaptive card summary of each run to this Microsoft Teams incoming webhook"`
+	SecretSource              string        `long:"secret-source" env:"RIP_SECRET_SOURCE" description:"where secrets such as --teams-webhook-url come from: the flag or environment itself, or the name of an SSM SecureString parameter or Secrets Manager secret holding them, so deployments needn't carry them in plaintext" choice:"plain" choice:"ssm" choice:"secretsmanager" default:"plain"`
+	NotifyOn                  string        `long:"notify-on" env:"RIP_NOTIFY_ON" description:"which runs to send notifications for: runs that changed something or failed, only failed runs, every run, or none" choice:"changes" choice:"errors" choice:"always" choice:"never" default:"changes"`
+	NotifyDryRun              bool          `long:"notify-dry-run" env:"RIP_NOTIFY_DRY_RUN" description:"also send notifications with the plan of dry-run runs"`
+	NotifyTemplate            string        `long:"notify-template" env:"RIP_NOTIFY_TEMPLATE" description:"Go template file rendering the notification text from the run report (the --report-file report, e.g. {{.ASG}}, {{.Status}} and {{.Error.Message}})"`
+	HistoryTable              string        `long:"history-table" env:"RIP_HISTORY_TABLE" description:"DynamoDB table (partition key asg, sort key time, both strings) storing the report of each run, read by the history command"`
+	DriftSLO                  time.Duration `long:"drift-slo" env:"RIP_DRIFT_SLO" description:"with --daemon, alert through the configured notification sinks once the ASG has had stale instances for longer than this"`
+	MaintenanceWindows        []string      `long:"maintenance-window" env:"RIP_MAINTENANCE_WINDOW" description:"only make changes inside this weekly window, e.g. \"Mon-Fri 09:00-17:00 America/Los_Angeles\", and run in check-only mode outside it; may be repeated"`
+	FreezeSources             []string      `long:"freeze-source" env:"RIP_FREEZE_SOURCE" description:"run in check-only mode during a change freeze declared by ssm:<parameter-name> or tag:<asg-tag-key> set to true, or by a file:<calendar-path> of \"<from> <to> [comment]\" date ranges; may be repeated"`
+	Splay                     time.Duration `long:"splay" env:"RIP_SPLAY" description:"wait a random time up to this long before each run, so many scheduled replicas don't hit the AWS APIs at once"`
+	MaxAMIAge                 days          `long:"max-ami-age" env:"RIP_MAX_AMI_AGE" description:"also recycle instances, regardless of Launch Template version, whose AMI is older than this, e.g. 30d"`
+	DeregisteredAMIPolicy     string        `long:"deregistered-ami-policy" env:"RIP_DEREGISTERED_AMI_POLICY" description:"how to treat instances running an AMI that has been deregistered, regardless of their Launch Template version: only report them in --report-file and --history-table, or recycle them like stale instances" choice:"report" choice:"recycle" default:"report"`
+	RequirePatchCompliance    bool          `long:"require-patch-compliance" env:"RIP_REQUIRE_PATCH_COMPLIANCE" description:"also recycle instances, regardless of Launch Template version, that SSM Patch Manager reports as missing or having failed patches"`
+	RecycleSources            []string      `long:"recycle-source" env:"RIP_RECYCLE_SOURCE" description:"recycle the instance ids read from file:<path>, s3://<bucket>/<key>, ssm:<parameter-name> or sqs:<queue-url> regardless of Launch Template version, e.g. from vulnerability scanners; queue messages are deleted once the run removed protection from all of their instances; may be repeated"`
+	SavePlan                  string        `long:"save-plan" env:"RIP_SAVE_PLAN" description:"write the plan of this run (instance states and the instances to deregister and unprotect) as JSON to this file"`
+	ComparePlan               string        `long:"compare-plan" env:"RIP_COMPARE_PLAN" description:"report what changed between the plan saved by an earlier --save-plan run and this one"`
+	ApplyPlan                 string        `long:"apply-plan" env:"RIP_APPLY_PLAN" description:"only deregister and unprotect the instances in the plan saved by an earlier --save-plan run, refusing if the ASG changed since"`
+	PlanMaxAge                time.Duration `long:"plan-max-age" env:"RIP_PLAN_MAX_AGE" description:"refuse to apply plans older than this with --apply-plan" default:"24h"`
+	ForceApply                bool          `long:"force-apply" env:"RIP_FORCE_APPLY" description:"apply a plan with --apply-plan even if it is too old or the ASG changed since"`
+	ProtectReplacements       bool          `long:"protect-replacements" env:"RIP_PROTECT_REPLACEMENTS" description:"enable scale in protection on healthy latest instances that aren't protected yet, for ASGs that don't protect new instances by default"`
+	NoColor                   bool          `long:"no-color" env:"RIP_NO_COLOR" description:"disable colored log output (also disabled by NO_COLOR or when stderr is not a terminal)"`
+
+	// account is the id of the account a run of an organization sweep acts in
+	account string
 }
 
 // These variables are filled by goreleaser
@@ -37,10 +165,82 @@ var (
 	date    = "unknown"
 )
 
+// newRunID returns an id identifying this run in the tags and records it leaves behind
+func newRunID() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405Z"), hex.EncodeToString(b))
+}
+
 func main() {
 	options := Options{}
+	selfUpdate := SelfUpdateCommand{}
+	cleanup := CleanupCommand{}
+	history := HistoryCommand{}
+	lastRun := LastRunCommand{}
+	doctor := DoctorCommand{}
+	explain := ExplainCommand{}
+	reconcile := ReconcileCommand{}
 	parser := flags.NewParser(&options, flags.Default)
-	_, err := parser.Parse()
+	parser.SubcommandsOptional = true
+	_, err := parser.AddCommand("self-update", "Update to the latest release", "Replace this binary with the latest GitHub release after verifying its checksum.", &selfUpdate)
+	if err != nil {
+		log.Fatalf("[FATAL] %v", err)
+	}
+	_, err = parser.AddCommand("cleanup", "Clean up Standby and detached instances", "Remove scale in protection and target group registrations left on Standby instances and instances detached from the ASG.", &cleanup)
+	if err != nil {
+		log.Fatalf("[FATAL] %v", err)
+	}
+	_, err = parser.AddCommand("history", "Show recent runs", "Print the reports of the most recent runs for the ASG stored in --history-table, newest first.", &history)
+	if err != nil {
+		log.Fatalf("[FATAL] %v", err)
+	}
+	_, err = parser.AddCommand("last-run", "Show the last run", "Print the full JSON report of the most recent run for the ASG stored in --history-table.", &lastRun)
+	if err != nil {
+		log.Fatalf("[FATAL] %v", err)
+	}
+	_, err = parser.AddCommand("doctor", "Diagnose the environment", "Check credentials, region, permissions, the ASG, its Launch Template and target groups, and print a checklist of what to fix.", &doctor)
+	if err != nil {
+		log.Fatalf("[FATAL] %v", err)
+	}
+	_, err = parser.AddCommand("explain", "Explain the decisions for one instance", "Run in dry-run mode and print every step that concerned the instance: its Launch Template and version, the filters and guards that applied, and what would be done.", &explain)
+	if err != nil {
+		log.Fatalf("[FATAL] %v", err)
+	}
+	_, err = parser.AddCommand("reconcile", "Protect instances again after an aborted run", "Compare the scale in protection of the ASG's instances with the last run recorded to --state-file, or without one with their remove-instance-protection:protected-at tags, and protect the InService instances again that lost it since.", &reconcile)
+	if err != nil {
+		log.Fatalf("[FATAL] %v", err)
+	}
+	_, err = parser.Parse()
+	if err == nil && parser.Active != nil && parser.Active.Name != "self-update" && options.ASG == "" && !options.Version {
+		err = &flags.Error{Type: flags.ErrRequired, Message: "the required flag `--asg' was not specified"}
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if err == nil && parser.Active == nil && options.ASG == "" && options.ASGConfig == "" && !options.Version {
+		err = &flags.Error{Type: flags.ErrRequired, Message: "the required flag `--asg' or `--asg-config' was not specified"}
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if err == nil && options.ASG != "" && options.ASGConfig != "" {
+		err = &flags.Error{Type: flags.ErrInvalidChoice, Message: "`--asg' and `--asg-config' can't be used together"}
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if err == nil && options.ASGConfig != "" && options.OrgDiscover {
+		err = &flags.Error{Type: flags.ErrInvalidChoice, Message: "`--asg-config' can't be used with `--org-discover'"}
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if err == nil && options.HealthURLTemplate == "" {
+		for _, condition := range options.HealthConditions {
+			if condition == "probe" {
+				err = &flags.Error{Type: flags.ErrRequired, Message: "`--health-condition probe' requires `--health-url-template'"}
+				fmt.Fprintln(os.Stderr, err)
+				break
+			}
+		}
+	}
+	if err == nil && options.OrgDiscover && options.OrgRoleName == "" {
+		err = &flags.Error{Type: flags.ErrRequired, Message: "`--org-discover' requires `--org-role-name'"}
+		fmt.Fprintln(os.Stderr, err)
+	}
 	if err != nil {
 		if e, ok := err.(*flags.Error); ok && e.Type != flags.ErrHelp {
 			fmt.Printf("\n")
@@ -51,30 +251,193 @@ func main() {
 	}
 
 	// Init Logger
+	var logWriter io.Writer = os.Stderr
+	if useColor(os.Stderr, options.NoColor) {
+		logWriter = &colorWriter{w: os.Stderr}
+	}
 	filter := &logutils.LevelFilter{
 		Levels:   []logutils.LogLevel{"SPAM", "DEBUG", "INFO", "WARN", "ERROR", "DRYRUN"},
 		MinLevel: logutils.LogLevel(options.LogLevel),
-		Writer:   os.Stderr,
+		Writer:   logWriter,
 	}
 	log.SetOutput(filter)
+	if account, ok := orgChildAccount(); ok {
+		// the parent of a parallel organization sweep schedules this single run of one account
+		log.SetPrefix("account " + account.id + " ")
+		options.Once = true
+		options.Splay = 0
+		options.NoVersionCheck = true
+		options.HealthFile = ""
+	}
+	logDebug = filter.Check([]byte("[DEBUG]"))
 
 	if options.Version {
 		fmt.Printf("%s-%s-%s\n", version, commit, date)
 		os.Exit(0)
 	}
 
-	err = doUpdate(&options)
+	if parser.Active != nil && parser.Active.Name == "self-update" {
+		if err := doSelfUpdate(&selfUpdate); err != nil {
+			log.Fatalf("[FATAL] error updating binary: %v", err)
+		}
+		return
+	}
+
+	if parser.Active != nil && parser.Active.Name == "last-run" {
+		history = HistoryCommand{Limit: 1, JSON: true, Account: lastRun.Account}
+	}
+	if parser.Active != nil && (parser.Active.Name == "history" || parser.Active.Name == "last-run") {
+		if err := doHistory(os.Stdout, &history, &options); err != nil {
+			log.Fatalf("[FATAL] error reading history: %v", err)
+		}
+		return
+	}
+
+	if parser.Active != nil && parser.Active.Name == "doctor" {
+		if err := doDoctor(os.Stdout, &options); err != nil {
+			log.Fatalf("[FATAL] %v", err)
+		}
+		return
+	}
+
+	if parser.Active != nil && parser.Active.Name == "explain" {
+		ctx, stop := signalContext()
+		err := doExplain(ctx, os.Stdout, &explain, &options)
+		stop()
+		if err != nil {
+			log.Fatalf("[FATAL] %v", err)
+		}
+		return
+	}
+
+	if parser.Active != nil && parser.Active.Name == "cleanup" {
+		ctx, stop := signalContext()
+		err := doCleanup(ctx, &options)
+		stop()
+		if err != nil {
+			log.Printf("[FATAL] error cleaning up (%s): %v", classifyError(err), err)
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+
+	if parser.Active != nil && parser.Active.Name == "reconcile" {
+		ctx, stop := signalContext()
+		err := doReconcile(ctx, &reconcile, &options)
+		stop()
+		if err != nil {
+			log.Printf("[FATAL] error reconciling (%s): %v", classifyError(err), err)
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+
+	if !options.NoVersionCheck && options.OfflinePlan == "" {
+		checkVersion()
+	}
+
+	err = runLoop(&options)
 	if err != nil {
-		log.Fatalf("[FATAL] error updating: %v", err)
+		log.Printf("[FATAL] error updating (%s): %v", classifyError(err), err)
+		os.Exit(exitCode(err))
 	}
 }
 
-func doUpdate(options *Options) error {
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
+// runOnce runs the update in the current account, with --org-discover in every account of the
+// organization, or with --asg-config of every ASG listed. hooks, if set, report the run of each ASG.
+func runOnce(ctx context.Context, options *Options, hooks *runHooks) error {
+	allowed, err := inMaintenanceWindow(options, time.Now())
+	if err != nil {
+		return err
+	}
+	if !allowed && !options.DryRun {
+		log.Printf("[INFO] outside of the maintenance windows %v, running in check-only mode", options.MaintenanceWindows)
+		checkOnly := *options
+		checkOnly.DryRun = true
+		options = &checkOnly
+	}
+	sess := newAWSSession(options)
+	if options.OfflinePlan != "" {
+		log.Printf("[INFO] planning offline from the responses captured in %s", options.OfflinePlan)
+		offline := *options
+		offline.DryRun = true
+		offline.AssumeRoleARN = ""
+		offline.OrgDiscover = false
+		options = &offline
+		sess = offlineSession(sess, options.OfflinePlan)
+	}
+	health := newTargetHealthCache(options.TargetHealthTTL)
+	if options.OrgDiscover {
+		return runOrganization(ctx, sess, options, hooks, health)
+	}
+	if options.ASGConfig != "" {
+		return runASGs(ctx, sess, options, hooks, health)
+	}
+	err = doUpdate(ctx, sess, options, health)
+	hooks.finish(options, err, currentRunResult())
+	return err
+}
+
+// doUpdate runs the update of options.ASG. health is the target health cache of the sweep the
+// run is part of.
+func doUpdate(ctx context.Context, sess *session.Session, options *Options, health *targetHealthCache) (err error) {
+	runID := newRunID()
+	log.Printf("[DEBUG] starting run %s", runID)
+	stats = newRunStats()
+	stats.runID = runID
+	defer stats.print()
+	defer func() {
+		if err == nil {
+			err = stats.failuresError()
+		}
+	}()
+	if options.PrintAllInstances {
+		defer printInstanceStates(os.Stdout)
+	}
+
+	// handlers are added per run, so don't add them to the caller's session
+	sess = sess.Copy()
+	if options.AssumeRoleARN != "" {
+		sess = assumeRole(sess, options.AssumeRoleARN, runID)
+	}
+	stats.countAPICalls(sess)
+	if options.Record != "" {
+		if err := recordResponses(sess, options.Record); err != nil {
+			return err
+		}
+	}
+	if options.StatsdAddr != "" {
+		statsd, err := newStatsdClient(options)
+		if err != nil {
+			return err
+		}
+		defer statsd.close()
+		defer statsd.emitRun(stats)
+		statsd.watch(sess)
+	}
+	// the report, notification and history record are written after the run's deadline, and also
+	// when the breaker or budget stopped the run, so their session has neither
+	stats.session = sess.Copy()
+	if options.DryRun {
+		guardDryRun(stats.session)
+	}
+	breaker = &circuitBreaker{}
+	breaker.watch(sess, options.MaxConsecutiveErrors)
+	budget = &runBudget{}
+	describes = newDescribeCache()
+	budget.watch(sess, options.MaxAPICalls, options.MaxMutations)
+	if options.DryRun {
+		guardDryRun(sess)
+	}
+	_, cancel := applyTimeouts(ctx, sess, options)
+	defer cancel()
+	stats.startPhase("describe")
+	if err := checkCredentialExpiry(sess, options); err != nil {
+		return err
+	}
 	asgClient := autoscaling.New(sess)
 	albClient := elbv2.New(sess)
+	health = health.forRun(albClient)
 
 	log.Printf("[DEBUG] describing ASG %s...", options.ASG)
 	asgResponse, err := asgClient.DescribeAutoScalingGroups(&autoscaling.DescribeAutoScalingGroupsInput{
@@ -89,83 +452,204 @@ func doUpdate(options *Options) error {
 		return errors.New("invalid describe Auto Scaling Group response")
 	}
 	if len(asgResponse.AutoScalingGroups) != 1 {
-		return errors.Errorf("auto scaling group \"%s\" not found", options.ASG)
+		return notFoundError("auto scaling group \"%s\" not found", options.ASG)
 	}
 
 	asg := asgResponse.AutoScalingGroups[0]
-	var ltName *string
-	if asg.LaunchTemplate != nil {
-		ltName = asg.LaunchTemplate.LaunchTemplateName
-	} else if asg.MixedInstancesPolicy != nil && asg.MixedInstancesPolicy.LaunchTemplate != nil {
-		ltName = asg.MixedInstancesPolicy.LaunchTemplate.LaunchTemplateSpecification.LaunchTemplateName
+	stats.protectedBefore = asgProtection(asg)
+	conflicts := flaps.observe(asgLabel(options), stats.protectedBefore)
+	defer func() {
+		flaps.record(asgLabel(options), stats.unprotectedInstances())
+	}()
+	if skip, err := checkEmptyASG(asg, options); err != nil || skip {
+		return err
+	}
+	checkProtectionDefault(asg)
+	if err := checkManagedASG(asg, options); err != nil {
+		return err
+	}
+	scaleDownDisabled, ok, err := checkClusterAutoscaler(asg, options)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	frozen, reason, err := checkFreeze(sess, asg, options)
+	if err != nil {
+		return err
+	}
+	if frozen && !options.DryRun {
+		log.Printf("[INFO] change freeze declared by %s, running in check-only mode", reason)
+		guardDryRun(sess)
+		checkOnly := *options
+		checkOnly.DryRun = true
+		options = &checkOnly
 	}
-	if ltName == nil {
+
+	lt := asgLaunchTemplate(asg)
+	if lt == nil {
 		return errors.Errorf("auto scaling group \"%s\" does not use Launch Templates", options.ASG)
 	}
 
-	log.Printf("[DEBUG] ASG %s uses Launch Template %s, describing LT...", options.ASG, *ltName)
+	log.Printf("[DEBUG] ASG %s uses Launch Template %s, describing LT...", options.ASG, lt)
 	ec2Client := ec2.New(sess)
-	ltResponse, err := ec2Client.DescribeLaunchTemplates(&ec2.DescribeLaunchTemplatesInput{
-		LaunchTemplateNames: []*string{
-			ltName,
-		},
-	})
+	latestVersion, err := resolveLatestVersion(ec2Client, asg, *lt, options)
 	if err != nil {
-		return errors.Wrap(err, "could not describe Launch Template "+*ltName)
+		return err
 	}
-	if ltResponse == nil || len(ltResponse.LaunchTemplates) != 1 {
-		return errors.New("invalid describe Launch Template response for " + *ltName)
+	if options.CheckLaunchability {
+		if err := checkLaunchability(ec2Client, asg, *lt, latestVersion); err != nil {
+			return err
+		}
 	}
-
-	lt := ltResponse.LaunchTemplates[0]
-	if lt.LatestVersionNumber == nil {
-		return errors.New("no latest version for Launch Template " + *ltName)
+	if options.CheckSpotCapacity {
+		if err := checkSpotCapacity(asgClient, asg); err != nil {
+			return err
+		}
+	}
+	weights := instanceWeights(asg)
+	templateReplaced, err := templateReplacedInstances(asgClient, asg, *lt)
+	if err != nil {
+		return err
+	}
+	excluded, err := excludedInstances(sess, options)
+	if err != nil {
+		return err
+	}
+	recycle, err := recycleReasons(ec2Client, ssm.New(sess), asg, *lt, latestVersion, options)
+	if err != nil {
+		return err
+	}
+	mustRecycle, acks, err := mustRecycleInstances(sess, options)
+	if err != nil {
+		return err
+	}
+	for instanceID, reason := range mustRecycle {
+		if _, ok := recycle[instanceID]; !ok {
+			recycle[instanceID] = reason
+		}
+	}
+	defer func() {
+		if len(acks) == 0 {
+			return
+		}
+		unprotected := stats.unprotectedInstances()
+		for _, ack := range acks {
+			if ackErr := ack(unprotected); ackErr != nil {
+				log.Printf("[ERROR] %v", ackErr)
+			}
+		}
+	}()
+	var notifier *instanceNotifier
+	if options.SNSTopicARN != "" {
+		notifier = &instanceNotifier{client: sns.New(sess), runID: runID, options: options}
 	}
-	latestVersion := *lt.LatestVersionNumber
 	log.Printf("[INFO] ASG %s has latest version %d, looking for old instances...", options.ASG, latestVersion)
-	instanceIdsToRemove := make([]*string, 0)
-	latestInstances := make([]string, 0)
-	invalidInstances := make([]string, 0)
-	oldInstances := make([]*string, 0)
+	stats.startPhase("classify")
+	classified, err := classifyInstances(asg, *lt, latestVersion, excluded, templateReplaced, recycle, options)
+	if err != nil {
+		return err
+	}
+	instanceIdsToRemove, latestInstances, invalidInstances, oldInstances := classified.toRemove, classified.latest, classified.invalid, classified.old
+	// instances another controller keeps protecting again are reported instead of fought over
+	instanceIdsToRemove = filterInstanceIds(instanceIdsToRemove, func(instanceID string) bool {
+		if !conflicts[instanceID] {
+			return true
+		}
+		log.Printf("[WARN] leaving instance %s protected, something else enabled its protection again %d or more times after it was removed", instanceID, flapThreshold)
+		stats.markState(instanceID, stateConflict)
+		return false
+	})
 	instancesToDeregister := make([]*string, 0)
 
+	// protected instances the stale rotation leaves alone, for the expiry and zombie checks
+	removing := make(map[string]bool, len(instanceIdsToRemove))
+	for _, instanceID := range instanceIdsToRemove {
+		removing[*instanceID] = true
+	}
+	otherProtected := make([]*string, 0)
 	for _, instance := range asg.Instances {
-		if instance.LaunchTemplate == nil || instance.LaunchTemplate.Version == nil {
-			return errors.New("missing Launch Template version for instance id " + *instance.InstanceId)
-		}
-		if *instance.LaunchTemplate.LaunchTemplateName != *ltName {
-			log.Printf(
-				"[WARN] instance %s has different Launch Template than ASG: %s:%s",
-				*instance.InstanceId,
-				*instance.LaunchTemplate.LaunchTemplateName,
-				*instance.LaunchTemplate.Version,
-			)
-			if *instance.ProtectedFromScaleIn == false {
-				log.Printf("[DEBUG] instance %s is already not protected from scale-in, skipping", *instance.InstanceId)
-				oldInstances = append(oldInstances, instance.InstanceId)
-			} else {
-				instanceIdsToRemove = append(instanceIdsToRemove, instance.InstanceId)
+		if aws.BoolValue(instance.ProtectedFromScaleIn) && !removing[*instance.InstanceId] && !excluded[*instance.InstanceId] {
+			otherProtected = append(otherProtected, instance.InstanceId)
+		}
+	}
+	if options.ProtectionMaxAge > 0 {
+		stats.startPhase("expire")
+		if err := expireProtection(asgClient, ec2Client, otherProtected, options); err != nil {
+			return err
+		}
+	}
+	leftovers, err := findLeftovers(ec2Client, asg, health)
+	if err != nil {
+		return err
+	}
+	if len(leftovers) > 0 {
+		log.Printf("[INFO] %d Standby or detached instances are still protected or registered, use the `cleanup` command to reconcile them", len(leftovers))
+	}
+	zombies, err := findZombies(ec2Client, asg, health, filterInstanceIds(otherProtected, func(instanceID string) bool {
+		state := stats.instanceState(instanceID)
+		return state == stateLatest || state == stateNewer
+	}), options)
+	if err != nil {
+		return err
+	}
+	if len(zombies) > 0 {
+		log.Printf("[WARN] %d protected instances are in none of the ASG's target groups: %v", len(zombies), aws.StringValueSlice(zombies))
+		if options.ReapZombies {
+			if err := reapZombies(asgClient, ec2Client, zombies, options); err != nil {
+				return err
 			}
-			continue
 		}
+	}
 
-		version, err := strconv.ParseInt(*instance.LaunchTemplate.Version, 10, 64)
+	plan := newRunPlan(runID, options, latestVersion)
+	var appliedPlan *runPlan
+	if options.ApplyPlan != "" {
+		appliedPlan, err = loadRunPlan(sess, options.ApplyPlan, options)
 		if err != nil {
-			return errors.Wrap(err, "invalid instance Launch Template Version")
+			return err
 		}
-
-		if version != latestVersion {
-			log.Printf("[DEBUG] instance %s has old version %d", *instance.InstanceId, version)
-			invalidInstances = append(invalidInstances, *instance.InstanceId)
-			if *instance.ProtectedFromScaleIn == false {
-				log.Printf("[DEBUG] old instance %s is already not protected from scale-in, skipping", *instance.InstanceId)
-				oldInstances = append(oldInstances, instance.InstanceId)
-			} else {
-				instanceIdsToRemove = append(instanceIdsToRemove, instance.InstanceId)
+		if err := verifyPlan(appliedPlan, currentRunState(runID, asg, latestVersion), options); err != nil {
+			return err
+		}
+		log.Printf("[INFO] applying plan %s from %s", appliedPlan.RunID, appliedPlan.Time.Format(time.RFC3339))
+	}
+	if options.SavePlan != "" || options.ComparePlan != "" {
+		var previousPlan *runPlan
+		if options.ComparePlan != "" {
+			previousPlan, err = loadRunPlan(sess, options.ComparePlan, options)
+			if err != nil {
+				return err
 			}
-		} else {
-			latestInstances = append(latestInstances, *instance.InstanceId)
 		}
+		defer func() {
+			plan.finish(asg)
+			if previousPlan != nil {
+				logPlanChanges(previousPlan, plan)
+			}
+			if options.SavePlan != "" {
+				if err := saveRunPlan(stats.session, options.SavePlan, plan, options); err != nil {
+					log.Printf("[ERROR] %v", err)
+				}
+			}
+		}()
+	}
+
+	if options.StateFile != "" {
+		previous, err := loadRunState(sess, options.StateFile, options)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			current := currentRunState(runID, asg, latestVersion)
+			if previous != nil {
+				logRunStateChanges(previous, current)
+			}
+			if err := saveRunState(stats.session, options.StateFile, current, options); err != nil {
+				log.Printf("[ERROR] %v", err)
+			}
+		}()
 	}
 
 	if options.PrintLatestInstances {
@@ -178,51 +662,124 @@ func doUpdate(options *Options) error {
 			fmt.Println(instance)
 		}
 	}
+	if options.LatestFile != "" {
+		if err := writeInstanceList(options.LatestFile, latestInstances); err != nil {
+			return err
+		}
+	}
+	if options.InvalidFile != "" {
+		if err := writeInstanceList(options.InvalidFile, invalidInstances); err != nil {
+			return err
+		}
+	}
+
+	if err := checkPendingLaunchHooks(asgClient, ec2Client, asg, options); err != nil {
+		return err
+	}
+	if err := reportUnhealthyLatest(ec2Client, asg, health, latestInstances, options); err != nil {
+		return err
+	}
+	tgSettings, err := describeTargetGroupSettings(albClient, asg.TargetGroupARNs, options)
+	if err != nil {
+		return err
+	}
+	conditions, err := healthConditions(sess, ec2Client, asg, health, tgSettings.slowStart, options)
+	if err != nil {
+		return err
+	}
+	latestInstances, err = filterHealthy(conditions, latestInstances)
+	if err != nil {
+		return err
+	}
+
+	if options.ProtectReplacements {
+		if err := protectReplacements(asgClient, ec2Client, asg, latestInstances, options); err != nil {
+			return err
+		}
+	}
 
+	stats.startPhase("drain")
+	protectedOldInstances := append([]*string{}, instanceIdsToRemove...)
+	instanceIdsToRemove = keepScaleDownDisabled(instanceIdsToRemove, scaleDownDisabled)
+	instanceIdsToRemove, err = checkMaxInstanceLifetime(ec2Client, asg, instanceIdsToRemove, options)
+	if err != nil {
+		return err
+	}
+	instanceIdsToRemove, err = limitByPercent(ec2Client, instanceIdsToRemove, options.RotatePercent)
+	if err != nil {
+		return err
+	}
+	// the caps pick the instances to drain, so those they leave out keep serving traffic
+	if options.RotateOrder != "" || options.MaxUnprotectSpot > 0 || options.MaxUnprotectOnDemand > 0 {
+		instanceIdsToRemove, err = orderByPurchaseOption(ec2Client, instanceIdsToRemove, weights, options)
+		if err != nil {
+			return err
+		}
+	}
 	instancesToDeregister = append(instancesToDeregister, oldInstances...)
 	instancesToDeregister = append(instancesToDeregister, instanceIdsToRemove...)
+	instancesToDeregister = appliedPlan.filterDeregister(instancesToDeregister)
 
-	if options.Deregister && len(latestInstances) > 0 && len(instancesToDeregister) > 0 {
-		// find target groups to remove instances from
-		for _, tg := range asg.TargetGroupARNs {
-			healthy, err := albClient.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{
-				TargetGroupArn: tg,
-			})
-			if err != nil {
-				return errors.Wrapf(err, "could not get target group instances for %s", *tg)
+	// per-instance DNS records are removed once every guard had its say, and only for the instances
+	// that stopped serving: drained from their target groups or unprotected
+	retired := make([]*string, 0)
+	if options.Route53Cleanup {
+		defer func() {
+			cleanupErr := keepGoing(options, cleanupRoute53Records(ec2Client, route53.New(sess), uniqueInstanceIds(retired), options))
+			if err == nil {
+				err = cleanupErr
 			}
+		}()
+	}
 
-			targets := make([]*elbv2.TargetDescription, 0)
-		TARGETS: // label to goto if target is found
-			for _, h := range healthy.TargetHealthDescriptions {
-				for _, old := range instancesToDeregister {
-					if *h.Target.Id == *old {
-						targets = append(targets, h.Target)
-						continue TARGETS
-					}
-				}
-			}
+	deregister := (options.Deregister || options.DeregisterOnly) && len(instancesToDeregister) > 0
+	if len(asg.LoadBalancerNames) > 0 && (options.Deregister || options.DeregisterOnly) {
+		log.Printf("[WARN] ASG %s has Classic Load Balancers %v attached, old instances are not drained from them", options.ASG, aws.StringValueSlice(asg.LoadBalancerNames))
+	}
+	if deregister && len(asg.TargetGroupARNs) == 0 {
+		log.Printf("[INFO] ASG %s has no target groups, no draining applicable", options.ASG)
+		deregister = false
+	}
+	if deregister && len(latestInstances) == 0 {
+		if options.DeregisterEvenIfNoLatest {
+			log.Printf("[WARN] No instances at latest Launch Template version %d found, `--deregister-even-if-no-latest` provided so %d old instances will still be removed from target groups", latestVersion, len(instancesToDeregister))
+			log.Printf("[WARN] target groups of ASG %s may be left with no targets from this ASG", options.ASG)
+		} else {
+			log.Printf("[WARN] No instances at latest Launch Template version %d found, not removing old instances from target groups (use `--deregister-even-if-no-latest` to override)", latestVersion)
+			deregister = false
+		}
+	}
+	if deregister {
+		instanceAZs := make(map[string]string, len(asg.Instances))
+		for _, instance := range asg.Instances {
+			instanceAZs[*instance.InstanceId] = aws.StringValue(instance.AvailabilityZone)
+		}
+		drain := newDrainer(albClient, ec2Client, health, options, instanceAZs, weights)
+		plan.Deregister = planInstanceIds(instancesToDeregister)
+		notifier.publish(phaseAboutToDrain, instancesToDeregister)
+		err = drain.deregisterFromTargetGroups(asg.TargetGroupARNs, instancesToDeregister)
+		if err = keepGoing(options, err); err != nil {
+			return err
+		}
+		drained := filterInstanceIds(instancesToDeregister, func(instanceID string) bool {
+			return !drain.isDeferred(instanceID)
+		})
+		notifier.publish(phaseDrained, drained)
+		retired = append(retired, drained...)
 
-			for partition := range gopart.Partition(len(targets), 50) {
-				targets := targets[partition.Low:partition.High]
-
-				if options.DryRun {
-					for _, target := range targets {
-						log.Printf("[DRYRUN] would remove instance %s from target group %s", strings.ReplaceAll(target.String(), "\n", ""), *tg)
-					}
-				} else {
-
-					_, err = albClient.DeregisterTargets(&elbv2.DeregisterTargetsInput{
-						TargetGroupArn: tg,
-						Targets:        targets,
-					})
-					if err != nil {
-						return errors.Wrapf(err, "could not deregister targets from %s", *tg)
-					}
-					log.Printf("[INFO] Removed %d instances from %s", len(targets), *tg)
-				}
+		// instances still serving traffic to hold an AZ's healthy floor must stay protected
+		instanceIdsToRemove = filterInstanceIds(instanceIdsToRemove, func(instanceID string) bool {
+			if drain.isDeferred(instanceID) {
+				log.Printf("[INFO] keeping scale in protection on deferred instance %s", instanceID)
+				return false
 			}
-		}
+			return true
+		})
+	}
+
+	if options.DeregisterOnly {
+		log.Printf("[INFO] `--deregister-only` flag provided, leaving scale in protection untouched for %d instances", len(instanceIdsToRemove))
+		return nil
 	}
 
 	if len(instanceIdsToRemove) == 0 {
@@ -240,6 +797,68 @@ func doUpdate(options *Options) error {
 		}
 	}
 
+	stats.startPhase("checks")
+	instanceIdsToRemove, err = checkNetworkAttachments(ec2Client, instanceIdsToRemove, options)
+	if err != nil {
+		return err
+	}
+	instanceIdsToRemove, err = checkDataVolumes(ec2Client, instanceIdsToRemove, options)
+	if err != nil {
+		return err
+	}
+	if options.CheckQuotas {
+		if err := checkQuotas(sess, ec2Client, instanceIdsToRemove); err != nil {
+			return err
+		}
+	}
+	if options.RequireSSMOnline {
+		instanceIdsToRemove, err = checkSSMOnline(ssm.New(sess), latestInstances, instanceIdsToRemove, weights)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(instanceIdsToRemove) == 0 {
+		log.Printf("[INFO] No old instances left to remove scale in protection from")
+		return nil
+	}
+
+	if options.DrainMetricName != "" {
+		instanceIdsToRemove, err = waitForConnectionDrain(cloudwatch.New(sess), instanceIdsToRemove, tgSettings.drainOptions(options))
+		if err != nil {
+			return err
+		}
+	}
+	if options.SessionDrain {
+		instanceIdsToRemove, err = waitForSessionDrain(ssm.New(sess), instanceIdsToRemove, options)
+		if err != nil {
+			return err
+		}
+	}
+
+	if options.SnapshotBeforeUnprotect {
+		err = snapshotInstances(ec2Client, instanceIdsToRemove, runID, options)
+		if err != nil {
+			return err
+		}
+	}
+
+	stats.startPhase("unprotect")
+	instanceIdsToRemove = appliedPlan.filterUnprotect(instanceIdsToRemove)
+	plan.Unprotect = planInstanceIds(instanceIdsToRemove)
+	plan.Estimate = estimateImpact(asg, weights, plan.Unprotect, options)
+	unprotecting := make(map[string]bool, len(instanceIdsToRemove))
+	for _, instanceID := range instanceIdsToRemove {
+		unprotecting[*instanceID] = true
+	}
+	skipped := make([]string, 0)
+	for _, instanceID := range protectedOldInstances {
+		if !unprotecting[*instanceID] {
+			skipped = append(skipped, *instanceID)
+		}
+	}
+	stats.markSkipped(skipped)
+
 	if options.DryRun {
 		log.Printf("[DRYRUN] Removing scale in protection for %d instances", len(instanceIdsToRemove))
 	} else {
@@ -247,28 +866,67 @@ func doUpdate(options *Options) error {
 	}
 
 	// partition into groups of at most 50
+	unprotected := make([]*string, 0, len(instanceIdsToRemove))
 	for partition := range gopart.Partition(len(instanceIdsToRemove), 50) {
 		instanceIds := instanceIdsToRemove[partition.Low:partition.High]
-		if options.DryRun {
-			for _, instance := range instanceIds {
-				log.Printf("[DRYRUN] would remove instance protection on instanceId %s", *instance)
-			}
-			continue
-		}
 
 		log.Printf("[DEBUG] calling SetInstanceProtection with %d instances", len(instanceIds))
-		_, err = asgClient.SetInstanceProtection(&autoscaling.SetInstanceProtectionInput{
+		req, _ := asgClient.SetInstanceProtectionRequest(&autoscaling.SetInstanceProtectionInput{
 			AutoScalingGroupName: aws.String(options.ASG),
 			InstanceIds:          instanceIds,
 			ProtectedFromScaleIn: aws.Bool(false),
 		})
-		if err != nil {
+		if err := mutate(req, options.DryRun); err != nil {
+			if keepGoing(options, errors.Wrapf(err, "could not remove protection from %v", aws.StringValueSlice(instanceIds))) == nil {
+				continue
+			}
+			stats.setRemaining(instanceIdsToRemove[partition.Low:])
+			if breaker.isOpen() && options.ReprotectOnAbort && len(unprotected) > 0 {
+				reprotectInstances(asgClient, ec2Client, options.ASG, unprotected)
+			}
+			if len(unprotected) > 0 {
+				return partialFailureError(err, len(instanceIdsToRemove)-len(unprotected), len(instanceIdsToRemove), "instances")
+			}
 			return errors.Wrap(err, "set instance protection failed")
 		}
+		notifier.publish(phaseUnprotected, instanceIds)
+		retired = append(retired, instanceIds...)
+		if err := untagProtectedAt(ec2Client, instanceIds, options.DryRun); err != nil {
+			log.Printf("[WARN] %v, `reconcile` without a state file would protect %v again", err, aws.StringValueSlice(instanceIds))
+		}
+		if options.DryRun {
+			stats.action("protection removed (dry-run)", len(instanceIds))
+			continue
+		}
+		unprotected = append(unprotected, instanceIds...)
+		stats.timelineStep(stepUnprotected, aws.StringValueSlice(instanceIds))
 
 		for _, instance := range instanceIds {
 			log.Printf("[DEBUG] instance protection removed for instance: %s", *instance)
 		}
+		stats.action("protection removed", len(instanceIds))
+	}
+	if len(unprotected) > 0 {
+		if options.VerifyProtection {
+			time.Sleep(options.VerifyDelay)
+		}
+		if err := recheckProtection(asgClient, options.ASG, unprotected); err != nil {
+			return err
+		}
+		if options.VerifyProtection {
+			if err := verifyProtection(asgClient, unprotected, options); err != nil {
+				return err
+			}
+		}
+	}
+	if options.WaitForTermination {
+		if options.DryRun {
+			log.Printf("[DRYRUN] would wait up to %s for %d instances to be terminated and replaced", options.TerminationTimeout, len(instanceIdsToRemove))
+		} else if len(unprotected) > 0 {
+			if err := waitForTermination(ctx, asgClient, asg, unprotected, options); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
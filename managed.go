@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// managedTagPrefixes maps ASG tag key prefixes to the controller that manages groups carrying them
+var managedTagPrefixes = []struct {
+	prefix     string
+	controller string
+}{
+	{"AmazonECSManaged", "an ECS capacity provider"},
+	{"eks:nodegroup-name", "an EKS managed node group"},
+	{"eks:cluster-name", "an EKS managed node group"},
+	{"k8s.io/cluster-autoscaler/", "Kubernetes Cluster Autoscaler"},
+	{"kubernetes.io/cluster/", "a Kubernetes cluster"},
+}
+
+// clusterAutoscalerControllers are the controllers of ASGs Cluster Autoscaler scales, which
+// carry both its tags and the cluster's
+var clusterAutoscalerControllers = map[string]bool{
+	"Kubernetes Cluster Autoscaler": true,
+	"a Kubernetes cluster":          true,
+}
+
+// filterControllers returns the controllers not in drop
+func filterControllers(controllers []string, drop map[string]bool) []string {
+	kept := make([]string, 0, len(controllers))
+	for _, controller := range controllers {
+		if !drop[controller] {
+			kept = append(kept, controller)
+		}
+	}
+	return kept
+}
+
+// managingControllers returns the controllers whose markers are present on the ASG's tags
+func managingControllers(asg *autoscaling.Group) []string {
+	controllers := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, tag := range asg.Tags {
+		key := aws.StringValue(tag.Key)
+		for _, managed := range managedTagPrefixes {
+			if strings.HasPrefix(key, managed.prefix) && !seen[managed.controller] {
+				seen[managed.controller] = true
+				controllers = append(controllers, managed.controller)
+			}
+		}
+	}
+	return controllers
+}
+
+// checkManagedASG refuses to act on ASGs managed by another controller, which would fight over
+// the same instances, unless options.IgnoreManagedASG is set. ASGs tagged for Cluster Autoscaler
+// are left to options.ClusterAutoscalerPolicy instead, which checkClusterAutoscaler applies either
+// way; other controllers on the same ASG, like an EKS managed node group, still need
+// options.IgnoreManagedASG.
+func checkManagedASG(asg *autoscaling.Group, options *Options) error {
+	controllers := managingControllers(asg)
+	if isClusterAutoscalerManaged(asg) {
+		controllers = filterControllers(controllers, clusterAutoscalerControllers)
+	}
+	if len(controllers) == 0 {
+		return nil
+	}
+	if options.IgnoreManagedASG {
+		log.Printf("[WARN] ASG %s is managed by %s, continuing since `--ignore-managed-asg` was provided", options.ASG, strings.Join(controllers, ", "))
+		return nil
+	}
+	return guardError("auto scaling group \"%s\" is managed by %s, use `--ignore-managed-asg` to act on it anyway", options.ASG, strings.Join(controllers, ", "))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// taggedASG returns an ASG carrying the tag keys
+func taggedASG(keys ...string) *autoscaling.Group {
+	tags := make([]*autoscaling.TagDescription, 0, len(keys))
+	for _, key := range keys {
+		tags = append(tags, &autoscaling.TagDescription{Key: aws.String(key), Value: aws.String("true")})
+	}
+	return &autoscaling.Group{AutoScalingGroupName: aws.String("web"), Tags: tags}
+}
+
+func TestCheckManagedASG(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		name        string
+		keys        []string
+		controllers []string
+		// refused is whether the ASG is refused without --ignore-managed-asg
+		refused bool
+	}{
+		{"unmanaged", []string{"Name", "team"}, nil, false},
+		{"ecs", []string{"AmazonECSManaged"}, []string{"an ECS capacity provider"}, true},
+		{"eks listed once", []string{"eks:cluster-name", "eks:nodegroup-name"}, []string{"an EKS managed node group"}, true},
+		// Cluster Autoscaler ASGs are left to --cluster-autoscaler-policy
+		{"cluster autoscaler", []string{"k8s.io/cluster-autoscaler/enabled", "k8s.io/cluster-autoscaler/prod", "kubernetes.io/cluster/prod"},
+			[]string{"Kubernetes Cluster Autoscaler", "a Kubernetes cluster"}, false},
+		{"cluster autoscaler on a node group", []string{"eks:nodegroup-name", "k8s.io/cluster-autoscaler/enabled", "kubernetes.io/cluster/prod"},
+			[]string{"an EKS managed node group", "Kubernetes Cluster Autoscaler", "a Kubernetes cluster"}, true},
+		// without Cluster Autoscaler tags the cluster tag alone still marks a managed ASG
+		{"kubernetes cluster", []string{"kubernetes.io/cluster/prod"}, []string{"a Kubernetes cluster"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			asg := taggedASG(test.keys...)
+			if controllers := managingControllers(asg); strings.Join(controllers, ",") != strings.Join(test.controllers, ",") {
+				t.Errorf("managingControllers() = %v, want %v", controllers, test.controllers)
+			}
+			err := checkManagedASG(asg, &Options{ASG: "web"})
+			if (err != nil) != test.refused {
+				t.Errorf("checkManagedASG() = %v, want refused %v", err, test.refused)
+			}
+			if err != nil && classifyError(err) != errorKindGuardTripped {
+				t.Errorf("refusal is a %s error, want %s", classifyError(err), errorKindGuardTripped)
+			}
+			if err := checkManagedASG(asg, &Options{ASG: "web", IgnoreManagedASG: true}); err != nil {
+				t.Errorf("checkManagedASG() with --ignore-managed-asg = %v", err)
+			}
+		})
+	}
+}
+
+func TestFilterControllers(t *testing.T) {
+	tests := []struct {
+		controllers []string
+		drop        map[string]bool
+		kept        []string
+	}{
+		{nil, clusterAutoscalerControllers, []string{}},
+		{[]string{"an ECS capacity provider"}, nil, []string{"an ECS capacity provider"}},
+		{[]string{"Kubernetes Cluster Autoscaler", "an EKS managed node group", "a Kubernetes cluster"}, clusterAutoscalerControllers, []string{"an EKS managed node group"}},
+	}
+	for _, test := range tests {
+		if kept := filterControllers(test.controllers, test.drop); strings.Join(kept, ",") != strings.Join(test.kept, ",") {
+			t.Errorf("filterControllers(%v) = %v, want %v", test.controllers, kept, test.kept)
+		}
+	}
+}
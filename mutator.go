@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/pkg/errors"
+)
+
+// mutate sends a state-changing AWS request, or with dryRun logs the exact call and its
+// parameters instead. Every mutation goes through here so --dry-run can't be forgotten.
+func mutate(req *request.Request, dryRun bool) error {
+	if !dryRun {
+		return req.Send()
+	}
+	params, err := json.Marshal(req.Params)
+	if err != nil {
+		params = []byte(err.Error())
+	}
+	log.Printf("[DRYRUN] would call %s %s %s", req.ClientInfo.ServiceName, req.Operation.Name, params)
+	return nil
+}
+
+// guardDryRun fails any mutating request made through the session, as a backstop for code
+// paths that call the AWS API directly instead of through mutate.
+func guardDryRun(sess *session.Session) {
+	sess.Handlers.Validate.PushBack(func(r *request.Request) {
+		if isMutation(r.Operation.Name) {
+			r.Error = errors.Errorf("refusing to call %s %s in dry-run", r.ClientInfo.ServiceName, r.Operation.Name)
+		}
+	})
+}
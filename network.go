@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+)
+
+// findNetworkAttachments returns, for each of the given instances holding an Elastic IP or a
+// secondary network interface that outlives the instance, a description of what it holds.
+func findNetworkAttachments(ec2Client *ec2.EC2, instanceIds []*string) (map[string][]string, error) {
+	attachments := make(map[string][]string)
+	if len(instanceIds) == 0 {
+		return attachments, nil
+	}
+
+	addresses, err := ec2Client.DescribeAddresses(&ec2.DescribeAddressesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("instance-id"),
+				Values: instanceIds,
+			},
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not describe Elastic IPs")
+	}
+	for _, address := range addresses.Addresses {
+		instanceID := aws.StringValue(address.InstanceId)
+		attachments[instanceID] = append(attachments[instanceID], "Elastic IP "+aws.StringValue(address.PublicIp))
+	}
+
+	instances, err := describeInstances(ec2Client, instanceIds)
+	if err != nil {
+		return nil, err
+	}
+	for instanceID, instance := range instances {
+		for _, eni := range instance.NetworkInterfaces {
+			if eni.Attachment == nil || aws.Int64Value(eni.Attachment.DeviceIndex) == 0 {
+				continue
+			}
+			if aws.BoolValue(eni.Attachment.DeleteOnTermination) {
+				continue
+			}
+			attachments[instanceID] = append(attachments[instanceID], "network interface "+aws.StringValue(eni.NetworkInterfaceId))
+		}
+	}
+	return attachments, nil
+}
+
+// checkNetworkAttachments warns about instances whose termination would orphan Elastic IPs or
+// secondary network interfaces, and drops them from instanceIds if options.SkipInstancesWithEIP is set.
+func checkNetworkAttachments(ec2Client *ec2.EC2, instanceIds []*string, options *Options) ([]*string, error) {
+	attachments, err := findNetworkAttachments(ec2Client, instanceIds)
+	if err != nil {
+		return nil, err
+	}
+	for _, instanceID := range instanceIds {
+		for _, attachment := range attachments[*instanceID] {
+			log.Printf("[WARN] instance %s holds %s which will be orphaned when it is terminated", *instanceID, attachment)
+		}
+	}
+	if !options.SkipInstancesWithEIP {
+		return instanceIds, nil
+	}
+	return filterInstanceIds(instanceIds, func(instanceID string) bool {
+		if len(attachments[instanceID]) > 0 {
+			log.Printf("[INFO] `--skip-instances-with-eip` flag provided, keeping scale in protection on instance %s", instanceID)
+			return false
+		}
+		return true
+	}), nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// Instance phases published to --sns-topic-arn
+const (
+	phaseAboutToDrain = "about-to-drain"
+	phaseDrained      = "drained"
+	phaseUnprotected  = "unprotected"
+)
+
+// instanceEvent is the message published for one instance reaching a phase
+type instanceEvent struct {
+	RunID      string    `json:"run_id"`
+	ASG        string    `json:"asg"`
+	InstanceID string    `json:"instance_id"`
+	Phase      string    `json:"phase"`
+	DryRun     bool      `json:"dry_run"`
+	Time       time.Time `json:"time"`
+}
+
+// instanceNotifier publishes a message per instance and phase to an SNS topic, so external
+// systems such as a CMDB or session-draining sidecars can react per host.
+type instanceNotifier struct {
+	client  *sns.SNS
+	runID   string
+	options *Options
+}
+
+// publish sends one message per instance. Failures are logged but don't stop the run.
+func (n *instanceNotifier) publish(phase string, instanceIds []*string) {
+	if n == nil {
+		return
+	}
+	for _, instanceID := range instanceIds {
+		message, err := json.Marshal(instanceEvent{
+			RunID:      n.runID,
+			ASG:        n.options.ASG,
+			InstanceID: *instanceID,
+			Phase:      phase,
+			DryRun:     n.options.DryRun,
+			Time:       time.Now().UTC(),
+		})
+		if err != nil {
+			log.Printf("[ERROR] could not encode %s message for instance %s: %v", phase, *instanceID, err)
+			continue
+		}
+		req, _ := n.client.PublishRequest(&sns.PublishInput{
+			TopicArn: aws.String(n.options.SNSTopicARN),
+			Message:  aws.String(string(message)),
+			MessageAttributes: map[string]*sns.MessageAttributeValue{
+				"phase": {DataType: aws.String("String"), StringValue: aws.String(phase)},
+				"asg":   {DataType: aws.String("String"), StringValue: aws.String(n.options.ASG)},
+			},
+		})
+		if err := mutate(req, n.options.DryRun); err != nil {
+			log.Printf("[ERROR] could not publish %s message for instance %s: %v", phase, *instanceID, err)
+			continue
+		}
+		if !n.options.DryRun {
+			stats.action("sns messages published", 1)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/pkg/errors"
+)
+
+// errCodeFixtureMissing is the error code of calls with no captured response in --offline-plan
+const errCodeFixtureMissing = "OfflineFixtureMissing"
+
+// fixtureName returns the file name of the captured response of the nth call of an operation.
+// The first call uses <service>.<Operation>.json, later ones <service>.<Operation>.<n>.json.
+func fixtureName(r *request.Request, n int) string {
+	if n <= 1 {
+		return fmt.Sprintf("%s.%s.json", r.ClientInfo.ServiceName, r.Operation.Name)
+	}
+	return fmt.Sprintf("%s.%s.%d.json", r.ClientInfo.ServiceName, r.Operation.Name, n)
+}
+
+// offlineSession returns a copy of sess that answers every call from the responses captured in
+// dir instead of sending it. A call without a captured response of its own reuses the first
+// response of its operation, and fails if there is none.
+func offlineSession(sess *session.Session, dir string) *session.Session {
+	region := aws.StringValue(sess.Config.Region)
+	if region == "" {
+		region = "us-east-1"
+	}
+	sess = sess.Copy(&aws.Config{
+		Region:      aws.String(region),
+		Credentials: credentials.NewStaticCredentials("offline", "offline", ""),
+	})
+
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	sess.Handlers.Send.Clear()
+	sess.Handlers.Send.PushBack(func(r *request.Request) {
+		// the service clients add their protocol's unmarshalers to each request, which would
+		// expect an HTTP response
+		r.Handlers.UnmarshalMeta.Clear()
+		r.Handlers.ValidateResponse.Clear()
+		r.Handlers.UnmarshalError.Clear()
+		r.Handlers.Unmarshal.Clear()
+
+		mu.Lock()
+		calls[fixtureName(r, 1)]++
+		n := calls[fixtureName(r, 1)]
+		mu.Unlock()
+
+		path := filepath.Join(dir, fixtureName(r, n))
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) && n > 1 {
+			path = filepath.Join(dir, fixtureName(r, 1))
+			data, err = ioutil.ReadFile(path)
+		}
+		if err != nil {
+			r.Error = awserr.New(errCodeFixtureMissing, "no captured response for "+r.ClientInfo.ServiceName+" "+r.Operation.Name, err)
+			r.Retryable = aws.Bool(false)
+			return
+		}
+		log.Printf("[SPAM] answering %s %s from %s", r.ClientInfo.ServiceName, r.Operation.Name, path)
+		if err := json.Unmarshal(data, r.Data); err != nil {
+			r.Error = awserr.New(request.ErrCodeSerialization, "could not parse "+path, err)
+			r.Retryable = aws.Bool(false)
+		}
+	})
+	return sess
+}
+
+var accountIDPattern = regexp.MustCompile(`\b[0-9]{12}\b`)
+
+// scrubSecrets blanks launch template user data, which often holds secrets, and the values of
+// SecureString parameters anywhere in a decoded response
+func scrubSecrets(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if _, ok := v["UserData"]; ok {
+			v["UserData"] = ""
+		}
+		if v["Type"] == "SecureString" {
+			if _, ok := v["Value"]; ok {
+				v["Value"] = ""
+			}
+		}
+		for _, value := range v {
+			scrubSecrets(value)
+		}
+	case []interface{}:
+		for _, value := range v {
+			scrubSecrets(value)
+		}
+	}
+}
+
+// sanitizeFixture returns a captured response as indented JSON without secrets and with account
+// ids replaced
+func sanitizeFixture(response interface{}) ([]byte, error) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+	scrubSecrets(decoded)
+	data, err = json.MarshalIndent(decoded, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return accountIDPattern.ReplaceAll(data, []byte("123456789012")), nil
+}
+
+// recordSkipped are the services whose responses carry credentials, keys or secrets
+var recordSkipped = map[string]bool{
+	"sts":            true,
+	"kms":            true,
+	"secretsmanager": true,
+}
+
+// recordResponses writes the response of every successful call made through sess into dir, in
+// the format --offline-plan reads. Credentials and keys are never recorded.
+func recordResponses(sess *session.Session, dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrapf(err, "could not create %s", dir)
+	}
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	sess.Handlers.Complete.PushBack(func(r *request.Request) {
+		if r.Error != nil || recordSkipped[r.ClientInfo.ServiceName] {
+			return
+		}
+		mu.Lock()
+		calls[fixtureName(r, 1)]++
+		n := calls[fixtureName(r, 1)]
+		mu.Unlock()
+
+		data, err := sanitizeFixture(r.Data)
+		if err != nil {
+			log.Printf("[WARN] could not record %s %s: %v", r.ClientInfo.ServiceName, r.Operation.Name, err)
+			return
+		}
+		path := filepath.Join(dir, fixtureName(r, n))
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			log.Printf("[WARN] could not record %s %s: %v", r.ClientInfo.ServiceName, r.Operation.Name, err)
+		}
+	})
+	return nil
+}
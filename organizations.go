@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/pkg/errors"
+)
+
+// orgAccount is an active account of the organization to sweep
+type orgAccount struct {
+	id        string
+	name      string
+	partition string
+}
+
+// roleARN returns the ARN of the named role in the account
+func (a orgAccount) roleARN(roleName string) string {
+	return fmt.Sprintf("arn:%s:iam::%s:role/%s", a.partition, a.id, roleName)
+}
+
+// listOrgAccounts returns the active accounts of the organization, filtered by the organizational
+// units given with --org-include-ou and --org-exclude-ou. Nested OUs count as part of their parents.
+func listOrgAccounts(client *organizations.Organizations, options *Options) ([]orgAccount, error) {
+	accounts := make([]orgAccount, 0)
+	err := client.ListAccountsPages(&organizations.ListAccountsInput{}, func(page *organizations.ListAccountsOutput, lastPage bool) bool {
+		for _, account := range page.Accounts {
+			if aws.StringValue(account.Status) != organizations.AccountStatusActive {
+				log.Printf("[DEBUG] skipping account %s with status %s", aws.StringValue(account.Id), aws.StringValue(account.Status))
+				continue
+			}
+			partition := "aws"
+			if parts := strings.SplitN(aws.StringValue(account.Arn), ":", 3); len(parts) == 3 {
+				partition = parts[1]
+			}
+			accounts = append(accounts, orgAccount{id: aws.StringValue(account.Id), name: aws.StringValue(account.Name), partition: partition})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list organization accounts")
+	}
+	if len(options.OrgIncludeOUs) == 0 && len(options.OrgExcludeOUs) == 0 {
+		return accounts, nil
+	}
+
+	parents := make(map[string]string)
+	ancestors := func(id string) ([]string, error) {
+		result := make([]string, 0)
+		for {
+			parent, ok := parents[id]
+			if !ok {
+				resp, err := client.ListParents(&organizations.ListParentsInput{ChildId: aws.String(id)})
+				if err != nil {
+					return nil, errors.Wrapf(err, "could not list parents of %s", id)
+				}
+				if len(resp.Parents) == 0 {
+					return result, nil
+				}
+				parent = aws.StringValue(resp.Parents[0].Id)
+				parents[id] = parent
+			}
+			result = append(result, parent)
+			if strings.HasPrefix(parent, "r-") {
+				return result, nil
+			}
+			id = parent
+		}
+	}
+	contains := func(ids []string, wanted []string) bool {
+		for _, id := range ids {
+			for _, w := range wanted {
+				if id == w {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	filtered := make([]orgAccount, 0, len(accounts))
+	for _, account := range accounts {
+		ous, err := ancestors(account.id)
+		if err != nil {
+			return nil, err
+		}
+		if len(options.OrgIncludeOUs) > 0 && !contains(ous, options.OrgIncludeOUs) {
+			log.Printf("[DEBUG] skipping account %s, not in an included OU", account.id)
+			continue
+		}
+		if contains(ous, options.OrgExcludeOUs) {
+			log.Printf("[DEBUG] skipping account %s, in an excluded OU", account.id)
+			continue
+		}
+		filtered = append(filtered, account)
+	}
+	return filtered, nil
+}
+
+// asgLabel names the ASG of a run in logs and messages, with its account in organization sweeps
+func asgLabel(options *Options) string {
+	if options.account == "" {
+		return options.ASG
+	}
+	return options.ASG + " in account " + options.account
+}
+
+// suffixPath appends a suffix, the account id or the ASG name, to the name of a file, before its
+// extension
+func suffixPath(path string, suffix string) string {
+	if path == "" {
+		return ""
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + suffix + ext
+}
+
+// runFiles are the files a run writes and reads, which runs of several accounts or ASGs must
+// not share
+func runFiles(options *Options) []*string {
+	return []*string{
+		&options.ReportFile,
+		&options.StateFile,
+		&options.SavePlan,
+		&options.ComparePlan,
+		&options.ApplyPlan,
+		&options.LatestFile,
+		&options.InvalidFile,
+	}
+}
+
+// accountRunOptions returns the options of the run in one account of an organization sweep. The
+// files runs write and read get the account id appended to their names, so that accounts don't
+// overwrite each other's.
+func accountRunOptions(options *Options, account orgAccount) *Options {
+	accountOptions := *options
+	accountOptions.AssumeRoleARN = account.roleARN(options.OrgRoleName)
+	accountOptions.account = account.id
+	for _, path := range runFiles(&accountOptions) {
+		*path = suffixPath(*path, account.id)
+	}
+	return &accountOptions
+}
+
+// runOrganization runs the update in every discovered account of the organization, assuming
+// --org-role-name in each. With --keep-going a failed account doesn't stop the sweep. hooks
+// report the run of each account.
+func runOrganization(ctx context.Context, sess *session.Session, options *Options, hooks *runHooks, health *targetHealthCache) error {
+	if options.AssumeRoleARN != "" {
+		sess = assumeRole(sess, options.AssumeRoleARN, newRunID())
+	}
+	if account, ok := orgChildAccount(); ok {
+		return runOrgChild(ctx, sess, options, account, hooks, health)
+	}
+	accounts, err := listOrgAccounts(organizations.New(sess), options)
+	if err != nil {
+		return err
+	}
+	concurrency := options.OrgConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	log.Printf("[INFO] sweeping %d accounts of the organization, %d at a time", len(accounts), concurrency)
+	if options.OrgWindow > 0 {
+		log.Printf("[INFO] spreading the accounts over %s", options.OrgWindow)
+	}
+
+	var mu sync.Mutex
+	var errs multiError
+	var failed error
+	apiCalls := make(map[string]int)
+	defer func() {
+		total := 0
+		for _, n := range apiCalls {
+			total += n
+		}
+		log.Printf("[INFO] ---- aws api calls of %d accounts: %d ----", len(accounts), total)
+		printAPICalls(apiCalls)
+	}()
+
+	start := time.Now()
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, account := range accounts {
+		if options.OrgWindow > 0 {
+			at := start.Add(options.OrgWindow * time.Duration(i) / time.Duration(len(accounts)))
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Until(at)):
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case slots <- struct{}{}:
+		}
+		mu.Lock()
+		stop := failed != nil
+		mu.Unlock()
+		if stop || ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(account orgAccount) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			result, err := sweepAccount(ctx, sess, options, account, hooks, health, concurrency > 1)
+
+			mu.Lock()
+			defer mu.Unlock()
+			for operation, n := range result.APICalls {
+				apiCalls[operation] += n
+			}
+			if err != nil {
+				err = errors.Wrapf(err, "account %s", account.id)
+				if !options.KeepGoing {
+					if failed == nil {
+						failed = err
+					}
+					return
+				}
+				log.Printf("[ERROR] %v, continuing with `--keep-going`", err)
+				errs = append(errs, err)
+			}
+		}(account)
+	}
+	wg.Wait()
+
+	if failed != nil {
+		return failed
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if len(errs) > 0 {
+		return partialFailureError(errs, len(errs), len(accounts), "accounts")
+	}
+	return nil
+}
+
+// sweepAccount runs the update in one account of the organization. Accounts swept in parallel
+// run in a child process each, since the state of a run is kept per process, so only accounts
+// swept one after the other share the target health cache.
+func sweepAccount(ctx context.Context, sess *session.Session, options *Options, account orgAccount, hooks *runHooks, health *targetHealthCache, parallel bool) (runResult, error) {
+	accountOptions := accountRunOptions(options, account)
+	if !parallel {
+		log.Printf("[INFO] ---- account %s (%s) ----", account.id, account.name)
+		err := doUpdate(ctx, sess, accountOptions, health)
+		result := currentRunResult()
+		hooks.finish(accountOptions, err, result)
+		return result, err
+	}
+	log.Printf("[INFO] ---- starting account %s (%s) ----", account.id, account.name)
+	result, err := runAccountProcess(ctx, account)
+	log.Printf("[INFO] ---- finished account %s (%s) ----", account.id, account.name)
+	hooks.observe(newSession(accountOptions), accountOptions, err, result)
+	return result, err
+}
+
+// Child processes of parallel organization sweeps are told their account with envOrgAccount, as
+// "<id>:<partition>:<name>", and write their runResult to the file named by envOrgResult
+const (
+	envOrgAccount = "RIP_ORG_ACCOUNT"
+	envOrgResult  = "RIP_ORG_RESULT"
+)
+
+// orgChildAccount returns the account this process sweeps as the child of a parallel
+// organization sweep, and false if it isn't one
+func orgChildAccount() (orgAccount, bool) {
+	parts := strings.SplitN(os.Getenv(envOrgAccount), ":", 3)
+	if len(parts) != 3 {
+		return orgAccount{}, false
+	}
+	return orgAccount{id: parts[0], partition: parts[1], name: parts[2]}, true
+}
+
+// runAccountProcess sweeps the account in a child process running this executable with the same
+// arguments. A canceled context asks the child to stop with SIGTERM rather than killing it halfway.
+func runAccountProcess(ctx context.Context, account orgAccount) (runResult, error) {
+	var result runResult
+	exe, err := os.Executable()
+	if err != nil {
+		return result, errors.Wrap(err, "could not find this executable")
+	}
+	resultFile, err := ioutil.TempFile("", "remove-instance-protection-"+account.id+"-*.json")
+	if err != nil {
+		return result, errors.Wrap(err, "could not create the result file of the account")
+	}
+	resultFile.Close()
+	defer os.Remove(resultFile.Name())
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(),
+		envOrgAccount+"="+account.id+":"+account.partition+":"+account.name,
+		envOrgResult+"="+resultFile.Name(),
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	ownProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return result, errors.Wrap(err, "could not start the sweep of the account")
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = cmd.Process.Signal(syscall.SIGTERM)
+		case <-done:
+		}
+	}()
+	waitErr := cmd.Wait()
+	close(done)
+
+	data, err := ioutil.ReadFile(resultFile.Name())
+	if err == nil && len(data) > 0 {
+		err = json.Unmarshal(data, &result)
+	}
+	if err != nil {
+		log.Printf("[WARN] could not read the result of account %s: %v", account.id, err)
+	}
+	if result.Error != "" {
+		return result, &runError{kind: result.ErrorKind, err: errors.New(result.Error)}
+	}
+	if waitErr != nil {
+		return result, errors.Wrap(waitErr, "sweep of the account failed")
+	}
+	return result, nil
+}
+
+// runOrgChild runs the update in the account given by the parent of a parallel organization
+// sweep, and hands the result to it
+func runOrgChild(ctx context.Context, sess *session.Session, options *Options, account orgAccount, hooks *runHooks, health *targetHealthCache) error {
+	accountOptions := accountRunOptions(options, account)
+	err := doUpdate(ctx, sess, accountOptions, health)
+	result := currentRunResult()
+	hooks.finish(accountOptions, err, result)
+	if err != nil {
+		result.ErrorKind, result.Error = classifyError(err), err.Error()
+	}
+	data, marshalErr := json.Marshal(result)
+	if marshalErr == nil {
+		marshalErr = ioutil.WriteFile(os.Getenv(envOrgResult), data, 0600)
+	}
+	if marshalErr != nil {
+		log.Printf("[ERROR] could not hand the result of account %s to the sweep: %v", account.id, marshalErr)
+	}
+	return err
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// writeInstanceList writes the instance ids to path, one per line
+func writeInstanceList(path string, instanceIds []string) error {
+	content := strings.Join(instanceIds, "\n")
+	if len(instanceIds) > 0 {
+		content += "\n"
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		return errors.Wrapf(err, "could not write instance list to %s", path)
+	}
+	return nil
+}
+
+// printInstanceStates writes every classified instance with its state, tab separated, to w
+func printInstanceStates(w io.Writer) {
+	for _, state := range stats.instanceStates() {
+		fmt.Fprintf(w, "%s\t%s\n", state[0], state[1])
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/pkg/errors"
+)
+
+// runPlan is what a run decided to change, saved with --save-plan so a later run can be
+// compared against it with --compare-plan
+type runPlan struct {
+	RunID         string                   `json:"run_id"`
+	ASG           string                   `json:"asg"`
+	Time          time.Time                `json:"time"`
+	DryRun        bool                     `json:"dry_run"`
+	LatestVersion int64                    `json:"latest_version"`
+	Instances     map[string]instanceState `json:"instances"`
+	Deregister    []string                 `json:"deregister"`
+	Unprotect     []string                 `json:"unprotect"`
+	Estimate      *impactEstimate          `json:"estimate,omitempty"`
+}
+
+// newRunPlan starts the plan of this run; the instance states are filled in by finish
+func newRunPlan(runID string, options *Options, latestVersion int64) *runPlan {
+	return &runPlan{
+		RunID:         runID,
+		ASG:           options.ASG,
+		Time:          time.Now().UTC(),
+		DryRun:        options.DryRun,
+		LatestVersion: latestVersion,
+		Deregister:    []string{},
+		Unprotect:     []string{},
+	}
+}
+
+// finish records the instance states of the run in the plan
+func (p *runPlan) finish(asg *autoscaling.Group) {
+	p.Instances = currentRunState(p.RunID, asg, p.LatestVersion).Instances
+	sort.Strings(p.Deregister)
+	sort.Strings(p.Unprotect)
+}
+
+func loadRunPlan(sess *session.Session, path string, options *Options) (*runPlan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read plan %s", path)
+	}
+	data, err = openFile(sess, options, data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read plan %s", path)
+	}
+	var plan runPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, errors.Wrapf(err, "could not parse plan %s", path)
+	}
+	return &plan, nil
+}
+
+func saveRunPlan(sess *session.Session, path string, plan *runPlan, options *Options) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not encode plan")
+	}
+	data, err = sealFile(sess, options, data)
+	if err != nil {
+		return errors.Wrapf(err, "could not write plan %s", path)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return errors.Wrapf(err, "could not write plan %s", path)
+	}
+	return nil
+}
+
+// stringSetDiff returns the strings only in a and only in b
+func stringSetDiff(a, b []string) (onlyA, onlyB []string) {
+	inA := make(map[string]bool, len(a))
+	for _, s := range a {
+		inA[s] = true
+	}
+	inB := make(map[string]bool, len(b))
+	for _, s := range b {
+		inB[s] = true
+		if !inA[s] {
+			onlyB = append(onlyB, s)
+		}
+	}
+	for _, s := range a {
+		if !inB[s] {
+			onlyA = append(onlyA, s)
+		}
+	}
+	sort.Strings(onlyA)
+	sort.Strings(onlyB)
+	return onlyA, onlyB
+}
+
+// logPlanChanges reports what moved between a stored plan and the current one
+func logPlanChanges(previous *runPlan, current *runPlan) {
+	var previousStale, currentStale []string
+	for instanceID, s := range previous.Instances {
+		if isStale(s.State) {
+			previousStale = append(previousStale, instanceID)
+		}
+	}
+	for instanceID, s := range current.Instances {
+		if isStale(s.State) {
+			currentStale = append(currentStale, instanceID)
+		}
+	}
+	resolved, newlyStale := stringSetDiff(previousStale, currentStale)
+	droppedUnprotect, addedUnprotect := stringSetDiff(previous.Unprotect, current.Unprotect)
+	droppedDeregister, addedDeregister := stringSetDiff(previous.Deregister, current.Deregister)
+
+	log.Printf("[INFO] changes since plan %s at %s (latest version %d -> %d):", previous.RunID, previous.Time.Format(time.RFC3339), previous.LatestVersion, current.LatestVersion)
+	for _, change := range []struct {
+		name      string
+		instances []string
+	}{
+		{"newly stale", newlyStale},
+		{"resolved", resolved},
+		{"added to unprotect", addedUnprotect},
+		{"dropped from unprotect", droppedUnprotect},
+		{"added to deregister", addedDeregister},
+		{"dropped from deregister", droppedDeregister},
+	} {
+		log.Printf("[INFO]   %-24s %d %v", change.name, len(change.instances), change.instances)
+	}
+}
+
+// planInstanceIds converts instance ids for the plan
+func planInstanceIds(instanceIds []*string) []string {
+	return aws.StringValueSlice(instanceIds)
+}
+
+// verifyPlan checks that a saved plan still describes the ASG: it is younger than
+// --plan-max-age, and the latest version, instances and their protection haven't changed since.
+// A stale plan is refused unless --force-apply is set.
+func verifyPlan(applied *runPlan, current *runState, options *Options) error {
+	problems := make([]string, 0)
+	if applied.ASG != options.ASG {
+		problems = append(problems, "plan is for ASG "+applied.ASG)
+	}
+	if options.PlanMaxAge > 0 && time.Since(applied.Time) > options.PlanMaxAge {
+		problems = append(problems, "plan is "+time.Since(applied.Time).Round(time.Second).String()+" old")
+	}
+	if applied.LatestVersion != current.LatestVersion {
+		problems = append(problems, "latest version changed from "+strconv.FormatInt(applied.LatestVersion, 10)+" to "+strconv.FormatInt(current.LatestVersion, 10))
+	}
+	for instanceID, planned := range applied.Instances {
+		now, ok := current.Instances[instanceID]
+		if !ok {
+			problems = append(problems, "instance "+instanceID+" is gone")
+			continue
+		}
+		if now.Protected != planned.Protected {
+			problems = append(problems, "protection of instance "+instanceID+" changed")
+		}
+	}
+	for instanceID := range current.Instances {
+		if _, ok := applied.Instances[instanceID]; !ok {
+			problems = append(problems, "instance "+instanceID+" is new")
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	if options.ForceApply {
+		log.Printf("[WARN] plan %s no longer matches the ASG, applying anyway with `--force-apply`: %s", applied.RunID, strings.Join(problems, "; "))
+		return nil
+	}
+	return guardError("plan %s no longer matches the ASG, use `--force-apply` to apply it anyway: %s", applied.RunID, strings.Join(problems, "; "))
+}
+
+// filterDeregister returns the instances the plan deregisters, or all of them without a plan
+func (p *runPlan) filterDeregister(instanceIds []*string) []*string {
+	if p == nil {
+		return instanceIds
+	}
+	return p.filter(p.Deregister, "deregister", instanceIds)
+}
+
+// filterUnprotect returns the instances the plan unprotects, or all of them without a plan
+func (p *runPlan) filterUnprotect(instanceIds []*string) []*string {
+	if p == nil {
+		return instanceIds
+	}
+	return p.filter(p.Unprotect, "unprotect", instanceIds)
+}
+
+func (p *runPlan) filter(list []string, action string, instanceIds []*string) []*string {
+	planned := make(map[string]bool, len(list))
+	for _, instanceID := range list {
+		planned[instanceID] = true
+	}
+	return filterInstanceIds(instanceIds, func(instanceID string) bool {
+		if !planned[instanceID] {
+			log.Printf("[INFO] plan %s doesn't %s instance %s, leaving it alone", p.RunID, action, instanceID)
+			return false
+		}
+		return true
+	})
+}
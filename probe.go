@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// probeURL expands the placeholders of a --health-url-template for an instance
+func probeURL(template string, instance *ec2.Instance) string {
+	return strings.NewReplacer(
+		"{instance-id}", aws.StringValue(instance.InstanceId),
+		"{private-ip}", aws.StringValue(instance.PrivateIpAddress),
+		"{public-ip}", aws.StringValue(instance.PublicIpAddress),
+		"{private-dns}", aws.StringValue(instance.PrivateDnsName),
+	).Replace(template)
+}
+
+// probeInstances returns the instances that answer options.HealthURLTemplate with a 2xx status.
+// Instances that fail the probe are not counted as healthy replacement capacity.
+func probeInstances(ec2Client *ec2.EC2, instanceIds []string, options *Options) ([]string, error) {
+	instances, err := describeInstances(ec2Client, aws.StringSlice(instanceIds))
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: options.HealthURLTimeout}
+	healthy := make([]string, 0, len(instanceIds))
+	for _, instanceID := range instanceIds {
+		instance, ok := instances[instanceID]
+		if !ok {
+			log.Printf("[WARN] latest instance %s not found, not counting it as healthy", instanceID)
+			continue
+		}
+		url := probeURL(options.HealthURLTemplate, instance)
+		resp, err := client.Get(url)
+		if err != nil {
+			log.Printf("[WARN] latest instance %s failed health probe %s: %v", instanceID, url, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			log.Printf("[WARN] latest instance %s failed health probe %s: status %d", instanceID, url, resp.StatusCode)
+			continue
+		}
+		log.Printf("[DEBUG] latest instance %s passed health probe %s", instanceID, url)
+		healthy = append(healthy, instanceID)
+	}
+	return healthy, nil
+}
@@ -0,0 +1,14 @@
+// +build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// ownProcessGroup starts the command in a process group of its own, so a SIGINT sent to the
+// terminal's process group reaches only this process, which forwards it once
+func ownProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
@@ -0,0 +1,6 @@
+package main
+
+import "os/exec"
+
+// ownProcessGroup is a no-op on Windows, which has no process groups to signal
+func ownProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/meirf/gopart"
+	"github.com/pkg/errors"
+)
+
+// protectionChange is the scale in protection of one instance before and after a run
+type protectionChange struct {
+	InstanceID string `json:"instance_id"`
+	Before     bool   `json:"before"`
+	After      bool   `json:"after"`
+	// Unprotected is set when this run successfully removed the instance's protection
+	Unprotected bool `json:"unprotected"`
+	// Mismatch is set when the instance is still protected despite a successful API call,
+	// e.g. because of eventual consistency or a racing controller
+	Mismatch bool `json:"mismatch"`
+}
+
+// asgProtection returns the scale in protection of every instance of the ASG
+func asgProtection(asg *autoscaling.Group) map[string]bool {
+	protection := make(map[string]bool, len(asg.Instances))
+	for _, instance := range asg.Instances {
+		protection[*instance.InstanceId] = aws.BoolValue(instance.ProtectedFromScaleIn)
+	}
+	return protection
+}
+
+// checkProtectionDefault reports the ASG's NewInstancesProtectedFromScaleIn setting. Without it
+// scale in can pick any instance and this tool has nothing to do; with it, the replacements come
+// up protected and become stale-protected themselves after the next Launch Template change.
+func checkProtectionDefault(asg *autoscaling.Group) {
+	protected := aws.BoolValue(asg.NewInstancesProtectedFromScaleIn)
+	stats.mu.Lock()
+	stats.newInstancesProtected = &protected
+	stats.mu.Unlock()
+	if !protected {
+		log.Printf("[WARN] ASG %s doesn't protect new instances from scale in, so old instances are only protected if something else protects them", aws.StringValue(asg.AutoScalingGroupName))
+		return
+	}
+	log.Printf("[INFO] ASG %s protects new instances from scale in, replacements will need their protection removed after the next Launch Template change", aws.StringValue(asg.AutoScalingGroupName))
+}
+
+// protectReplacements enables scale in protection on healthy latest instances that don't have it,
+// for ASGs that don't protect new instances by default, and tags them with protectedAtTag
+func protectReplacements(asgClient *autoscaling.AutoScaling, ec2Client *ec2.EC2, asg *autoscaling.Group, latestInstances []string, options *Options) error {
+	protection := asgProtection(asg)
+	unprotected := make([]*string, 0)
+	for _, instanceID := range latestInstances {
+		if !protection[instanceID] {
+			unprotected = append(unprotected, aws.String(instanceID))
+		}
+	}
+	if len(unprotected) == 0 {
+		return nil
+	}
+
+	log.Printf("[INFO] protecting %d replacement instances from scale in", len(unprotected))
+	for partition := range gopart.Partition(len(unprotected), 50) {
+		batch := unprotected[partition.Low:partition.High]
+		req, _ := asgClient.SetInstanceProtectionRequest(&autoscaling.SetInstanceProtectionInput{
+			AutoScalingGroupName: aws.String(options.ASG),
+			InstanceIds:          batch,
+			ProtectedFromScaleIn: aws.Bool(true),
+		})
+		if err := mutate(req, options.DryRun); err != nil {
+			return errors.Wrap(err, "could not protect replacement instances")
+		}
+		if err := tagProtectedAt(ec2Client, batch, options.DryRun); err != nil {
+			return err
+		}
+		if options.DryRun {
+			stats.action("replacements protected (dry-run)", len(batch))
+		} else {
+			stats.action("replacements protected", len(batch))
+		}
+	}
+	return nil
+}
+
+// describeProtection re-describes the ASG and returns the current protection of its instances
+func describeProtection(asgClient *autoscaling.AutoScaling, asgName string) (map[string]bool, error) {
+	resp, err := asgClient.DescribeAutoScalingGroups(&autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []*string{aws.String(asgName)},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not describe Auto Scaling Group")
+	}
+	if len(resp.AutoScalingGroups) != 1 {
+		return nil, notFoundError("auto scaling group \"%s\" not found", asgName)
+	}
+	return asgProtection(resp.AutoScalingGroups[0]), nil
+}
+
+// recheckAttempts and recheckDelay bound how long recheckProtection waits, doubling the delay
+// after each attempt, for DescribeAutoScalingGroups to catch up with SetInstanceProtection
+const (
+	recheckAttempts = 3
+	recheckDelay    = time.Second
+)
+
+// recheckProtection records the protection of the ASG's instances after this run unprotected
+// some of them, and warns about those still protected. Protection removed a moment ago can still
+// be reported by the eventually consistent describe, so it is re-described with backoff first.
+func recheckProtection(asgClient *autoscaling.AutoScaling, asgName string, unprotected []*string) error {
+	delay := recheckDelay
+	for attempt := 1; ; attempt++ {
+		after, err := describeProtection(asgClient, asgName)
+		if err != nil {
+			return err
+		}
+		stats.mu.Lock()
+		stats.protectedAfter = after
+		stats.unprotected = aws.StringValueSlice(unprotected)
+		stats.mu.Unlock()
+
+		remaining := stragglers(unprotected)
+		if len(remaining) == 0 || attempt == recheckAttempts {
+			break
+		}
+		log.Printf("[DEBUG] %d instances still reported as protected, re-describing in %s", len(remaining), delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	for _, change := range stats.protectionChanges() {
+		if change.Mismatch {
+			log.Printf("[WARN] instance %s is still protected from scale in after removing its protection", change.InstanceID)
+		}
+	}
+	return nil
+}
+
+// stragglers returns the instances this run unprotected that are still protected
+func stragglers(unprotected []*string) []*string {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	return filterInstanceIds(unprotected, func(instanceID string) bool {
+		return stats.protectedAfter[instanceID]
+	})
+}
+
+// verifyProtection retries removing the protection of instances that are still protected after
+// a successful SetInstanceProtection, e.g. because a racing process re-enabled it, and reports
+// those still protected after options.VerifyRetries attempts as failures.
+func verifyProtection(asgClient *autoscaling.AutoScaling, unprotected []*string, options *Options) error {
+	for attempt := 1; attempt <= options.VerifyRetries; attempt++ {
+		remaining := stragglers(unprotected)
+		if len(remaining) == 0 {
+			return nil
+		}
+		log.Printf("[WARN] retrying protection removal for %d instances (attempt %d of %d)", len(remaining), attempt, options.VerifyRetries)
+		for partition := range gopart.Partition(len(remaining), 50) {
+			req, _ := asgClient.SetInstanceProtectionRequest(&autoscaling.SetInstanceProtectionInput{
+				AutoScalingGroupName: aws.String(options.ASG),
+				InstanceIds:          remaining[partition.Low:partition.High],
+				ProtectedFromScaleIn: aws.Bool(false),
+			})
+			if err := mutate(req, options.DryRun); err != nil {
+				return errors.Wrap(err, "set instance protection failed")
+			}
+		}
+		time.Sleep(options.VerifyDelay)
+		if err := recheckProtection(asgClient, options.ASG, unprotected); err != nil {
+			return err
+		}
+	}
+
+	remaining := stragglers(unprotected)
+	if len(remaining) == 0 {
+		return nil
+	}
+	return partialFailureError(
+		errors.Errorf("instances still protected after %d retries: %v", options.VerifyRetries, aws.StringValueSlice(remaining)),
+		len(remaining), len(unprotected), "instances",
+	)
+}
+
+// protectionChanges diffs the protection of every instance before and after the run. Without
+// a recheck, the protection is assumed unchanged.
+func (s *runStats) protectionChanges() []protectionChange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unprotected := make(map[string]bool, len(s.unprotected))
+	for _, instanceID := range s.unprotected {
+		unprotected[instanceID] = true
+	}
+	changes := make([]protectionChange, 0, len(s.protectedBefore))
+	for instanceID, before := range s.protectedBefore {
+		after := before
+		if s.protectedAfter != nil {
+			after = s.protectedAfter[instanceID]
+		}
+		changes = append(changes, protectionChange{
+			InstanceID:  instanceID,
+			Before:      before,
+			After:       after,
+			Unprotected: unprotected[instanceID],
+			Mismatch:    unprotected[instanceID] && after,
+		})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].InstanceID < changes[j].InstanceID })
+	return changes
+}
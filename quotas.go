@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/servicequotas"
+	"github.com/meirf/gopart"
+	"github.com/pkg/errors"
+)
+
+// onDemandQuotaCodes maps instance families to the Service Quotas code of their On-Demand vCPU
+// limit. Families not listed aren't checked.
+var onDemandQuotaCodes = map[string]string{
+	"a": "L-1216C47A", "c": "L-1216C47A", "d": "L-1216C47A", "h": "L-1216C47A", "i": "L-1216C47A",
+	"m": "L-1216C47A", "r": "L-1216C47A", "t": "L-1216C47A", "z": "L-1216C47A",
+	"g": "L-DB2E81BA", "vt": "L-DB2E81BA",
+	"p":   "L-417A185B",
+	"x":   "L-7295265B",
+	"f":   "L-74FC7D96",
+	"inf": "L-1945791B",
+}
+
+// instanceFamily returns the leading letters of an instance type, e.g. "inf" for "inf1.xlarge"
+func instanceFamily(instanceType string) string {
+	end := strings.IndexFunc(instanceType, func(r rune) bool { return !unicode.IsLetter(r) })
+	if end < 0 {
+		return instanceType
+	}
+	return instanceType[:end]
+}
+
+// instanceVCPUs returns the default vCPUs of each instance type
+func instanceVCPUs(ec2Client *ec2.EC2, instanceTypes []string) (map[string]int64, error) {
+	vcpus := make(map[string]int64, len(instanceTypes))
+	for partition := range gopart.Partition(len(instanceTypes), 100) {
+		err := ec2Client.DescribeInstanceTypesPages(&ec2.DescribeInstanceTypesInput{
+			InstanceTypes: aws.StringSlice(instanceTypes[partition.Low:partition.High]),
+		}, func(page *ec2.DescribeInstanceTypesOutput, lastPage bool) bool {
+			for _, info := range page.InstanceTypes {
+				if info.VCpuInfo != nil {
+					vcpus[aws.StringValue(info.InstanceType)] = aws.Int64Value(info.VCpuInfo.DefaultVCpus)
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "could not describe instance types")
+		}
+	}
+	return vcpus, nil
+}
+
+// checkQuotas warns when launching a replacement for each of the instances to unprotect would
+// exceed the On-Demand vCPU quota of its instance family, given the vCPUs running in the region.
+// Replacements are assumed to be of the same type as the instances they replace.
+func checkQuotas(sess *session.Session, ec2Client *ec2.EC2, instanceIds []*string) error {
+	if len(instanceIds) == 0 {
+		return nil
+	}
+	replaced, err := describeInstances(ec2Client, instanceIds)
+	if err != nil {
+		return err
+	}
+
+	// vCPU counts by instance type of running On-Demand instances, and of the replacements
+	running := make(map[string]int64)
+	needed := make(map[string]int64)
+	err = ec2Client.DescribeInstancesPages(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{"pending", "running"})}},
+	}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.InstanceLifecycle == nil {
+					running[aws.StringValue(instance.InstanceType)]++
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not describe running instances")
+	}
+	for _, instance := range replaced {
+		if instance.InstanceLifecycle == nil {
+			needed[aws.StringValue(instance.InstanceType)]++
+		}
+	}
+
+	instanceTypes := make([]string, 0, len(running))
+	for instanceType := range running {
+		instanceTypes = append(instanceTypes, instanceType)
+	}
+	vcpus, err := instanceVCPUs(ec2Client, instanceTypes)
+	if err != nil {
+		return err
+	}
+	usage := make(map[string]int64)
+	for instanceType, n := range running {
+		if code, ok := onDemandQuotaCodes[instanceFamily(instanceType)]; ok {
+			usage[code] += n * vcpus[instanceType]
+		}
+	}
+	required := make(map[string]int64)
+	for instanceType, n := range needed {
+		if code, ok := onDemandQuotaCodes[instanceFamily(instanceType)]; ok {
+			required[code] += n * vcpus[instanceType]
+		}
+	}
+
+	quotasClient := servicequotas.New(sess)
+	for code, vcpusNeeded := range required {
+		resp, err := quotasClient.GetServiceQuota(&servicequotas.GetServiceQuotaInput{
+			ServiceCode: aws.String("ec2"),
+			QuotaCode:   aws.String(code),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "could not get EC2 quota %s", code)
+		}
+		quota := int64(aws.Float64Value(resp.Quota.Value))
+		name := aws.StringValue(resp.Quota.QuotaName)
+		log.Printf("[DEBUG] quota %q: %d of %d vCPUs in use, replacements need %d", name, usage[code], quota, vcpusNeeded)
+		if usage[code]+vcpusNeeded > quota {
+			log.Printf("[WARN] replacements need %d vCPUs of quota %q, but only %d of %d are free; replacements may fail to launch", vcpusNeeded, name, quota-usage[code], quota)
+		}
+	}
+	return nil
+}
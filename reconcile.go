@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/meirf/gopart"
+	"github.com/pkg/errors"
+)
+
+// ReconcileCommand contains the flag options of the reconcile command
+type ReconcileCommand struct {
+	IncludeStale bool `long:"include-stale" description:"also protect instances the last run recorded as stale, e.g. after an aborted run removed their protection before they could be drained"`
+}
+
+// instancesToReprotect returns the InService instances of the ASG that were protected when the
+// previous run recorded its state but aren't anymore. Instances recorded as stale were meant to
+// lose their protection and are only returned with includeStale.
+func instancesToReprotect(asg *autoscaling.Group, previous *runState, includeStale bool) []*string {
+	instanceIds := make([]*string, 0)
+	for _, instance := range asg.Instances {
+		recorded, ok := previous.Instances[*instance.InstanceId]
+		if !ok || !recorded.Protected || aws.BoolValue(instance.ProtectedFromScaleIn) {
+			continue
+		}
+		if aws.StringValue(instance.LifecycleState) != autoscaling.LifecycleStateInService {
+			log.Printf("[INFO] not protecting %s instance %s", aws.StringValue(instance.LifecycleState), *instance.InstanceId)
+			continue
+		}
+		if unprotectedOnPurpose(recorded.State) {
+			log.Printf("[INFO] not protecting instance %s recorded as %s, run %s removed its protection", *instance.InstanceId, recorded.State, previous.RunID)
+			continue
+		}
+		if isStale(recorded.State) && !includeStale {
+			log.Printf("[INFO] not protecting instance %s recorded as %s, use --include-stale to protect it", *instance.InstanceId, recorded.State)
+			continue
+		}
+		log.Printf("[WARN] instance %s recorded as %s and protected by run %s is no longer protected", *instance.InstanceId, recorded.State, previous.RunID)
+		instanceIds = append(instanceIds, instance.InstanceId)
+	}
+	sort.Slice(instanceIds, func(i, j int) bool { return *instanceIds[i] < *instanceIds[j] })
+	return instanceIds
+}
+
+// instancesToReprotectByTag returns the InService instances of the ASG that carry the
+// protected-at tag of an earlier protection but aren't protected anymore, for when no state
+// was recorded. Runs remove the tag along with the protection, so a tagged instance lost its
+// protection some other way. As with a recorded state, instances on an older Launch Template
+// version than latestVersion are taken as stale and only returned with includeStale.
+func instancesToReprotectByTag(asg *autoscaling.Group, instances map[string]*ec2.Instance, lt *launchTemplateRef, latestVersion int64, includeStale bool) []*string {
+	instanceIds := make([]*string, 0)
+	for _, asgInstance := range asg.Instances {
+		instance, ok := instances[*asgInstance.InstanceId]
+		if !ok || aws.BoolValue(asgInstance.ProtectedFromScaleIn) {
+			continue
+		}
+		protectedAt := ""
+		for _, tag := range instance.Tags {
+			if aws.StringValue(tag.Key) == protectedAtTag {
+				protectedAt = aws.StringValue(tag.Value)
+			}
+		}
+		if protectedAt == "" {
+			continue
+		}
+		if aws.StringValue(asgInstance.LifecycleState) != autoscaling.LifecycleStateInService {
+			log.Printf("[INFO] not protecting %s instance %s", aws.StringValue(asgInstance.LifecycleState), *asgInstance.InstanceId)
+			continue
+		}
+		if lt != nil && !includeStale {
+			version := int64(0)
+			spec := asgInstance.LaunchTemplate
+			if spec != nil && lt.matches(spec) {
+				version, _ = strconv.ParseInt(aws.StringValue(spec.Version), 10, 64)
+			}
+			if version < latestVersion {
+				log.Printf("[INFO] not protecting instance %s not on the latest Launch Template version, use --include-stale to protect it", *asgInstance.InstanceId)
+				continue
+			}
+		}
+		log.Printf("[WARN] instance %s protected at %s is no longer protected", *asgInstance.InstanceId, protectedAt)
+		instanceIds = append(instanceIds, asgInstance.InstanceId)
+	}
+	sort.Slice(instanceIds, func(i, j int) bool { return *instanceIds[i] < *instanceIds[j] })
+	return instanceIds
+}
+
+// doReconcile protects the instances of the ASG again that lost their scale in protection since
+// the last run recorded to --state-file, e.g. because a run was killed between removing
+// protection and draining, or because protection was removed by hand. Without a recorded state
+// the protected-at tags of the instances are used instead.
+func doReconcile(ctx context.Context, reconcile *ReconcileCommand, options *Options) error {
+	runID := newRunID()
+	sess := newAWSSession(options)
+	if options.AssumeRoleARN != "" {
+		sess = assumeRole(sess, options.AssumeRoleARN, runID)
+	}
+	if options.DryRun {
+		guardDryRun(sess)
+	}
+	_, cancel := applyTimeouts(ctx, sess, options)
+	defer cancel()
+
+	var previous *runState
+	if options.StateFile != "" {
+		var err error
+		previous, err = loadRunState(sess, options.StateFile, options)
+		if err != nil {
+			return err
+		}
+		if previous == nil {
+			log.Printf("[WARN] state file %s not found, using the %s tags", options.StateFile, protectedAtTag)
+		} else if previous.ASG != options.ASG {
+			return errors.Errorf("state file %s records Auto Scaling Group %q, not %q", options.StateFile, previous.ASG, options.ASG)
+		}
+	}
+
+	asgClient := autoscaling.New(sess)
+	resp, err := asgClient.DescribeAutoScalingGroups(&autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []*string{aws.String(options.ASG)},
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not describe Auto Scaling Group")
+	}
+	if len(resp.AutoScalingGroups) != 1 {
+		return notFoundError("auto scaling group \"%s\" not found", options.ASG)
+	}
+	asg := resp.AutoScalingGroups[0]
+
+	ec2Client := ec2.New(sess)
+	var instanceIds []*string
+	if previous != nil {
+		log.Printf("[INFO] comparing protection with run %s at %s", previous.RunID, previous.Time.Format(time.RFC3339))
+		instanceIds = instancesToReprotect(asg, previous, reconcile.IncludeStale)
+	} else {
+		instanceIds, err = reprotectByTag(ec2Client, asg, reconcile.IncludeStale, options)
+		if err != nil {
+			return err
+		}
+	}
+	if len(instanceIds) == 0 {
+		log.Printf("[INFO] no instances lost their protection")
+		return nil
+	}
+
+	for partition := range gopart.Partition(len(instanceIds), 50) {
+		batch := instanceIds[partition.Low:partition.High]
+		req, _ := asgClient.SetInstanceProtectionRequest(&autoscaling.SetInstanceProtectionInput{
+			AutoScalingGroupName: aws.String(options.ASG),
+			InstanceIds:          batch,
+			ProtectedFromScaleIn: aws.Bool(true),
+		})
+		if err := mutate(req, options.DryRun); err != nil {
+			return errors.Wrap(err, "could not protect instances again")
+		}
+		if err := tagProtectedAt(ec2Client, batch, options.DryRun); err != nil {
+			return err
+		}
+		log.Printf("[INFO] protected %d instances again: %v", len(batch), aws.StringValueSlice(batch))
+	}
+	return nil
+}
+
+// reprotectByTag describes the ASG's instances and returns those to protect again by their
+// protected-at tags
+func reprotectByTag(ec2Client *ec2.EC2, asg *autoscaling.Group, includeStale bool, options *Options) ([]*string, error) {
+	instanceIds := make([]*string, 0, len(asg.Instances))
+	for _, instance := range asg.Instances {
+		instanceIds = append(instanceIds, instance.InstanceId)
+	}
+	instances, err := describeInstances(ec2Client, instanceIds)
+	if err != nil {
+		return nil, err
+	}
+	lt := asgLaunchTemplate(asg)
+	latestVersion := int64(0)
+	if lt != nil {
+		latestVersion, err = resolveLatestVersion(ec2Client, asg, *lt, options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return instancesToReprotectByTag(asg, instances, lt, latestVersion, includeStale), nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// reconcileInstance is an instance of the ASG reconciled, on Launch Template "web"
+type reconcileInstance struct {
+	id        string
+	lifecycle string
+	protected bool
+	version   string
+	// recorded is the state recorded for it, "" if none, and recordedProtected its protection
+	recorded          string
+	recordedProtected bool
+	// protectedAt is its protected-at tag, "" if it has none
+	protectedAt string
+}
+
+// reconcileFixture returns the ASG, the recorded state and the described instances of instances
+func reconcileFixture(instances []reconcileInstance) (*autoscaling.Group, *runState, map[string]*ec2.Instance) {
+	asg := &autoscaling.Group{AutoScalingGroupName: aws.String("web")}
+	previous := &runState{RunID: "run-1", Instances: make(map[string]instanceState)}
+	described := make(map[string]*ec2.Instance)
+	for _, instance := range instances {
+		asg.Instances = append(asg.Instances, &autoscaling.Instance{
+			InstanceId:           aws.String(instance.id),
+			LifecycleState:       aws.String(instance.lifecycle),
+			ProtectedFromScaleIn: aws.Bool(instance.protected),
+			LaunchTemplate: &autoscaling.LaunchTemplateSpecification{
+				LaunchTemplateName: aws.String("web"),
+				Version:            aws.String(instance.version),
+			},
+		})
+		if instance.recorded != "" {
+			previous.Instances[instance.id] = instanceState{State: instance.recorded, Protected: instance.recordedProtected}
+		}
+		tags := []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String("web")}}
+		if instance.protectedAt != "" {
+			tags = append(tags, &ec2.Tag{Key: aws.String(protectedAtTag), Value: aws.String(instance.protectedAt)})
+		}
+		described[instance.id] = &ec2.Instance{InstanceId: aws.String(instance.id), Tags: tags}
+	}
+	return asg, previous, described
+}
+
+func TestInstancesToReprotect(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	inService := autoscaling.LifecycleStateInService
+	asg, previous, _ := reconcileFixture([]reconcileInstance{
+		{id: "i-5", lifecycle: inService, version: "3", recorded: stateLatest, recordedProtected: true},
+		{id: "i-1", lifecycle: inService, version: "3", recorded: stateLatest, recordedProtected: true},
+		// still protected
+		{id: "i-2", lifecycle: inService, protected: true, version: "3", recorded: stateLatest, recordedProtected: true},
+		// wasn't protected when recorded
+		{id: "i-3", lifecycle: inService, version: "3", recorded: stateLatest},
+		// not recorded at all
+		{id: "i-4", lifecycle: inService, version: "3"},
+		{id: "i-6", lifecycle: autoscaling.LifecycleStateTerminatingWait, version: "3", recorded: stateLatest, recordedProtected: true},
+		{id: "i-7", lifecycle: inService, version: "2", recorded: stateStaleProtected, recordedProtected: true},
+		{id: "i-8", lifecycle: inService, version: "2", recorded: stateSkipped, recordedProtected: true},
+		// unprotected on purpose by --protection-max-age and --reap-zombies
+		{id: "i-9", lifecycle: inService, version: "3", recorded: stateExpired, recordedProtected: true},
+		{id: "i-10", lifecycle: inService, version: "3", recorded: stateReaped, recordedProtected: true},
+	})
+
+	tests := []struct {
+		includeStale bool
+		want         []string
+	}{
+		{false, []string{"i-1", "i-5"}},
+		{true, []string{"i-1", "i-5", "i-7", "i-8"}},
+	}
+	for _, test := range tests {
+		got := aws.StringValueSlice(instancesToReprotect(asg, previous, test.includeStale))
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("instancesToReprotect(includeStale %v) = %v, want %v", test.includeStale, got, test.want)
+		}
+	}
+}
+
+func TestInstancesToReprotectByTag(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	inService := autoscaling.LifecycleStateInService
+	protectedAt := "2020-08-01T00:00:00Z"
+	asg, _, described := reconcileFixture([]reconcileInstance{
+		{id: "i-1", lifecycle: inService, version: "3", protectedAt: protectedAt},
+		// still protected
+		{id: "i-2", lifecycle: inService, protected: true, version: "3", protectedAt: protectedAt},
+		// never protected by a run
+		{id: "i-3", lifecycle: inService, version: "3"},
+		{id: "i-4", lifecycle: autoscaling.LifecycleStatePending, version: "3", protectedAt: protectedAt},
+		{id: "i-5", lifecycle: inService, version: "2", protectedAt: protectedAt},
+		{id: "i-6", lifecycle: inService, version: "$Latest", protectedAt: protectedAt},
+	})
+	// not described
+	asg.Instances = append(asg.Instances, &autoscaling.Instance{
+		InstanceId:     aws.String("i-7"),
+		LifecycleState: aws.String(inService),
+	})
+
+	lt := &launchTemplateRef{Name: "web"}
+	tests := []struct {
+		name         string
+		lt           *launchTemplateRef
+		includeStale bool
+		want         []string
+	}{
+		{"latest only", lt, false, []string{"i-1"}},
+		{"include stale", lt, true, []string{"i-1", "i-5", "i-6"}},
+		// without a Launch Template versions can't be compared, and no instance counts as stale
+		{"no launch template", nil, false, []string{"i-1", "i-5", "i-6"}},
+	}
+	for _, test := range tests {
+		got := aws.StringValueSlice(instancesToReprotectByTag(asg, described, test.lt, 3, test.includeStale))
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: instancesToReprotectByTag() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/meirf/gopart"
+	"github.com/pkg/errors"
+)
+
+// days is a duration flag that also accepts a number of days, like "30d"
+type days time.Duration
+
+// UnmarshalFlag implements flags.Unmarshaler
+func (d *days) UnmarshalFlag(value string) error {
+	if strings.HasSuffix(value, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return errors.Errorf("invalid number of days %q", value)
+		}
+		*d = days(time.Duration(n) * 24 * time.Hour)
+		return nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = days(duration)
+	return nil
+}
+
+// isAMINotFound reports whether DescribeImages failed because an AMI doesn't exist (anymore)
+func isAMINotFound(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && (aerr.Code() == "InvalidAMIID.NotFound" || aerr.Code() == "InvalidAMIID.Unavailable")
+}
+
+// describeImages returns the AMIs among imageIds that still exist, keyed by AMI id. Deregistered
+// AMIs are missing from the result. If a batch fails because one of its AMIs is gone, its AMIs
+// are described one at a time.
+func describeImages(ec2Client *ec2.EC2, imageIds []*string) (map[string]*ec2.Image, error) {
+	images, missing := describes.cachedImages(imageIds)
+	describe := func(imageIds []*string) error {
+		resp, err := ec2Client.DescribeImages(&ec2.DescribeImagesInput{ImageIds: imageIds})
+		if err != nil {
+			return err
+		}
+		describes.addImages(resp.Images)
+		for _, image := range resp.Images {
+			images[*image.ImageId] = image
+		}
+		return nil
+	}
+	for partition := range gopart.Partition(len(missing), describeBatchSize) {
+		batch := missing[partition.Low:partition.High]
+		err := describe(batch)
+		if err != nil && isAMINotFound(err) {
+			for _, imageID := range batch {
+				if err = describe([]*string{imageID}); err != nil && !isAMINotFound(err) {
+					break
+				}
+				err = nil
+			}
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "could not describe AMIs")
+		}
+	}
+	return images, nil
+}
+
+// instanceImages describes the instances and the distinct AMIs they run
+func instanceImages(ec2Client *ec2.EC2, instanceIds []*string) (map[string]*ec2.Instance, map[string]*ec2.Image, error) {
+	instances, err := describeInstances(ec2Client, instanceIds)
+	if err != nil {
+		return nil, nil, err
+	}
+	imageIds := make([]*string, 0)
+	seen := make(map[string]bool)
+	for _, instance := range instances {
+		if imageID := aws.StringValue(instance.ImageId); imageID != "" && !seen[imageID] {
+			seen[imageID] = true
+			imageIds = append(imageIds, instance.ImageId)
+		}
+	}
+	images, err := describeImages(ec2Client, imageIds)
+	if err != nil {
+		return nil, nil, err
+	}
+	return instances, images, nil
+}
+
+// deregisteredAMIInstances returns the instances running an AMI that has been deregistered, with
+// the reason to recycle them. Such instances can't be relaunched or inspected from their AMI.
+func deregisteredAMIInstances(ec2Client *ec2.EC2, instanceIds []*string) (map[string]string, error) {
+	instances, images, err := instanceImages(ec2Client, instanceIds)
+	if err != nil {
+		return nil, err
+	}
+	reasons := make(map[string]string)
+	for instanceID, instance := range instances {
+		imageID := aws.StringValue(instance.ImageId)
+		if _, ok := images[imageID]; imageID != "" && !ok {
+			reasons[instanceID] = "ami-deregistered: " + imageID + " no longer exists"
+		}
+	}
+	return reasons, nil
+}
+
+// oldAMIInstances returns the instances running an AMI created longer ago than maxAge, with the
+// reason to recycle them. Instances running latestImageID, the AMI of the latest Launch Template
+// version, are left alone since their replacements would boot the same AMI.
+func oldAMIInstances(ec2Client *ec2.EC2, instanceIds []*string, maxAge time.Duration, latestImageID string) (map[string]string, error) {
+	instances, images, err := instanceImages(ec2Client, instanceIds)
+	if err != nil {
+		return nil, err
+	}
+	created := make(map[string]time.Time, len(images))
+	for _, image := range images {
+		t, err := time.Parse(time.RFC3339, aws.StringValue(image.CreationDate))
+		if err != nil {
+			log.Printf("[WARN] AMI %s has invalid creation date %q", aws.StringValue(image.ImageId), aws.StringValue(image.CreationDate))
+			continue
+		}
+		created[aws.StringValue(image.ImageId)] = t
+	}
+
+	reasons := make(map[string]string)
+	latestTooOld := 0
+	for instanceID, instance := range instances {
+		imageCreated, ok := created[aws.StringValue(instance.ImageId)]
+		if !ok {
+			continue
+		}
+		if age := time.Since(imageCreated); age > maxAge {
+			if aws.StringValue(instance.ImageId) == latestImageID {
+				latestTooOld++
+				continue
+			}
+			reasons[instanceID] = "ami-age: " + aws.StringValue(instance.ImageId) + " is " + strconv.Itoa(int(age.Hours()/24)) + " days old"
+		}
+	}
+	if latestTooOld > 0 {
+		log.Printf("[WARN] the latest Launch Template version uses AMI %s, older than `--max-ami-age`, not recycling the %d instances running it", latestImageID, latestTooOld)
+	}
+	return reasons, nil
+}
+
+// patchNonCompliantInstances returns the instances SSM Patch Manager reports as missing or having
+// failed patches, with the reason to recycle them
+func patchNonCompliantInstances(ssmClient *ssm.SSM, instanceIds []*string) (map[string]string, error) {
+	reasons := make(map[string]string)
+	for partition := range gopart.Partition(len(instanceIds), 50) {
+		err := ssmClient.DescribeInstancePatchStatesPages(&ssm.DescribeInstancePatchStatesInput{
+			InstanceIds: instanceIds[partition.Low:partition.High],
+		}, func(page *ssm.DescribeInstancePatchStatesOutput, lastPage bool) bool {
+			for _, state := range page.InstancePatchStates {
+				missing, failed := aws.Int64Value(state.MissingCount), aws.Int64Value(state.FailedCount)
+				if missing > 0 || failed > 0 {
+					reasons[aws.StringValue(state.InstanceId)] = "patch-compliance: " + strconv.FormatInt(missing, 10) + " missing, " + strconv.FormatInt(failed, 10) + " failed patches"
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "could not describe instance patch states")
+		}
+	}
+	return reasons, nil
+}
+
+// recycleReasons returns the instances to recycle regardless of their Launch Template version,
+// with the reason for each
+func recycleReasons(ec2Client *ec2.EC2, ssmClient *ssm.SSM, asg *autoscaling.Group, lt launchTemplateRef, latestVersion int64, options *Options) (map[string]string, error) {
+	reasons := make(map[string]string)
+	instanceIds := make([]*string, 0, len(asg.Instances))
+	for _, instance := range asg.Instances {
+		instanceIds = append(instanceIds, instance.InstanceId)
+	}
+	if len(instanceIds) == 0 {
+		return reasons, nil
+	}
+
+	if options.MaxAMIAge > 0 {
+		data, err := launchTemplateData(ec2Client, lt, latestVersion)
+		if err != nil {
+			return nil, err
+		}
+		old, err := oldAMIInstances(ec2Client, instanceIds, time.Duration(options.MaxAMIAge), aws.StringValue(data.ImageId))
+		if err != nil {
+			return nil, err
+		}
+		for instanceID, reason := range old {
+			reasons[instanceID] = reason
+		}
+	}
+	// only reporting them costs describing every instance and AMI, so that is done only when a
+	// report or history record will carry them
+	if options.DeregisteredAMIPolicy == "recycle" || options.ReportFile != "" || options.HistoryTable != "" {
+		deregistered, err := deregisteredAMIInstances(ec2Client, instanceIds)
+		if err != nil {
+			return nil, err
+		}
+		stats.setDeregisteredAMIs(deregistered)
+		for instanceID, reason := range deregistered {
+			if options.DeregisteredAMIPolicy != "recycle" {
+				log.Printf("[WARN] instance %s runs a deregistered AMI (%s)", instanceID, reason)
+				continue
+			}
+			reasons[instanceID] = reason
+		}
+	}
+	if options.RequirePatchCompliance {
+		nonCompliant, err := patchNonCompliantInstances(ssmClient, instanceIds)
+		if err != nil {
+			return nil, err
+		}
+		for instanceID, reason := range nonCompliant {
+			reasons[instanceID] = reason
+		}
+	}
+	return reasons, nil
+}
+
+// recycleAck acknowledges the queue messages whose instances were handled, given the instances the
+// run removed protection from
+type recycleAck func(unprotected map[string]bool) error
+
+// receiveRecycleQueue drains the SQS queue of instance ids to recycle. The returned function
+// deletes the messages whose instances were all unprotected, so messages for other ASGs or for
+// instances the run skipped are received again by a later run. A dry run leaves the messages
+// visible to other consumers.
+func receiveRecycleQueue(sqsClient *sqs.SQS, queueURL string, dryRun bool) ([]string, recycleAck, error) {
+	visibility := int64(time.Hour / time.Second)
+	if dryRun {
+		visibility = 0
+	}
+	instanceIds := make([]string, 0)
+	messageInstances := make(map[string][]string)
+	receipts := make(map[string]*string)
+	for {
+		resp, err := sqsClient.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(queueURL),
+			MaxNumberOfMessages: aws.Int64(10),
+			VisibilityTimeout:   aws.Int64(visibility),
+		})
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "could not receive messages from %s", queueURL)
+		}
+		// without a visibility timeout the same messages come back, so stop once nothing is new
+		received := 0
+		for _, message := range resp.Messages {
+			messageID := aws.StringValue(message.MessageId)
+			if _, ok := receipts[messageID]; ok {
+				continue
+			}
+			received++
+			messageInstances[messageID] = parseInstanceList(aws.StringValue(message.Body))
+			receipts[messageID] = message.ReceiptHandle
+			instanceIds = append(instanceIds, messageInstances[messageID]...)
+		}
+		if received == 0 {
+			break
+		}
+	}
+
+	ack := func(unprotected map[string]bool) error {
+		entries := make([]*sqs.DeleteMessageBatchRequestEntry, 0)
+		for messageID, ids := range messageInstances {
+			handled := true
+			for _, instanceID := range ids {
+				handled = handled && unprotected[instanceID]
+			}
+			if !handled {
+				continue
+			}
+			entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(len(entries))),
+				ReceiptHandle: receipts[messageID],
+			})
+		}
+		if len(entries) > 0 {
+			log.Printf("[INFO] deleting %d of %d messages from %s", len(entries), len(messageInstances), queueURL)
+		}
+		for partition := range gopart.Partition(len(entries), 10) {
+			req, _ := sqsClient.DeleteMessageBatchRequest(&sqs.DeleteMessageBatchInput{
+				QueueUrl: aws.String(queueURL),
+				Entries:  entries[partition.Low:partition.High],
+			})
+			if err := mutate(req, dryRun); err != nil {
+				return errors.Wrapf(err, "could not delete messages from %s", queueURL)
+			}
+		}
+		return nil
+	}
+	return instanceIds, ack, nil
+}
+
+// mustRecycleInstances reads the instance ids produced by external tooling, e.g. vulnerability
+// scanners, from every --recycle-source. The returned functions acknowledge queue messages.
+func mustRecycleInstances(sess *session.Session, options *Options) (map[string]string, []recycleAck, error) {
+	reasons := make(map[string]string)
+	acks := make([]recycleAck, 0)
+	for _, source := range options.RecycleSources {
+		var instanceIds []string
+		var err error
+		if strings.HasPrefix(source, "sqs:") {
+			var ack recycleAck
+			instanceIds, ack, err = receiveRecycleQueue(sqs.New(sess), strings.TrimPrefix(source, "sqs:"), options.DryRun)
+			acks = append(acks, ack)
+		} else {
+			instanceIds, err = fetchInstanceList(sess, source)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("[DEBUG] %d instances to recycle from %s", len(instanceIds), source)
+		for _, instanceID := range instanceIds {
+			reasons[instanceID] = "must-recycle: " + source
+		}
+	}
+	return reasons, acks, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/pkg/errors"
+)
+
+// reportError describes why a run failed
+type reportError struct {
+	Kind     string `json:"kind"`
+	Message  string `json:"message"`
+	ExitCode int    `json:"exit_code"`
+	Failed   int    `json:"failed,omitempty"`
+	Total    int    `json:"total,omitempty"`
+}
+
+// runReport is written to --report-file at the end of each run
+type runReport struct {
+	RunID      string             `json:"run_id"`
+	ASG        string             `json:"asg"`
+	Account    string             `json:"account,omitempty"`
+	DryRun     bool               `json:"dry_run"`
+	Time       time.Time          `json:"time"`
+	Duration   string             `json:"duration"`
+	Status     string             `json:"status"`
+	Error      *reportError       `json:"error,omitempty"`
+	Instances  map[string]string  `json:"instances"`
+	Actions    map[string]int     `json:"actions"`
+	APICalls   int                `json:"api_calls"`
+	Failures   []string           `json:"failures,omitempty"`
+	Remaining  []string           `json:"remaining,omitempty"`
+	Protection []protectionChange `json:"protection"`
+	Targets    []targetOutcome    `json:"targets,omitempty"`
+	// Timeline is when each step of the rotation of old instances happened
+	Timeline map[string]*instanceTimeline `json:"timeline,omitempty"`
+	// APICallsByOperation counts the calls by "service:Operation", and APIRetries their retries
+	APICallsByOperation map[string]int `json:"api_calls_by_operation"`
+	APIRetries          int            `json:"api_retries"`
+	// NewInstancesProtected is the ASG's NewInstancesProtectedFromScaleIn setting
+	NewInstancesProtected *bool `json:"new_instances_protected,omitempty"`
+	// DeregisteredAMIs are the instances running an AMI that has been deregistered, with the reason
+	DeregisteredAMIs map[string]string `json:"deregistered_amis,omitempty"`
+}
+
+// newRunReport builds the report of the run recorded in stats
+func newRunReport(options *Options, runErr error) *runReport {
+	protection := stats.protectionChanges()
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	report := &runReport{
+		Protection:            protection,
+		RunID:                 stats.runID,
+		ASG:                   options.ASG,
+		Account:               options.account,
+		DryRun:                options.DryRun,
+		Time:                  stats.start.UTC(),
+		Duration:              time.Since(stats.start).Round(time.Millisecond).String(),
+		Status:                "ok",
+		Instances:             make(map[string]string, len(stats.states)),
+		Actions:               make(map[string]int, len(stats.actions)),
+		APICalls:              stats.apiCalls,
+		APICallsByOperation:   stats.apiCallsByOperation,
+		APIRetries:            stats.apiRetries,
+		Failures:              stats.failures,
+		Remaining:             stats.remaining,
+		Targets:               stats.targets,
+		Timeline:              stats.timelines,
+		NewInstancesProtected: stats.newInstancesProtected,
+		DeregisteredAMIs:      stats.deregisteredAMIs,
+	}
+	for instanceID, state := range stats.states {
+		report.Instances[instanceID] = state
+	}
+	for action, n := range stats.actions {
+		report.Actions[action] = n
+	}
+	if stats.empty != "" {
+		report.Status = "empty"
+	}
+	if runErr != nil {
+		report.Status = "error"
+		report.Error = &reportError{
+			Kind:     classifyError(runErr),
+			Message:  runErr.Error(),
+			ExitCode: exitCode(runErr),
+		}
+		var re *runError
+		if errors.As(runErr, &re) {
+			report.Error.Failed, report.Error.Total = re.failed, re.total
+		}
+	}
+	return report
+}
+
+// writeReport writes the JSON report of the last run to --report-file
+func writeReport(sess *session.Session, options *Options, runErr error) {
+	if options.ReportFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(newRunReport(options, runErr), "", "  ")
+	if err != nil {
+		log.Printf("[ERROR] could not encode report: %v", err)
+		return
+	}
+	data, err = sealFile(sess, options, data)
+	if err != nil {
+		log.Printf("[ERROR] could not encrypt report: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(options.ReportFile, data, 0644); err != nil {
+		log.Printf("[ERROR] could not write report file %s: %v", options.ReportFile, err)
+		return
+	}
+	if err := writeReportDigest(sess, options, data); err != nil {
+		log.Printf("[ERROR] %v", err)
+	}
+}
+
+// writeReportDigest writes the SHA-256 digest of the report next to it in sha256sum format, and
+// with --report-signing-key a KMS signature of the digest, so audit pipelines can verify a
+// report relayed through chat or webhooks
+func writeReportDigest(sess *session.Session, options *Options, data []byte) error {
+	digest := sha256.Sum256(data)
+	line := hex.EncodeToString(digest[:]) + "  " + filepath.Base(options.ReportFile) + "\n"
+	if err := ioutil.WriteFile(options.ReportFile+".sha256", []byte(line), 0644); err != nil {
+		return errors.Wrap(err, "could not write report digest")
+	}
+	if options.ReportSigningKey == "" {
+		return nil
+	}
+
+	resp, err := kms.New(sess).Sign(&kms.SignInput{
+		KeyId:            aws.String(options.ReportSigningKey),
+		Message:          digest[:],
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(options.ReportSigningAlgorithm),
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not sign report digest")
+	}
+	signature := base64.StdEncoding.EncodeToString(resp.Signature) + "\n"
+	if err := ioutil.WriteFile(options.ReportFile+".sig", []byte(signature), 0644); err != nil {
+		return errors.Wrap(err, "could not write report signature")
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const (
+	purchaseOptionSpot     = "spot"
+	purchaseOptionOnDemand = "on-demand"
+)
+
+// purchaseOption returns whether an instance is spot or on-demand capacity
+func purchaseOption(instance *ec2.Instance) string {
+	if aws.StringValue(instance.InstanceLifecycle) == ec2.InstanceLifecycleTypeSpot {
+		return purchaseOptionSpot
+	}
+	return purchaseOptionOnDemand
+}
+
+// orderByPurchaseOption orders the instances to unprotect by purchase option according to
+// options.RotateOrder and applies the per-class limits in capacity units. Instances beyond a
+// limit keep their protection until a later run.
+func orderByPurchaseOption(ec2Client *ec2.EC2, instanceIds []*string, weights capacityWeights, options *Options) ([]*string, error) {
+	instances, err := describeInstances(ec2Client, instanceIds)
+	if err != nil {
+		return nil, err
+	}
+	classes := make(map[string]string, len(instanceIds))
+	for _, instanceID := range instanceIds {
+		option := purchaseOptionOnDemand
+		if instance, ok := instances[*instanceID]; ok {
+			option = purchaseOption(instance)
+		}
+		classes[*instanceID] = option
+	}
+
+	ordered := append([]*string{}, instanceIds...)
+	if options.RotateOrder != "" {
+		first := purchaseOptionSpot
+		if options.RotateOrder == "on-demand-first" {
+			first = purchaseOptionOnDemand
+		}
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return classes[*ordered[i]] == first && classes[*ordered[j]] != first
+		})
+	}
+
+	limits := map[string]float64{
+		purchaseOptionSpot:     options.MaxUnprotectSpot,
+		purchaseOptionOnDemand: options.MaxUnprotectOnDemand,
+	}
+	released := make(map[string]float64)
+	return filterInstanceIds(ordered, func(instanceID string) bool {
+		option := classes[instanceID]
+		weight := weights.weight(instanceID)
+		if limit := limits[option]; limit > 0 && released[option]+weight > limit {
+			log.Printf("[INFO] keeping scale in protection on %s instance %s, limit of %v capacity units reached", option, instanceID, limit)
+			return false
+		}
+		released[option] += weight
+		return true
+	}), nil
+}
+
+// limitByPercent keeps the oldest percent of the instances by launch time, rounding up so every
+// run makes progress. The others keep their protection until a later run.
+func limitByPercent(ec2Client *ec2.EC2, instanceIds []*string, percent int) ([]*string, error) {
+	if percent <= 0 || percent >= 100 || len(instanceIds) == 0 {
+		return instanceIds, nil
+	}
+	instances, err := describeInstances(ec2Client, instanceIds)
+	if err != nil {
+		return nil, err
+	}
+	return oldestPercent(instanceIds, instances, percent), nil
+}
+
+// oldestPercent keeps the oldest percent of the described instances. Instances missing from
+// instances count as the oldest.
+func oldestPercent(instanceIds []*string, instances map[string]*ec2.Instance, percent int) []*string {
+	launched := func(instanceID string) time.Time {
+		if instance, ok := instances[instanceID]; ok && instance.LaunchTime != nil {
+			return *instance.LaunchTime
+		}
+		return time.Time{}
+	}
+
+	ordered := append([]*string{}, instanceIds...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return launched(*ordered[i]).Before(launched(*ordered[j]))
+	})
+	keep := (len(ordered)*percent + 99) / 100
+	for _, instanceID := range ordered[keep:] {
+		log.Printf("[INFO] keeping scale in protection on instance %s, `--rotate-percent %d` rotates the oldest %d of %d stale instances this run", *instanceID, percent, keep, len(ordered))
+	}
+	return ordered[:keep]
+}
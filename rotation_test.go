@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestOldestPercent(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// i-4 is the oldest, i-1 the newest, and i-0 wasn't described
+	start := time.Date(2020, 8, 1, 0, 0, 0, 0, time.UTC)
+	instances := map[string]*ec2.Instance{
+		"i-1": {LaunchTime: aws.Time(start.Add(4 * time.Hour))},
+		"i-2": {LaunchTime: aws.Time(start.Add(3 * time.Hour))},
+		"i-3": {LaunchTime: aws.Time(start.Add(2 * time.Hour))},
+		"i-4": {LaunchTime: aws.Time(start.Add(time.Hour))},
+	}
+	ids := aws.StringSlice([]string{"i-1", "i-2", "i-3", "i-4", "i-0"})
+
+	tests := []struct {
+		percent int
+		kept    []string
+	}{
+		{1, []string{"i-0"}},
+		{20, []string{"i-0"}},
+		// rounding up, so every run makes progress
+		{21, []string{"i-0", "i-4"}},
+		{50, []string{"i-0", "i-4", "i-3"}},
+		{99, []string{"i-0", "i-4", "i-3", "i-2", "i-1"}},
+	}
+	for _, test := range tests {
+		kept := aws.StringValueSlice(oldestPercent(ids, instances, test.percent))
+		if fmt.Sprint(kept) != fmt.Sprint(test.kept) {
+			t.Errorf("oldestPercent(%d) = %v, want %v", test.percent, kept, test.kept)
+		}
+	}
+	if got := aws.StringValueSlice(ids); fmt.Sprint(got) != "[i-1 i-2 i-3 i-4 i-0]" {
+		t.Errorf("the instances passed in were reordered: %v", got)
+	}
+}
+
+func TestLimitByPercentNoop(t *testing.T) {
+	ids := aws.StringSlice([]string{"i-1", "i-2"})
+	// 0 and 100 rotate all without describing the instances, so no client is needed
+	for _, percent := range []int{0, 100} {
+		kept, err := limitByPercent(nil, ids, percent)
+		if err != nil || len(kept) != 2 {
+			t.Errorf("limitByPercent(%d) = %v, %v, want all instances", percent, aws.StringValueSlice(kept), err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/pkg/errors"
+)
+
+// instanceDNSRecord is a per-instance DNS record named by an instance tag of the form
+// "<hosted-zone-id>/<record-name>"
+type instanceDNSRecord struct {
+	instanceID   string
+	hostedZoneID string
+	recordName   string
+	// values are the addresses and names that identify the record as belonging to the instance
+	values map[string]bool
+}
+
+// cleanupRoute53Records deletes the per-instance Route 53 records of the given instances.
+// Only records whose values point at the instance are deleted, so a record that was already
+// re-registered by a replacement is left alone.
+func cleanupRoute53Records(ec2Client *ec2.EC2, r53Client *route53.Route53, instanceIds []*string, options *Options) error {
+	if len(instanceIds) == 0 {
+		return nil
+	}
+
+	records := make([]instanceDNSRecord, 0)
+	err := ec2Client.DescribeInstancesPages(&ec2.DescribeInstancesInput{
+		InstanceIds: instanceIds,
+	}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				for _, tag := range instance.Tags {
+					if aws.StringValue(tag.Key) != options.Route53Tag {
+						continue
+					}
+					parts := strings.SplitN(aws.StringValue(tag.Value), "/", 2)
+					if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+						log.Printf("[WARN] instance %s has invalid %s tag %q, expected <hosted-zone-id>/<record-name>", *instance.InstanceId, options.Route53Tag, aws.StringValue(tag.Value))
+						continue
+					}
+					values := make(map[string]bool)
+					for _, value := range []*string{instance.PrivateIpAddress, instance.PublicIpAddress, instance.PrivateDnsName, instance.PublicDnsName} {
+						if aws.StringValue(value) != "" {
+							values[strings.TrimSuffix(*value, ".")] = true
+						}
+					}
+					records = append(records, instanceDNSRecord{
+						instanceID:   *instance.InstanceId,
+						hostedZoneID: parts[0],
+						recordName:   strings.TrimSuffix(parts[1], ".") + ".",
+						values:       values,
+					})
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not describe instances for Route 53 cleanup")
+	}
+
+	for _, record := range records {
+		if err := keepGoing(options, deleteInstanceDNSRecord(r53Client, record, options)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteInstanceDNSRecord(r53Client *route53.Route53, record instanceDNSRecord, options *Options) error {
+	resp, err := r53Client.ListResourceRecordSets(&route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(record.hostedZoneID),
+		StartRecordName: aws.String(record.recordName),
+		MaxItems:        aws.String("10"),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not list records %s in hosted zone %s", record.recordName, record.hostedZoneID)
+	}
+
+	changes := make([]*route53.Change, 0)
+	for _, rrs := range resp.ResourceRecordSets {
+		if !strings.EqualFold(aws.StringValue(rrs.Name), record.recordName) {
+			continue
+		}
+		if !recordPointsAt(rrs, record.values) {
+			log.Printf("[WARN] %s record %s no longer points at instance %s, leaving it in place", aws.StringValue(rrs.Type), record.recordName, record.instanceID)
+			continue
+		}
+		changes = append(changes, &route53.Change{
+			Action:            aws.String(route53.ChangeActionDelete),
+			ResourceRecordSet: rrs,
+		})
+	}
+	if len(changes) == 0 {
+		log.Printf("[DEBUG] no Route 53 records named %s found for instance %s", record.recordName, record.instanceID)
+		return nil
+	}
+
+	req, _ := r53Client.ChangeResourceRecordSetsRequest(&route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(record.hostedZoneID),
+		ChangeBatch: &route53.ChangeBatch{
+			Comment: aws.String("remove-instance-protection: cleanup for stale instance " + record.instanceID),
+			Changes: changes,
+		},
+	})
+	if err := mutate(req, options.DryRun); err != nil {
+		return errors.Wrapf(err, "could not delete Route 53 record %s for instance %s", record.recordName, record.instanceID)
+	}
+	if options.DryRun {
+		return nil
+	}
+	stats.action("route 53 records deleted", len(changes))
+	log.Printf("[INFO] Deleted %d Route 53 records named %s for instance %s", len(changes), record.recordName, record.instanceID)
+	return nil
+}
+
+// recordPointsAt reports whether every value of the record set belongs to the instance
+func recordPointsAt(rrs *route53.ResourceRecordSet, values map[string]bool) bool {
+	if len(rrs.ResourceRecords) == 0 {
+		// alias records don't point at instances directly
+		return false
+	}
+	for _, rr := range rrs.ResourceRecords {
+		if !values[strings.TrimSuffix(aws.StringValue(rr.Value), ".")] {
+			return false
+		}
+	}
+	return true
+}
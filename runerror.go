@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/pkg/errors"
+)
+
+// Kinds of run errors, reported in --report-file and mapped to exit codes by exitCode
+const (
+	errorKindError          = "Error"
+	errorKindNotFound       = "NotFound"
+	errorKindThrottled      = "Throttled"
+	errorKindPartialFailure = "PartialFailure"
+	errorKindGuardTripped   = "GuardTripped"
+	errorKindCircuitOpen    = "CircuitOpen"
+	errorKindEmpty          = "Empty"
+)
+
+// exitCodes maps error kinds to the exit code of the process
+var exitCodes = map[string]int{
+	errorKindError:          1,
+	errorKindCircuitOpen:    exitCircuitOpen,
+	errorKindNotFound:       4,
+	errorKindThrottled:      5,
+	errorKindPartialFailure: 6,
+	errorKindGuardTripped:   7,
+	errorKindEmpty:          8,
+}
+
+// runError is an error of a known kind, so callers can tell "ASG missing" from "3 of 120
+// instances failed"
+type runError struct {
+	kind string
+	err  error
+	// failed and total count the items affected by a partial failure
+	failed int
+	total  int
+}
+
+func (e *runError) Error() string {
+	return e.err.Error()
+}
+
+func (e *runError) Unwrap() error {
+	return e.err
+}
+
+// notFoundError reports a resource the run needs that doesn't exist
+func notFoundError(format string, args ...interface{}) error {
+	return &runError{kind: errorKindNotFound, err: errors.Errorf(format, args...)}
+}
+
+// guardError reports a safety check that refused to let the run continue
+func guardError(format string, args ...interface{}) error {
+	return &runError{kind: errorKindGuardTripped, err: errors.Errorf(format, args...)}
+}
+
+// partialFailureError reports that some of the items of a step failed after others succeeded
+func partialFailureError(err error, failed, total int, what string) error {
+	return &runError{
+		kind:   errorKindPartialFailure,
+		err:    errors.Wrap(err, fmt.Sprintf("%d of %d %s failed", failed, total, what)),
+		failed: failed,
+		total:  total,
+	}
+}
+
+// classifyError returns the kind of an error returned by a run. A tripped breaker or budget
+// decides the kind even when batches succeeded before it and the error reports a partial failure.
+func classifyError(err error) string {
+	if errors.Is(err, errCircuitOpen) || breaker.isOpen() {
+		return errorKindCircuitOpen
+	}
+	if budget.exceeded() {
+		return errorKindGuardTripped
+	}
+	var re *runError
+	if errors.As(err, &re) {
+		return re.kind
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		if request.IsErrorThrottle(aerr) {
+			return errorKindThrottled
+		}
+	}
+	return errorKindError
+}
+
+// exitCode returns the process exit code for an error returned by a run
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	return exitCodes[classifyError(err)]
+}
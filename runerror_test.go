@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/pkg/errors"
+)
+
+func TestClassifyError(t *testing.T) {
+	defer func() {
+		breaker = &circuitBreaker{}
+		budget = &runBudget{}
+	}()
+
+	partial := partialFailureError(errors.New("batch 2 failed"), 1, 3, "batches")
+	tests := []struct {
+		name     string
+		err      error
+		open     bool
+		tripped  bool
+		kind     string
+		exitCode int
+	}{
+		{"plain", errors.New("boom"), false, false, errorKindError, 1},
+		{"not found", notFoundError("ASG %s not found", "web"), false, false, errorKindNotFound, 4},
+		{"wrapped not found", errors.Wrap(notFoundError("ASG %s not found", "web"), "account 1"), false, false, errorKindNotFound, 4},
+		{"throttled", errors.Wrap(awserr.New("Throttling", "Rate exceeded", nil), "could not describe"), false, false, errorKindThrottled, 5},
+		{"other aws error", awserr.New("ValidationError", "bad request", nil), false, false, errorKindError, 1},
+		{"partial failure", partial, false, false, errorKindPartialFailure, 6},
+		{"guard", guardError("too many instances"), false, false, errorKindGuardTripped, 7},
+		{"circuit open", errors.Wrap(errCircuitOpen, "could not unprotect"), false, false, errorKindCircuitOpen, exitCircuitOpen},
+		// a tripped breaker or budget decides the kind of the partial failure it caused
+		{"partial failure with open breaker", partial, true, false, errorKindCircuitOpen, exitCircuitOpen},
+		{"partial failure over budget", partial, false, true, errorKindGuardTripped, 7},
+		{"breaker before budget", partial, true, true, errorKindCircuitOpen, exitCircuitOpen},
+		{"empty", &runError{kind: errorKindEmpty, err: errors.New("no instances")}, false, false, errorKindEmpty, 8},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			breaker = &circuitBreaker{open: test.open}
+			budget = &runBudget{tripped: test.tripped}
+			if kind := classifyError(test.err); kind != test.kind {
+				t.Errorf("classifyError() = %s, want %s", kind, test.kind)
+			}
+			if code := exitCode(test.err); code != test.exitCode {
+				t.Errorf("exitCode() = %d, want %d", code, test.exitCode)
+			}
+		})
+	}
+
+	if code := exitCode(nil); code != 0 {
+		t.Errorf("exitCode(nil) = %d, want 0", code)
+	}
+}
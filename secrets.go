@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/pkg/errors"
+)
+
+// resolveSecret returns the secret named by value under --secret-source. With the plain source
+// value is the secret itself.
+func resolveSecret(sess *session.Session, options *Options, value string) (string, error) {
+	switch options.SecretSource {
+	case "ssm":
+		resp, err := ssm.New(sess).GetParameter(&ssm.GetParameterInput{
+			Name:           aws.String(value),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return "", errors.Wrapf(err, "could not get SSM parameter %s", value)
+		}
+		return aws.StringValue(resp.Parameter.Value), nil
+	case "secretsmanager":
+		resp, err := secretsmanager.New(sess).GetSecretValue(&secretsmanager.GetSecretValueInput{
+			SecretId: aws.String(value),
+		})
+		if err != nil {
+			return "", errors.Wrapf(err, "could not get secret %s", value)
+		}
+		return aws.StringValue(resp.SecretString), nil
+	}
+	return value, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// releasesURL is the GitHub API endpoint describing the latest release
+const releasesURL = "https://api.github.com/repos/ryanschneider/remove-instance-protection/releases/latest"
+
+// binaryName is the name of the executable inside release archives
+const binaryName = "remove-instance-protection"
+
+// SelfUpdateCommand contains the flag options of the self-update command
+type SelfUpdateCommand struct {
+	CheckOnly bool `long:"check-only" description:"only report whether a newer release is available"`
+	Force     bool `long:"force" description:"install the latest release even if it isn't newer than this build"`
+}
+
+// githubRelease is the subset of the GitHub release API response used here
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+var httpClient = &http.Client{Timeout: 60 * time.Second}
+
+// latestRelease fetches the latest published release
+func latestRelease(client *http.Client) (*githubRelease, error) {
+	resp, err := client.Get(releasesURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not fetch latest release")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("could not fetch latest release: status %d", resp.StatusCode)
+	}
+	var release githubRelease
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return nil, errors.Wrap(err, "could not parse latest release")
+	}
+	return &release, nil
+}
+
+// compareVersions compares two dotted versions numerically, ignoring a leading "v" and any
+// pre-release suffix. It returns -1, 0 or 1.
+func compareVersions(a, b string) int {
+	parse := func(v string) []int {
+		v = strings.TrimPrefix(v, "v")
+		if i := strings.IndexAny(v, "-+"); i >= 0 {
+			v = v[:i]
+		}
+		parts := strings.Split(v, ".")
+		nums := make([]int, len(parts))
+		for i, part := range parts {
+			nums[i], _ = strconv.Atoi(part)
+		}
+		return nums
+	}
+	av, bv := parse(a), parse(b)
+	for i := 0; i < len(av) || i < len(bv); i++ {
+		var x, y int
+		if i < len(av) {
+			x = av[i]
+		}
+		if i < len(bv) {
+			y = bv[i]
+		}
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+	}
+	return 0
+}
+
+// download fetches a release asset into memory
+func download(url string) ([]byte, error) {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not download %s", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("could not download %s: status %d", url, resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// releaseArchive returns the names and URLs of the archive for this platform and of the checksums file
+func releaseArchive(release *githubRelease) (name, url, checksumsURL string, err error) {
+	arches := []string{runtime.GOARCH}
+	if runtime.GOARCH == "amd64" {
+		arches = append(arches, "x86_64")
+	}
+	for _, asset := range release.Assets {
+		lower := strings.ToLower(asset.Name)
+		if strings.HasSuffix(lower, "checksums.txt") {
+			checksumsURL = asset.URL
+			continue
+		}
+		if !strings.HasSuffix(lower, ".tar.gz") || !strings.Contains(lower, "_"+runtime.GOOS+"_") {
+			continue
+		}
+		for _, arch := range arches {
+			if strings.HasSuffix(lower, "_"+arch+".tar.gz") {
+				name, url = asset.Name, asset.URL
+			}
+		}
+	}
+	if url == "" {
+		return "", "", "", errors.Errorf("release %s has no archive for %s/%s", release.TagName, runtime.GOOS, runtime.GOARCH)
+	}
+	if checksumsURL == "" {
+		return "", "", "", errors.Errorf("release %s has no checksums file", release.TagName)
+	}
+	return name, url, checksumsURL, nil
+}
+
+// verifyChecksum checks the archive against its entry in the goreleaser checksums file
+func verifyChecksum(archive []byte, name string, checksums []byte) error {
+	sum := sha256.Sum256(archive)
+	actual := hex.EncodeToString(sum[:])
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[1] != name {
+			continue
+		}
+		if fields[0] != actual {
+			return errors.Errorf("checksum mismatch for %s: expected %s, got %s", name, fields[0], actual)
+		}
+		return nil
+	}
+	return errors.Errorf("no checksum found for %s", name)
+}
+
+// extractBinary returns the executable from a release tar.gz archive
+func extractBinary(archive []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read release archive")
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.Errorf("release archive has no %s binary", binaryName)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read release archive")
+		}
+		if filepath.Base(header.Name) == binaryName {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+// replaceExecutable atomically replaces the running binary with the new one
+func replaceExecutable(binary []byte) (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", errors.Wrap(err, "could not find the running executable")
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		return "", errors.Wrap(err, "could not resolve the running executable")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(executable), "."+binaryName+"-update-")
+	if err != nil {
+		return "", errors.Wrap(err, "could not create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return "", errors.Wrap(err, "could not write new binary")
+	}
+	if err := tmp.Close(); err != nil {
+		return "", errors.Wrap(err, "could not write new binary")
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return "", errors.Wrap(err, "could not make new binary executable")
+	}
+	if err := os.Rename(tmp.Name(), executable); err != nil {
+		return "", errors.Wrapf(err, "could not replace %s", executable)
+	}
+	return executable, nil
+}
+
+// doSelfUpdate replaces the running binary with the latest release after verifying its checksum
+func doSelfUpdate(cmd *SelfUpdateCommand) error {
+	release, err := latestRelease(httpClient)
+	if err != nil {
+		return err
+	}
+
+	if version == "dev" && !cmd.Force {
+		return errors.Errorf("this is a development build, use `--force` to install release %s", release.TagName)
+	}
+	if compareVersions(version, release.TagName) >= 0 && !cmd.Force {
+		log.Printf("[INFO] already up to date: running %s, latest release is %s", version, release.TagName)
+		return nil
+	}
+	log.Printf("[INFO] release %s is available, running %s", release.TagName, version)
+	if cmd.CheckOnly {
+		return nil
+	}
+
+	name, url, checksumsURL, err := releaseArchive(release)
+	if err != nil {
+		return err
+	}
+	log.Printf("[DEBUG] downloading %s", url)
+	archive, err := download(url)
+	if err != nil {
+		return err
+	}
+	checksums, err := download(checksumsURL)
+	if err != nil {
+		return err
+	}
+	if err := verifyChecksum(archive, name, checksums); err != nil {
+		return err
+	}
+	binary, err := extractBinary(archive)
+	if err != nil {
+		return err
+	}
+	executable, err := replaceExecutable(binary)
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] updated %s to %s", executable, release.TagName)
+	return nil
+}
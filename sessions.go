@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/pkg/errors"
+)
+
+// sessionPollInterval is how often active sessions are re-checked while waiting
+const sessionPollInterval = 30 * time.Second
+
+// activeSessions returns the number of active Session Manager sessions on an instance
+func activeSessions(ssmClient *ssm.SSM, instanceID string) (int, error) {
+	count := 0
+	err := ssmClient.DescribeSessionsPages(&ssm.DescribeSessionsInput{
+		State: aws.String(ssm.SessionStateActive),
+		Filters: []*ssm.SessionFilter{{
+			Key:   aws.String(ssm.SessionFilterKeyTarget),
+			Value: aws.String(instanceID),
+		}},
+	}, func(page *ssm.DescribeSessionsOutput, lastPage bool) bool {
+		count += len(page.Sessions)
+		return true
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not describe sessions of instance %s", instanceID)
+	}
+	return count, nil
+}
+
+// waitForSessionDrain waits until no Session Manager sessions are active on each instance.
+// Instances still with sessions after options.SessionDrainTimeout are dropped so they keep their
+// protection, and users connected through them aren't cut off.
+func waitForSessionDrain(ssmClient *ssm.SSM, instanceIds []*string, options *Options) ([]*string, error) {
+	deadline := time.Now().Add(options.SessionDrainTimeout)
+	pending := make(map[string]bool, len(instanceIds))
+	for _, instanceID := range instanceIds {
+		pending[*instanceID] = true
+	}
+
+	for {
+		for instanceID := range pending {
+			sessions, err := activeSessions(ssmClient, instanceID)
+			if err != nil {
+				return nil, err
+			}
+			if sessions == 0 {
+				log.Printf("[DEBUG] instance %s has no active sessions", instanceID)
+				delete(pending, instanceID)
+				continue
+			}
+			log.Printf("[INFO] waiting for %d active sessions on instance %s to end", sessions, instanceID)
+		}
+
+		if len(pending) == 0 {
+			return instanceIds, nil
+		}
+		if options.DryRun {
+			log.Printf("[DRYRUN] would wait up to %s for sessions on %d instances to end", options.SessionDrainTimeout, len(pending))
+			return instanceIds, nil
+		}
+		if time.Now().Add(sessionPollInterval).After(deadline) {
+			break
+		}
+		time.Sleep(sessionPollInterval)
+	}
+
+	return filterInstanceIds(instanceIds, func(instanceID string) bool {
+		if pending[instanceID] {
+			log.Printf("[WARN] instance %s still has active sessions after %s, keeping scale in protection", instanceID, options.SessionDrainTimeout)
+			return false
+		}
+		return true
+	}), nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+)
+
+// snapshotTagRunID is the tag key recording which run created a snapshot
+const snapshotTagRunID = "remove-instance-protection:run-id"
+
+// snapshotInstances creates crash-consistent snapshots of the EBS volumes of each instance,
+// tagged with the run id, before its protection is removed.
+func snapshotInstances(ec2Client *ec2.EC2, instanceIds []*string, runID string, options *Options) error {
+	for _, instanceID := range instanceIds {
+		req, resp := ec2Client.CreateSnapshotsRequest(&ec2.CreateSnapshotsInput{
+			Description: aws.String("remove-instance-protection: snapshot of " + *instanceID + " before recycling"),
+			InstanceSpecification: &ec2.InstanceSpecification{
+				InstanceId:        instanceID,
+				ExcludeBootVolume: aws.Bool(options.SnapshotExcludeBootVolume),
+			},
+			CopyTagsFromSource: aws.String(ec2.CopyTagsFromSourceVolume),
+			TagSpecifications: []*ec2.TagSpecification{
+				{
+					ResourceType: aws.String(ec2.ResourceTypeSnapshot),
+					Tags: []*ec2.Tag{
+						{Key: aws.String(snapshotTagRunID), Value: aws.String(runID)},
+						{Key: aws.String("remove-instance-protection:instance-id"), Value: instanceID},
+					},
+				},
+			},
+		})
+		if err := mutate(req, options.DryRun); err != nil {
+			return errors.Wrapf(err, "could not snapshot volumes of instance %s", *instanceID)
+		}
+		if options.DryRun {
+			continue
+		}
+		stats.action("snapshots created", len(resp.Snapshots))
+		for _, snapshot := range resp.Snapshots {
+			log.Printf("[INFO] created snapshot %s of volume %s for instance %s", aws.StringValue(snapshot.SnapshotId), aws.StringValue(snapshot.VolumeId), *instanceID)
+		}
+	}
+	return nil
+}
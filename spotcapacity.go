@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/pkg/errors"
+)
+
+// spotCapacityWindow is how far back scaling activities are searched for Spot capacity trouble
+const spotCapacityWindow = 24 * time.Hour
+
+// usesSpot reports whether the ASG launches some of its instances as Spot
+func usesSpot(asg *autoscaling.Group) bool {
+	policy := asg.MixedInstancesPolicy
+	if policy == nil || policy.InstancesDistribution == nil {
+		return false
+	}
+	return aws.Int64Value(policy.InstancesDistribution.OnDemandPercentageAboveBaseCapacity) < 100
+}
+
+// checkSpotCapacity warns, before the old fleet is drained, when the ASG's recent scaling
+// activities show that Spot capacity for its instance types is hard to get: launches that
+// failed for lack of capacity, and instances lost to Spot interruptions or rebalancing. This SDK
+// has no Spot placement scores, so the ASG's own history is the signal.
+func checkSpotCapacity(asgClient *autoscaling.AutoScaling, asg *autoscaling.Group) error {
+	if !usesSpot(asg) {
+		return nil
+	}
+	since := time.Now().Add(-spotCapacityWindow)
+	failed, interrupted := 0, 0
+	err := asgClient.DescribeScalingActivitiesPages(&autoscaling.DescribeScalingActivitiesInput{
+		AutoScalingGroupName: asg.AutoScalingGroupName,
+	}, func(page *autoscaling.DescribeScalingActivitiesOutput, lastPage bool) bool {
+		for _, activity := range page.Activities {
+			if activity.StartTime == nil || activity.StartTime.Before(since) {
+				return false
+			}
+			message := strings.ToLower(aws.StringValue(activity.StatusMessage))
+			cause := strings.ToLower(aws.StringValue(activity.Cause))
+			switch {
+			case aws.StringValue(activity.StatusCode) == autoscaling.ScalingActivityStatusCodeFailed && strings.Contains(message, "capacity"):
+				failed++
+			case strings.Contains(cause, "spot") && (strings.Contains(cause, "interruption") || strings.Contains(cause, "rebalance")):
+				interrupted++
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not describe scaling activities")
+	}
+
+	log.Printf("[DEBUG] in the last %s ASG %s had %d launches fail for lack of capacity and %d Spot interruptions", spotCapacityWindow, aws.StringValue(asg.AutoScalingGroupName), failed, interrupted)
+	if failed > 0 || interrupted > 0 {
+		log.Printf("[WARN] ASG %s had %d launches fail for lack of capacity and lost %d Spot instances to interruptions in the last %s, replacement capacity may be hard to get", aws.StringValue(asg.AutoScalingGroupName), failed, interrupted, spotCapacityWindow)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/meirf/gopart"
+	"github.com/pkg/errors"
+)
+
+// ssmOnlineInstances returns the subset of instanceIds that are managed by SSM and currently online
+func ssmOnlineInstances(ssmClient *ssm.SSM, instanceIds []string) (map[string]bool, error) {
+	online := make(map[string]bool)
+	for partition := range gopart.Partition(len(instanceIds), 50) {
+		err := ssmClient.DescribeInstanceInformationPages(&ssm.DescribeInstanceInformationInput{
+			Filters: []*ssm.InstanceInformationStringFilter{
+				{
+					Key:    aws.String("InstanceIds"),
+					Values: aws.StringSlice(instanceIds[partition.Low:partition.High]),
+				},
+			},
+		}, func(page *ssm.DescribeInstanceInformationOutput, lastPage bool) bool {
+			for _, info := range page.InstanceInformationList {
+				if aws.StringValue(info.PingStatus) == ssm.PingStatusOnline {
+					online[aws.StringValue(info.InstanceId)] = true
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "could not describe SSM instance information")
+		}
+	}
+	return online, nil
+}
+
+// checkSSMOnline limits the instances to unprotect to the capacity of latest instances that are
+// online in SSM, so each stale instance released has a managed replacement, and reports stale
+// instances that aren't SSM managed.
+func checkSSMOnline(ssmClient *ssm.SSM, latestInstances []string, instanceIds []*string, weights capacityWeights) ([]*string, error) {
+	all := append(append([]string{}, latestInstances...), aws.StringValueSlice(instanceIds)...)
+	online, err := ssmOnlineInstances(ssmClient, all)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, instanceID := range instanceIds {
+		if !online[*instanceID] {
+			log.Printf("[WARN] old instance %s is not online in SSM, it may be a zombie", *instanceID)
+		}
+	}
+
+	onlineLatest := 0.0
+	for _, instanceID := range latestInstances {
+		if online[instanceID] {
+			onlineLatest += weights.weight(instanceID)
+		} else {
+			log.Printf("[WARN] latest instance %s is not online in SSM, not counting it as replacement capacity", instanceID)
+		}
+	}
+
+	released := 0.0
+	kept := filterInstanceIds(instanceIds, func(instanceID string) bool {
+		if released+weights.weight(instanceID) > onlineLatest {
+			return false
+		}
+		released += weights.weight(instanceID)
+		return true
+	})
+	if len(kept) < len(instanceIds) {
+		log.Printf("[WARN] only %v capacity units of latest instances are online in SSM, removing protection from %d of %d old instances", onlineLatest, len(kept), len(instanceIds))
+	}
+	return kept, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/pkg/errors"
+)
+
+// instanceState is what a run observed about one instance
+type instanceState struct {
+	State     string `json:"state"`
+	Protected bool   `json:"protected"`
+}
+
+// runState is persisted to --state-file so the next run can report what changed since
+type runState struct {
+	RunID         string                   `json:"run_id"`
+	ASG           string                   `json:"asg"`
+	Time          time.Time                `json:"time"`
+	LatestVersion int64                    `json:"latest_version"`
+	Instances     map[string]instanceState `json:"instances"`
+}
+
+// loadRunState reads the state of the previous run, returning nil if there is none yet
+func loadRunState(sess *session.Session, path string, options *Options) (*runState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read state file %s", path)
+	}
+	data, err = openFile(sess, options, data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read state file %s", path)
+	}
+	var state runState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.Wrapf(err, "could not parse state file %s", path)
+	}
+	return &state, nil
+}
+
+// saveRunState writes the state of this run
+func saveRunState(sess *session.Session, path string, state *runState, options *Options) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not encode state")
+	}
+	data, err = sealFile(sess, options, data)
+	if err != nil {
+		return errors.Wrapf(err, "could not write state file %s", path)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return errors.Wrapf(err, "could not write state file %s", path)
+	}
+	return nil
+}
+
+// currentRunState builds the state of this run from the recorded instance states
+func currentRunState(runID string, asg *autoscaling.Group, latestVersion int64) *runState {
+	protected := make(map[string]bool, len(asg.Instances))
+	for _, instance := range asg.Instances {
+		protected[*instance.InstanceId] = aws.BoolValue(instance.ProtectedFromScaleIn)
+	}
+
+	state := &runState{
+		RunID:         runID,
+		ASG:           aws.StringValue(asg.AutoScalingGroupName),
+		Time:          time.Now().UTC(),
+		LatestVersion: latestVersion,
+		Instances:     make(map[string]instanceState),
+	}
+	for _, s := range stats.instanceStates() {
+		state.Instances[s[0]] = instanceState{State: s[1], Protected: protected[s[0]]}
+	}
+	return state
+}
+
+// unprotectedOnPurpose reports whether a run removed the protection of an instance in the state
+// for another reason than rotating it out, which reconcile must not undo
+func unprotectedOnPurpose(state string) bool {
+	return state == stateExpired || state == stateReaped
+}
+
+// isStale reports whether an instance in state is due for rotation. Skipped instances are stale
+// ones a guard kept protected for this run, and conflict ones stale ones left to another controller.
+func isStale(state string) bool {
+	return state == stateSkipped || state == stateConflict || strings.HasPrefix(state, "stale-") || strings.HasPrefix(state, "foreign-") || strings.HasPrefix(state, "template-replaced-")
+}
+
+// logRunStateChanges reports what changed between the previous and the current run
+func logRunStateChanges(previous *runState, current *runState) {
+	var newlyStale, newlyCurrent, newlyUnprotected, gone []string
+	for instanceID, now := range current.Instances {
+		before, ok := previous.Instances[instanceID]
+		if isStale(now.State) && (!ok || !isStale(before.State)) {
+			newlyStale = append(newlyStale, instanceID)
+		}
+		if now.State == stateLatest && ok && before.State != stateLatest {
+			newlyCurrent = append(newlyCurrent, instanceID)
+		}
+		if ok && before.Protected && !now.Protected {
+			newlyUnprotected = append(newlyUnprotected, instanceID)
+		}
+	}
+	for instanceID := range previous.Instances {
+		if _, ok := current.Instances[instanceID]; !ok {
+			gone = append(gone, instanceID)
+		}
+	}
+
+	log.Printf("[INFO] changes since run %s at %s (latest version %d -> %d):", previous.RunID, previous.Time.Format(time.RFC3339), previous.LatestVersion, current.LatestVersion)
+	for _, change := range []struct {
+		name      string
+		instances []string
+	}{
+		{"newly stale", newlyStale},
+		{"newly current", newlyCurrent},
+		{"newly unprotected", newlyUnprotected},
+		{"gone", gone},
+	} {
+		sort.Strings(change.instances)
+		log.Printf("[INFO]   %-18s %d %v", change.name, len(change.instances), change.instances)
+	}
+}
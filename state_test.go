@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestIsStale(t *testing.T) {
+	tests := []struct {
+		state string
+		stale bool
+	}{
+		{stateLatest, false},
+		{stateStaleProtected, true},
+		{stateStaleUnprotected, true},
+		{stateForeignProtected, true},
+		{stateForeignUnprotected, true},
+		{stateTemplateReplacedProtected, true},
+		{stateTemplateReplacedUnprotected, true},
+		{stateUnknown, false},
+		{stateSkipped, true},
+		{stateExcluded, false},
+		{stateLatestUnhealthy, false},
+		{stateExpired, false},
+		{stateReaped, false},
+		{stateConflict, true},
+	}
+	for _, test := range tests {
+		if stale := isStale(test.state); stale != test.stale {
+			t.Errorf("isStale(%q) = %v, want %v", test.state, stale, test.stale)
+		}
+	}
+}
+
+func TestStaleInstances(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func() { stats = newRunStats() }()
+
+	stats = newRunStats()
+	for instanceID, state := range map[string]string{
+		"i-1": stateLatest,
+		"i-2": stateStaleProtected,
+		"i-3": stateSkipped,
+		"i-4": stateLatestUnhealthy,
+		"i-5": stateExcluded,
+		"i-6": stateConflict,
+	} {
+		recordDecision("DEBUG", instanceID, "", state, "")
+	}
+	// the ASG hasn't converged while unhealthy instances on the latest version are left either
+	if n := staleInstances(); n != 4 {
+		t.Errorf("staleInstances() = %d, want 4", n)
+	}
+}
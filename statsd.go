@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/pkg/errors"
+)
+
+// statsdClient sends metrics to a StatsD or DogStatsD agent over UDP. Sending is best effort,
+// a missing agent never fails a run.
+type statsdClient struct {
+	conn      net.Conn
+	prefix    string
+	dogstatsd bool
+	// tags are added to every metric in DogStatsD format
+	tags []string
+}
+
+func newStatsdClient(options *Options) (*statsdClient, error) {
+	conn, err := net.Dial("udp", options.StatsdAddr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not connect to StatsD at %s", options.StatsdAddr)
+	}
+	return &statsdClient{
+		conn:      conn,
+		prefix:    options.StatsdPrefix,
+		dogstatsd: options.StatsdFormat == "dogstatsd",
+		tags:      []string{"asg:" + options.ASG},
+	}, nil
+}
+
+// metricName turns free-form names like "targets deregistered (dry-run)" into metric names
+func metricName(name string) string {
+	return strings.Trim(strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name), "_")
+}
+
+func (c *statsdClient) send(name string, value string, metricType string, tags ...string) {
+	line := fmt.Sprintf("%s.%s:%s|%s", c.prefix, name, value, metricType)
+	if c.dogstatsd {
+		line += "|#" + strings.Join(append(append([]string{}, c.tags...), tags...), ",")
+	}
+	if _, err := c.conn.Write([]byte(line)); err != nil {
+		log.Printf("[SPAM] could not send metric %s: %v", name, err)
+	}
+}
+
+func (c *statsdClient) count(name string, n int, tags ...string) {
+	c.send(metricName(name), fmt.Sprintf("%d", n), "c", tags...)
+}
+
+func (c *statsdClient) timing(name string, d time.Duration, tags ...string) {
+	c.send(metricName(name), fmt.Sprintf("%d", d.Milliseconds()), "ms", tags...)
+}
+
+// watch times every AWS request completed through the session
+func (c *statsdClient) watch(sess *session.Session) {
+	sess.Handlers.Complete.PushBack(func(r *request.Request) {
+		tags := []string{"service:" + r.ClientInfo.ServiceName, "operation:" + r.Operation.Name}
+		c.timing("aws.call", time.Since(r.Time), tags...)
+		if r.Error != nil {
+			c.count("aws.errors", 1, tags...)
+		}
+	})
+}
+
+// emitRun sends the classifications, actions and phase timings of the run
+func (c *statsdClient) emitRun(s *runStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endPhaseLocked()
+	for decision, n := range s.decisions {
+		c.count("instances."+decision, n)
+	}
+	for action, n := range s.actions {
+		c.count("actions."+action, n)
+	}
+	for _, phase := range s.phases {
+		c.timing("phase."+phase.name, phase.duration)
+	}
+	c.count("aws.calls", s.apiCalls)
+	for operation, n := range s.apiCallsByOperation {
+		// colons separate the value in the statsd line protocol
+		c.count("aws.calls."+strings.Replace(operation, ":", ".", 1), n)
+	}
+	c.count("aws.retries", s.apiRetries)
+	c.timing("duration", time.Since(s.start))
+}
+
+func (c *statsdClient) close() {
+	c.conn.Close()
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/pkg/errors"
+)
+
+// Instance states, as recorded by recordDecision and printed by --output-all-instances
+const (
+	stateLatest             = "latest"
+	stateNewer              = "newer"
+	stateStaleProtected     = "stale-protected"
+	stateStaleUnprotected   = "stale-unprotected"
+	stateForeignProtected   = "foreign-protected"
+	stateForeignUnprotected = "foreign-unprotected"
+	// template-replaced instances are on a Launch Template the ASG has since been switched away from
+	stateTemplateReplacedProtected   = "template-replaced-protected"
+	stateTemplateReplacedUnprotected = "template-replaced-unprotected"
+	stateUnknown                     = "unknown"
+	stateSkipped                     = "skipped"
+	stateExcluded                    = "excluded"
+	stateLatestUnhealthy             = "latest-unhealthy"
+	// expired and reaped instances had their protection removed by --protection-max-age and
+	// --reap-zombies, regardless of their Launch Template version
+	stateExpired = "expired"
+	stateReaped  = "reaped"
+	// conflict instances are stale, but another controller keeps enabling their protection again
+	stateConflict = "conflict"
+)
+
+// phaseTiming is the wall clock time spent in one phase of a run
+type phaseTiming struct {
+	name     string
+	duration time.Duration
+}
+
+// runStats collects what happened during a run for the summary printed at its end
+type runStats struct {
+	mu sync.Mutex
+
+	runID        string
+	start        time.Time
+	phase        string
+	phaseStart   time.Time
+	phases       []phaseTiming
+	decisions    map[string]int
+	states       map[string]string
+	stateOrder   []string
+	actions      map[string]int
+	actionsOrder []string
+	apiCalls     int
+	// apiCallsByOperation counts the AWS requests by "service:Operation", and apiRetries the
+	// retries they took on top
+	apiCallsByOperation map[string]int
+	apiRetries          int
+	// session is the session of the run with its handlers, for the AWS calls made reporting it
+	session *session.Session
+	// protectedBefore and protectedAfter are the scale in protection of the ASG's instances at
+	// the start of the run and after unprotecting, and unprotected the instances this run unprotected
+	protectedBefore map[string]bool
+	protectedAfter  map[string]bool
+	unprotected     []string
+	// newInstancesProtected is the ASG's NewInstancesProtectedFromScaleIn setting
+	newInstancesProtected *bool
+	// remaining are the instances left protected when the run aborted while unprotecting
+	remaining []string
+	// failures are the errors --keep-going let the run continue past
+	failures []string
+	// targets are the outcomes of deregistering old instances from target groups
+	targets []targetOutcome
+	// empty is why the ASG can't be rotated at all, if it is empty or fully suspended
+	empty string
+	// timelines are when each step of the rotation of old instances happened
+	timelines map[string]*instanceTimeline
+	// deregisteredAMIs are the instances running a deregistered AMI, with the reason
+	deregisteredAMIs map[string]string
+}
+
+// stats is the summary of the current run
+var stats = newRunStats()
+
+func newRunStats() *runStats {
+	now := time.Now()
+	return &runStats{
+		start:      now,
+		phaseStart: now,
+		decisions:  make(map[string]int),
+		states:     make(map[string]string),
+		actions:    make(map[string]int),
+		timelines:  make(map[string]*instanceTimeline),
+
+		apiCallsByOperation: make(map[string]int),
+	}
+}
+
+// startPhase ends the current phase, if any, and starts timing the named one
+func (s *runStats) startPhase(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endPhaseLocked()
+	s.phase = name
+	s.phaseStart = time.Now()
+}
+
+func (s *runStats) endPhaseLocked() {
+	if s.phase == "" {
+		return
+	}
+	s.phases = append(s.phases, phaseTiming{name: s.phase, duration: time.Since(s.phaseStart)})
+	s.phase = ""
+}
+
+// action records that n changes of the given kind were made (or, in dry-run, would be made)
+func (s *runStats) action(name string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.actions[name]; !ok {
+		s.actionsOrder = append(s.actionsOrder, name)
+	}
+	s.actions[name] += n
+}
+
+// countAPICalls counts every AWS request completed through the session, by operation
+func (s *runStats) countAPICalls(sess *session.Session) {
+	sess.Handlers.Complete.PushBack(func(r *request.Request) {
+		s.mu.Lock()
+		s.apiCalls++
+		s.apiCallsByOperation[apiOperation(r)]++
+		s.apiRetries += r.RetryCount
+		s.mu.Unlock()
+	})
+}
+
+// apiOperation names the request's operation the way IAM actions are named, e.g.
+// "autoscaling:SetInstanceProtection"
+func apiOperation(r *request.Request) string {
+	return r.ClientInfo.ServiceName + ":" + r.Operation.Name
+}
+
+// apiCallCounts returns a copy of the AWS requests of the run by operation
+func (s *runStats) apiCallCounts() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]int, len(s.apiCallsByOperation))
+	for operation, n := range s.apiCallsByOperation {
+		counts[operation] = n
+	}
+	return counts
+}
+
+// printAPICalls logs the calls by operation, most frequent first
+func printAPICalls(counts map[string]int) {
+	operations := make([]string, 0, len(counts))
+	for operation := range counts {
+		operations = append(operations, operation)
+	}
+	sort.Slice(operations, func(i, j int) bool {
+		if counts[operations[i]] != counts[operations[j]] {
+			return counts[operations[i]] > counts[operations[j]]
+		}
+		return operations[i] < operations[j]
+	})
+	for _, operation := range operations {
+		log.Printf("[INFO]   %-44s %d", operation, counts[operation])
+	}
+}
+
+// keepGoing returns err unless --keep-going is set, in which case it records the failure for
+// the end of the run and returns nil. Once the circuit breaker or budget trips errors always abort.
+func keepGoing(options *Options, err error) error {
+	if err == nil || !options.KeepGoing || breaker.isOpen() || budget.exceeded() {
+		return err
+	}
+	log.Printf("[ERROR] %v, continuing with `--keep-going`", err)
+	stats.mu.Lock()
+	stats.failures = append(stats.failures, err.Error())
+	stats.mu.Unlock()
+	return nil
+}
+
+// failuresError returns a partial failure for the errors recorded by keepGoing, or nil
+func (s *runStats) failuresError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.failures) == 0 {
+		return nil
+	}
+	return &runError{
+		kind:   errorKindPartialFailure,
+		err:    errors.Errorf("%d failures: %s", len(s.failures), strings.Join(s.failures, "; ")),
+		failed: len(s.failures),
+	}
+}
+
+// logDebug is set when DEBUG lines are written anywhere, by --log-level or the explain command
+var logDebug = true
+
+// recordDecision counts the classification of a single instance and logs it in aligned columns
+// so long runs can be scanned by eye.
+func recordDecision(level string, instanceID string, version string, decision string, detail string) {
+	stats.mu.Lock()
+	if _, ok := stats.states[instanceID]; !ok {
+		stats.stateOrder = append(stats.stateOrder, instanceID)
+	}
+	stats.setState(instanceID, decision)
+	stats.mu.Unlock()
+	// most instances of a large ASG are classified at DEBUG, don't format lines that are dropped
+	if level == "DEBUG" && !logDebug {
+		return
+	}
+	log.Printf("[%s] %-19s %-8s %-18s %s", level, instanceID, version, decision, detail)
+}
+
+// setDeregisteredAMIs records the instances running a deregistered AMI for the report
+func (s *runStats) setDeregisteredAMIs(reasons map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deregisteredAMIs = reasons
+}
+
+// setRemaining records the instances left protected when the run aborts while unprotecting
+func (s *runStats) setRemaining(instanceIds []*string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remaining = aws.StringValueSlice(instanceIds)
+	log.Printf("[WARN] %d instances left protected: %v", len(s.remaining), s.remaining)
+}
+
+// markState changes the recorded state of a classified instance
+func (s *runStats) markState(instanceID string, state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setState(instanceID, state)
+}
+
+// markSkipped records that instances classified for protection removal were left protected
+func (s *runStats) markSkipped(instanceIds []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, instanceID := range instanceIds {
+		s.setState(instanceID, stateSkipped)
+	}
+}
+
+// setState moves an instance to state, counting it under its new state only, with s.mu held
+func (s *runStats) setState(instanceID string, state string) {
+	if previous, ok := s.states[instanceID]; ok {
+		s.decisions[previous]--
+		if s.decisions[previous] == 0 {
+			delete(s.decisions, previous)
+		}
+	}
+	s.states[instanceID] = state
+	s.decisions[state]++
+}
+
+// instanceState returns the state an instance was classified as, or "" if it wasn't
+func (s *runStats) instanceState(instanceID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.states[instanceID]
+}
+
+// unprotectedInstances returns the instances this run removed protection from
+func (s *runStats) unprotectedInstances() map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unprotected := make(map[string]bool, len(s.unprotected))
+	for _, instanceID := range s.unprotected {
+		unprotected[instanceID] = true
+	}
+	return unprotected
+}
+
+// instanceStates returns every classified instance and its state, in classification order
+func (s *runStats) instanceStates() [][2]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states := make([][2]string, 0, len(s.stateOrder))
+	for _, instanceID := range s.stateOrder {
+		states = append(states, [2]string{instanceID, s.states[instanceID]})
+	}
+	return states
+}
+
+// print logs the summary block
+func (s *runStats) print() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endPhaseLocked()
+
+	log.Printf("[INFO] ---- run summary ----")
+	decisions := make([]string, 0, len(s.decisions))
+	for decision := range s.decisions {
+		decisions = append(decisions, decision)
+	}
+	sort.Strings(decisions)
+	for _, decision := range decisions {
+		log.Printf("[INFO] %-28s %d", "instances "+decision, s.decisions[decision])
+	}
+	for _, action := range s.actionsOrder {
+		log.Printf("[INFO] %-28s %d", action, s.actions[action])
+	}
+	for _, phase := range s.phases {
+		log.Printf("[INFO] %-28s %s", "phase "+phase.name, phase.duration.Round(time.Millisecond))
+	}
+	log.Printf("[INFO] %-28s %d", "aws api calls", s.apiCalls)
+	printAPICalls(s.apiCallsByOperation)
+	if s.apiRetries > 0 {
+		log.Printf("[INFO] %-28s %d", "aws api retries", s.apiRetries)
+	}
+	for _, failure := range s.failures {
+		log.Printf("[ERROR] %-28s %s", "failed", failure)
+	}
+	log.Printf("[INFO] %-28s %s", "total duration", time.Since(s.start).Round(time.Millisecond))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestStateBookkeeping(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func() { stats = newRunStats() }()
+
+	tests := []struct {
+		name      string
+		steps     func()
+		decisions map[string]int
+		states    string
+	}{
+		{
+			"classified",
+			func() {
+				recordDecision("DEBUG", "i-1", "5", stateLatest, "")
+				recordDecision("INFO", "i-2", "4", stateStaleProtected, "")
+				recordDecision("INFO", "i-3", "4", stateStaleProtected, "")
+			},
+			map[string]int{stateLatest: 1, stateStaleProtected: 2},
+			"[[i-1 latest] [i-2 stale-protected] [i-3 stale-protected]]",
+		},
+		{
+			// an instance moved to another state counts under its new state only
+			"skipped and marked",
+			func() {
+				recordDecision("INFO", "i-1", "4", stateStaleProtected, "")
+				recordDecision("INFO", "i-2", "4", stateStaleProtected, "")
+				recordDecision("INFO", "i-3", "4", stateStaleProtected, "")
+				stats.markSkipped([]string{"i-1", "i-2"})
+				stats.markState("i-3", stateConflict)
+			},
+			map[string]int{stateSkipped: 2, stateConflict: 1},
+			"[[i-1 skipped] [i-2 skipped] [i-3 conflict]]",
+		},
+		{
+			// classifying an instance again keeps its place in the order
+			"reclassified",
+			func() {
+				recordDecision("INFO", "i-1", "4", stateStaleProtected, "")
+				recordDecision("INFO", "i-2", "5", stateLatest, "")
+				recordDecision("INFO", "i-1", "4", stateExcluded, "")
+				stats.markState("i-2", stateLatestUnhealthy)
+				stats.markState("i-2", stateLatest)
+			},
+			map[string]int{stateExcluded: 1, stateLatest: 1},
+			"[[i-1 excluded] [i-2 latest]]",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stats = newRunStats()
+			test.steps()
+			if fmt.Sprint(stats.decisions) != fmt.Sprint(test.decisions) {
+				t.Errorf("decisions %v, want %v", stats.decisions, test.decisions)
+			}
+			if states := fmt.Sprint(stats.instanceStates()); states != test.states {
+				t.Errorf("instance states %s, want %s", states, test.states)
+			}
+		})
+	}
+}
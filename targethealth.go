@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/pkg/errors"
+)
+
+type targetHealthEntry struct {
+	fetched      time.Time
+	descriptions []*elbv2.TargetHealthDescription
+}
+
+// targetHealthCache memoizes DescribeTargetHealth by target group ARN for a short TTL, so
+// several lookups of the same target group within a sweep only cost one API call. A sweep
+// creates one cache, and each of its runs describes through its own client with forRun.
+type targetHealthCache struct {
+	client *elbv2.ELBV2
+	ttl    time.Duration
+	shared *targetHealthEntries
+}
+
+// targetHealthEntries are the responses cached for all runs of a sweep
+type targetHealthEntries struct {
+	mu      sync.Mutex
+	entries map[string]targetHealthEntry
+}
+
+func newTargetHealthCache(ttl time.Duration) *targetHealthCache {
+	return &targetHealthCache{
+		ttl:    ttl,
+		shared: &targetHealthEntries{entries: make(map[string]targetHealthEntry)},
+	}
+}
+
+// forRun returns the cache describing target groups with the client of a run, sharing the
+// responses cached by the other runs of the sweep
+func (c *targetHealthCache) forRun(client *elbv2.ELBV2) *targetHealthCache {
+	return &targetHealthCache{client: client, ttl: c.ttl, shared: c.shared}
+}
+
+// describe returns the target health descriptions for the target group, using a cached
+// response when it is younger than the TTL.
+func (c *targetHealthCache) describe(tg string) ([]*elbv2.TargetHealthDescription, error) {
+	c.shared.mu.Lock()
+	entry, ok := c.shared.entries[tg]
+	c.shared.mu.Unlock()
+	if ok && time.Since(entry.fetched) < c.ttl {
+		log.Printf("[SPAM] using cached target health for %s", tg)
+		return entry.descriptions, nil
+	}
+
+	resp, err := c.client.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(tg),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get target group instances for %s", tg)
+	}
+
+	c.shared.mu.Lock()
+	c.shared.entries[tg] = targetHealthEntry{fetched: time.Now(), descriptions: resp.TargetHealthDescriptions}
+	c.shared.mu.Unlock()
+	return resp.TargetHealthDescriptions, nil
+}
+
+// invalidate drops the cached response for a target group, e.g. after deregistering targets from it
+func (c *targetHealthCache) invalidate(tg string) {
+	c.shared.mu.Lock()
+	delete(c.shared.entries, tg)
+	c.shared.mu.Unlock()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/pkg/errors"
+)
+
+// teamsFact is one row of an adaptive card FactSet
+type teamsFact struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
+// renderNotifyTemplate renders the --notify-template file with the run report, so teams can add
+// runbook links, owner mentions or environment labels to notifications
+func renderNotifyTemplate(path string, report *runReport) (string, error) {
+	tmpl, err := template.New(filepath.Base(path)).Funcs(template.FuncMap{
+		"join": strings.Join,
+	}).ParseFiles(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not parse notification template %s", path)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, report); err != nil {
+		return "", errors.Wrapf(err, "could not render notification template %s", path)
+	}
+	return out.String(), nil
+}
+
+// teamsCard wraps adaptive card body elements into a webhook payload
+func teamsCard(body []map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "message",
+		"attachments": []map[string]interface{}{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content": map[string]interface{}{
+				"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+				"type":    "AdaptiveCard",
+				"version": "1.2",
+				"body":    body,
+			},
+		}},
+	}
+}
+
+// teamsMessage builds the webhook payload of an adaptive card summarizing the run
+func teamsMessage(report *runReport) map[string]interface{} {
+	title := fmt.Sprintf("remove-instance-protection: %s %s", report.ASG, report.Status)
+	if report.Account != "" {
+		title = fmt.Sprintf("remove-instance-protection: %s in account %s %s", report.ASG, report.Account, report.Status)
+	}
+	if report.DryRun {
+		title += " (dry-run)"
+	}
+	facts := []teamsFact{
+		{Title: "Run", Value: report.RunID},
+		{Title: "Duration", Value: report.Duration},
+	}
+
+	states := make(map[string]int)
+	for _, state := range report.Instances {
+		states[state]++
+	}
+	names := make([]string, 0, len(states))
+	for state := range states {
+		names = append(names, state)
+	}
+	sort.Strings(names)
+	for _, state := range names {
+		facts = append(facts, teamsFact{Title: "Instances " + state, Value: fmt.Sprintf("%d", states[state])})
+	}
+	actions := make([]string, 0, len(report.Actions))
+	for action := range report.Actions {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	for _, action := range actions {
+		facts = append(facts, teamsFact{Title: action, Value: fmt.Sprintf("%d", report.Actions[action])})
+	}
+
+	body := []map[string]interface{}{
+		{"type": "TextBlock", "text": title, "weight": "bolder", "size": "medium", "wrap": true},
+		{"type": "FactSet", "facts": facts},
+	}
+	if report.Error != nil {
+		body = append(body, map[string]interface{}{
+			"type": "TextBlock", "text": report.Error.Kind + ": " + report.Error.Message, "color": "attention", "wrap": true,
+		})
+	}
+	return teamsCard(body)
+}
+
+// notifyTeams posts the run summary to a Microsoft Teams incoming webhook, as rendered by
+// templatePath if it is set
+func notifyTeams(client *http.Client, url string, templatePath string, report *runReport) error {
+	message := teamsMessage(report)
+	if templatePath != "" {
+		text, err := renderNotifyTemplate(templatePath, report)
+		if err != nil {
+			return err
+		}
+		message = teamsCard([]map[string]interface{}{
+			{"type": "TextBlock", "text": text, "wrap": true},
+		})
+	}
+	return postTeams(client, url, message)
+}
+
+// postTeams posts a message to a Microsoft Teams incoming webhook
+func postTeams(client *http.Client, url string, message map[string]interface{}) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return errors.Wrap(err, "could not encode Teams message")
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return errors.Wrap(err, "could not post to Teams webhook")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("could not post to Teams webhook: status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// shouldNotify applies --notify-on and --notify-dry-run to a run, so scheduled runs that change
+// nothing don't spam channels. Errors are always sent unless --notify-on is never.
+func shouldNotify(options *Options, report *runReport) bool {
+	if report.Error != nil {
+		return options.NotifyOn != "never"
+	}
+	if report.DryRun && !options.NotifyDryRun {
+		return false
+	}
+	switch options.NotifyOn {
+	case "always":
+		return true
+	case "changes":
+		return len(report.Actions) > 0
+	default:
+		return false
+	}
+}
+
+// notify sends the summary of the last run to the configured notification sinks. Failures are
+// logged but don't fail the run.
+func notify(sess *session.Session, options *Options, runErr error) {
+	if options.TeamsWebhookURL == "" {
+		return
+	}
+	report := newRunReport(options, runErr)
+	if !shouldNotify(options, report) {
+		log.Printf("[DEBUG] not notifying about run %s with `--notify-on %s`", report.RunID, options.NotifyOn)
+		return
+	}
+	url, err := resolveSecret(sess, options, options.TeamsWebhookURL)
+	if err != nil {
+		log.Printf("[ERROR] %v", err)
+		return
+	}
+	if err := notifyTeams(httpClient, url, options.NotifyTemplate, report); err != nil {
+		log.Printf("[ERROR] %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/pkg/errors"
+)
+
+// launchActivityPrefix starts the description of the scaling activity of an instance the ASG
+// launched itself, as opposed to one attached to it
+const launchActivityPrefix = "Launching a new EC2 instance: "
+
+// templateReplacedInstances returns the instances on another Launch Template than the ASG's that
+// the ASG launched itself, according to its scaling activities. Those were launched before the
+// ASG's Launch Template was swapped, rather than attached from elsewhere. Scaling activities are
+// only kept for six weeks, so older swaps go undetected.
+func templateReplacedInstances(asgClient *autoscaling.AutoScaling, asg *autoscaling.Group, lt launchTemplateRef) (map[string]bool, error) {
+	candidates := make(map[string]string)
+	for _, instance := range asg.Instances {
+		if instance.LaunchTemplate != nil && !lt.matches(instance.LaunchTemplate) {
+			candidates[*instance.InstanceId] = aws.StringValue(instance.LaunchTemplate.LaunchTemplateName)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	replaced := make(map[string]bool)
+	err := asgClient.DescribeScalingActivitiesPages(&autoscaling.DescribeScalingActivitiesInput{
+		AutoScalingGroupName: asg.AutoScalingGroupName,
+	}, func(page *autoscaling.DescribeScalingActivitiesOutput, lastPage bool) bool {
+		for _, activity := range page.Activities {
+			description := aws.StringValue(activity.Description)
+			if !strings.HasPrefix(description, launchActivityPrefix) {
+				continue
+			}
+			instanceID := strings.TrimPrefix(description, launchActivityPrefix)
+			if _, ok := candidates[instanceID]; ok {
+				replaced[instanceID] = true
+			}
+		}
+		return len(replaced) < len(candidates)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not describe scaling activities")
+	}
+
+	previous := make(map[string]bool)
+	for instanceID := range replaced {
+		if name := candidates[instanceID]; !previous[name] {
+			previous[name] = true
+			log.Printf("[INFO] ASG %s launched instances from Launch Template %s before switching to %s", aws.StringValue(asg.AutoScalingGroupName), name, lt)
+		}
+	}
+	return replaced, nil
+}
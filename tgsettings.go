@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/meirf/gopart"
+	"github.com/pkg/errors"
+)
+
+// targetGroupSettings are the target group attributes that affect how fast old instances can be
+// drained
+type targetGroupSettings struct {
+	// slowStart is the longest slow start duration of the target groups. A new target only
+	// receives its full share of requests once it has passed, so it extends the warmup of
+	// replacement instances.
+	slowStart time.Duration
+	// sticky are the target groups with sticky sessions, whose clients only move to replacement
+	// targets once their old target is deregistered
+	sticky []string
+	// deregistrationDelay is the longest deregistration delay of the target groups
+	deregistrationDelay time.Duration
+	// flowTargetGroups are the Network and Gateway Load Balancer target groups, which keep
+	// existing connections and flows on a deregistered target until they close or the
+	// deregistration delay ends, instead of draining requests
+	flowTargetGroups []string
+}
+
+// protocolGeneve is the protocol of Gateway Load Balancer target groups, which this SDK version
+// has no constant for
+const protocolGeneve = "GENEVE"
+
+// isFlowProtocol reports whether a target group protocol belongs to a Network or Gateway Load
+// Balancer rather than an Application Load Balancer
+func isFlowProtocol(protocol string) bool {
+	switch protocol {
+	case elbv2.ProtocolEnumTcp, elbv2.ProtocolEnumUdp, elbv2.ProtocolEnumTls, elbv2.ProtocolEnumTcpUdp, protocolGeneve:
+		return true
+	}
+	return false
+}
+
+// describeTargetGroupSettings reads the protocols and the slow start, stickiness and
+// deregistration delay attributes of the target groups
+func describeTargetGroupSettings(albClient *elbv2.ELBV2, targetGroupARNs []*string, options *Options) (*targetGroupSettings, error) {
+	settings := &targetGroupSettings{}
+	for partition := range gopart.Partition(len(targetGroupARNs), 20) {
+		resp, err := albClient.DescribeTargetGroups(&elbv2.DescribeTargetGroupsInput{
+			TargetGroupArns: targetGroupARNs[partition.Low:partition.High],
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "could not describe target groups")
+		}
+		for _, tg := range resp.TargetGroups {
+			protocol := aws.StringValue(tg.Protocol)
+			if !isFlowProtocol(protocol) {
+				continue
+			}
+			settings.flowTargetGroups = append(settings.flowTargetGroups, *tg.TargetGroupArn)
+			log.Printf("[INFO] target group %s uses %s, connections to drained targets stay open until they close or the deregistration delay ends", *tg.TargetGroupArn, protocol)
+			if healthProtocol := aws.StringValue(tg.HealthCheckProtocol); options.HealthURLTemplate != "" && healthProtocol != elbv2.ProtocolEnumHttp && healthProtocol != elbv2.ProtocolEnumHttps {
+				log.Printf("[WARN] target group %s health checks use %s, so the HTTP probe of --health-url-template may not match how the load balancer judges targets", *tg.TargetGroupArn, healthProtocol)
+			}
+		}
+	}
+
+	for _, tg := range targetGroupARNs {
+		resp, err := albClient.DescribeTargetGroupAttributes(&elbv2.DescribeTargetGroupAttributesInput{
+			TargetGroupArn: tg,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not describe attributes of target group %s", *tg)
+		}
+		for _, attribute := range resp.Attributes {
+			value := aws.StringValue(attribute.Value)
+			switch aws.StringValue(attribute.Key) {
+			case "slow_start.duration_seconds":
+				if seconds, err := strconv.Atoi(value); err == nil && time.Duration(seconds)*time.Second > settings.slowStart {
+					settings.slowStart = time.Duration(seconds) * time.Second
+				}
+			case "deregistration_delay.timeout_seconds":
+				if seconds, err := strconv.Atoi(value); err == nil && time.Duration(seconds)*time.Second > settings.deregistrationDelay {
+					settings.deregistrationDelay = time.Duration(seconds) * time.Second
+				}
+			case "stickiness.enabled":
+				if value == "true" {
+					settings.sticky = append(settings.sticky, *tg)
+				}
+			}
+		}
+	}
+
+	if settings.slowStart > 0 {
+		log.Printf("[INFO] target groups have a slow start of %s, latest instances need it on top of their warmup to count as healthy", settings.slowStart)
+	}
+	for _, tg := range settings.sticky {
+		log.Printf("[INFO] target group %s has sticky sessions, their clients move to other targets within the deregistration delay of %s after draining", tg, settings.deregistrationDelay)
+	}
+	return settings, nil
+}
+
+// drainOptions returns the options to wait for --drain-metric-name with. Connections to Network
+// and Gateway Load Balancer targets can outlive --drain-metric-timeout, so the wait is extended
+// to the deregistration delay of those target groups.
+func (s *targetGroupSettings) drainOptions(options *Options) *Options {
+	if len(s.flowTargetGroups) == 0 || options.DrainMetricTimeout >= s.deregistrationDelay {
+		return options
+	}
+	log.Printf("[INFO] extending the wait for --drain-metric-name from %s to the deregistration delay %s of the Network/Gateway Load Balancer target groups", options.DrainMetricTimeout, s.deregistrationDelay)
+	extended := *options
+	extended.DrainMetricTimeout = s.deregistrationDelay
+	return &extended
+}
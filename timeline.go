@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// terminationPollInterval is how often the ASG is re-described while waiting for terminations
+const terminationPollInterval = 30 * time.Second
+
+// instanceTimeline is when each step of an old instance's rotation happened
+type instanceTimeline struct {
+	DrainStarted *time.Time `json:"drain_started,omitempty"`
+	Deregistered *time.Time `json:"deregistered,omitempty"`
+	Unprotected  *time.Time `json:"unprotected,omitempty"`
+	Terminated   *time.Time `json:"terminated,omitempty"`
+	Replaced     *time.Time `json:"replaced,omitempty"`
+	Replacement  string     `json:"replacement,omitempty"`
+}
+
+// Steps of an instance's timeline
+const (
+	stepDrainStarted = "drain_started"
+	stepDeregistered = "deregistered"
+	stepUnprotected  = "unprotected"
+	stepTerminated   = "terminated"
+)
+
+// timelineStep records when a step happened for the instances, keeping the first time it did
+func (s *runStats) timelineStep(step string, instanceIds []string) {
+	now := time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, instanceID := range instanceIds {
+		timeline, ok := s.timelines[instanceID]
+		if !ok {
+			timeline = &instanceTimeline{}
+			s.timelines[instanceID] = timeline
+		}
+		var at **time.Time
+		switch step {
+		case stepDrainStarted:
+			at = &timeline.DrainStarted
+		case stepDeregistered:
+			at = &timeline.Deregistered
+		case stepUnprotected:
+			at = &timeline.Unprotected
+		case stepTerminated:
+			at = &timeline.Terminated
+		}
+		if *at == nil {
+			t := now
+			*at = &t
+		}
+	}
+}
+
+// timelineReplaced records that a new instance replaced an old one
+func (s *runStats) timelineReplaced(instanceID string, replacement string) {
+	now := time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if timeline, ok := s.timelines[instanceID]; ok {
+		timeline.Replaced = &now
+		timeline.Replacement = replacement
+	}
+}
+
+// waitForTermination follows the unprotected instances until the ASG has terminated and replaced
+// them or options.TerminationTimeout passes. New instances are paired with terminated ones in
+// the order they appear, as the ASG doesn't say which instance replaced which.
+func waitForTermination(ctx context.Context, asgClient *autoscaling.AutoScaling, asg *autoscaling.Group, unprotected []*string, options *Options) error {
+	known := make(map[string]bool, len(asg.Instances))
+	for _, instance := range asg.Instances {
+		known[*instance.InstanceId] = true
+	}
+	waiting := make(map[string]bool, len(unprotected))
+	for _, instanceID := range unprotected {
+		waiting[*instanceID] = true
+	}
+	terminated := make([]string, 0, len(unprotected))
+	deadline := time.Now().Add(options.TerminationTimeout)
+
+	log.Printf("[INFO] waiting up to %s for %d instances to be terminated and replaced", options.TerminationTimeout, len(unprotected))
+	for {
+		resp, err := asgClient.DescribeAutoScalingGroups(&autoscaling.DescribeAutoScalingGroupsInput{
+			AutoScalingGroupNames: []*string{aws.String(options.ASG)},
+		})
+		if err != nil {
+			return keepGoing(options, err)
+		}
+		if len(resp.AutoScalingGroups) != 1 {
+			return notFoundError("auto scaling group \"%s\" not found", options.ASG)
+		}
+
+		present := make(map[string]bool)
+		newInstances := make([]string, 0)
+		for _, instance := range resp.AutoScalingGroups[0].Instances {
+			instanceID := *instance.InstanceId
+			present[instanceID] = true
+			if waiting[instanceID] && aws.StringValue(instance.LifecycleState) == autoscaling.LifecycleStateTerminated {
+				present[instanceID] = false
+			}
+			if !known[instanceID] {
+				known[instanceID] = true
+				newInstances = append(newInstances, instanceID)
+			}
+		}
+		gone := make([]string, 0)
+		for instanceID := range waiting {
+			if !present[instanceID] {
+				gone = append(gone, instanceID)
+				delete(waiting, instanceID)
+			}
+		}
+		sort.Strings(gone)
+		if len(gone) > 0 {
+			log.Printf("[INFO] %d instances terminated: %v", len(gone), gone)
+			stats.timelineStep(stepTerminated, gone)
+			terminated = append(terminated, gone...)
+		}
+		for _, replacement := range newInstances {
+			if len(terminated) == 0 {
+				break
+			}
+			log.Printf("[INFO] instance %s replaced %s", replacement, terminated[0])
+			stats.timelineReplaced(terminated[0], replacement)
+			terminated = terminated[1:]
+		}
+
+		if len(waiting) == 0 && len(terminated) == 0 {
+			return nil
+		}
+		if time.Now().Add(terminationPollInterval).After(deadline) {
+			log.Printf("[WARN] %d instances not terminated and %d not replaced within %s", len(waiting), len(terminated), options.TerminationTimeout)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(terminationPollInterval):
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// applyTimeouts bounds every AWS request made through the session by options.APITimeout, and all
+// of them together by options.Timeout and the parent context. The returned context is done when
+// the run times out or is canceled; the returned function releases it.
+func applyTimeouts(parent context.Context, sess *session.Session, options *Options) (context.Context, context.CancelFunc) {
+	ctx, cancel := parent, context.CancelFunc(func() {})
+	if options.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+	}
+
+	runCtx := ctx
+	sess.Handlers.Validate.PushFront(func(r *request.Request) {
+		reqCtx, reqCancel := runCtx, context.CancelFunc(func() {})
+		if options.APITimeout > 0 {
+			reqCtx, reqCancel = context.WithTimeout(runCtx, options.APITimeout)
+		}
+		r.SetContext(reqCtx)
+		r.Handlers.Complete.PushBack(func(*request.Request) {
+			reqCancel()
+		})
+	})
+	return ctx, cancel
+}
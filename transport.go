@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+var (
+	awsHTTPClientOnce sync.Once
+	awsHTTPClient     *http.Client
+)
+
+// sharedHTTPClient returns the HTTP client of every AWS session, built once from the options so
+// all accounts, ASGs and daemon iterations reuse one pool of connections. The SDK default keeps
+// only two idle connections per endpoint, so parallel sweeps keep opening new ones and leave
+// sockets in TIME_WAIT behind.
+func sharedHTTPClient(options *Options) *http.Client {
+	awsHTTPClientOnce.Do(func() {
+		keepAlive := options.HTTPKeepAlive
+		if keepAlive == 0 {
+			// a zero net.Dialer.KeepAlive enables the default period, a negative one disables it
+			keepAlive = -1
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: keepAlive,
+		}).DialContext
+		transport.MaxIdleConns = options.MaxIdleConns
+		transport.MaxIdleConnsPerHost = options.MaxIdleConnsPerHost
+		transport.IdleConnTimeout = options.IdleConnTimeout
+		awsHTTPClient = &http.Client{Transport: transport, Timeout: options.HTTPTimeout}
+	})
+	return awsHTTPClient
+}
+
+// newAWSSession returns a session from the shared config and environment that sends its requests
+// through the shared HTTP client
+func newAWSSession(options *Options) *session.Session {
+	return session.Must(session.NewSessionWithOptions(session.Options{
+		Config:            aws.Config{HTTPClient: sharedHTTPClient(options)},
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// versionCheckTimeout bounds the startup version check so it never slows down a run noticeably
+const versionCheckTimeout = 3 * time.Second
+
+// minorVersion returns the major and minor components of a version like v1.2.3
+func minorVersion(v string) (int, int) {
+	parts := strings.SplitN(strings.TrimPrefix(v, "v"), ".", 3)
+	major, _ := strconv.Atoi(parts[0])
+	minor := 0
+	if len(parts) > 1 {
+		minor, _ = strconv.Atoi(parts[1])
+	}
+	return major, minor
+}
+
+// checkVersion compares the running version with the latest release and warns when it's behind by
+// a minor version or more. Failures are only logged, the check must never fail a run.
+func checkVersion() {
+	if version == "dev" {
+		return
+	}
+
+	release, err := latestRelease(&http.Client{Timeout: versionCheckTimeout})
+	if err != nil {
+		log.Printf("[DEBUG] version check failed: %v", err)
+		return
+	}
+	if compareVersions(version, release.TagName) >= 0 {
+		return
+	}
+
+	major, minor := minorVersion(version)
+	latestMajor, latestMinor := minorVersion(release.TagName)
+	if latestMajor > major || latestMinor > minor {
+		log.Printf("[WARN] running %s but %s is available, update with `%s self-update`", version, release.TagName, binaryName)
+		return
+	}
+	log.Printf("[INFO] running %s, patch release %s is available", version, release.TagName)
+}
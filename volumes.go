@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+)
+
+// findDataVolumes returns, for each of the given instances with non-root EBS volumes that either
+// survive termination or are tagged as data volumes, the ids of those volumes.
+func findDataVolumes(ec2Client *ec2.EC2, instanceIds []*string, dataVolumeTag string) (map[string][]string, error) {
+	dataVolumes := make(map[string][]string)
+	instances, err := describeInstances(ec2Client, instanceIds)
+	if err != nil {
+		return nil, err
+	}
+
+	volumeInstances := make(map[string]string)
+	volumeIds := make([]*string, 0)
+	for instanceID, instance := range instances {
+		for _, bdm := range instance.BlockDeviceMappings {
+			if bdm.Ebs == nil || aws.StringValue(bdm.DeviceName) == aws.StringValue(instance.RootDeviceName) {
+				continue
+			}
+			volumeID := aws.StringValue(bdm.Ebs.VolumeId)
+			if !aws.BoolValue(bdm.Ebs.DeleteOnTermination) {
+				dataVolumes[instanceID] = append(dataVolumes[instanceID], volumeID)
+				continue
+			}
+			volumeInstances[volumeID] = instanceID
+			volumeIds = append(volumeIds, bdm.Ebs.VolumeId)
+		}
+	}
+	if dataVolumeTag == "" || len(volumeIds) == 0 {
+		return dataVolumes, nil
+	}
+
+	err = ec2Client.DescribeVolumesPages(&ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("volume-id"), Values: volumeIds},
+			{Name: aws.String("tag-key"), Values: []*string{aws.String(dataVolumeTag)}},
+		},
+	}, func(page *ec2.DescribeVolumesOutput, lastPage bool) bool {
+		for _, volume := range page.Volumes {
+			instanceID := volumeInstances[aws.StringValue(volume.VolumeId)]
+			dataVolumes[instanceID] = append(dataVolumes[instanceID], aws.StringValue(volume.VolumeId))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not describe volumes")
+	}
+	return dataVolumes, nil
+}
+
+// checkDataVolumes keeps instances with data volumes protected unless options.AllowDataVolumes is set
+func checkDataVolumes(ec2Client *ec2.EC2, instanceIds []*string, options *Options) ([]*string, error) {
+	dataVolumes, err := findDataVolumes(ec2Client, instanceIds, options.DataVolumeTag)
+	if err != nil {
+		return nil, err
+	}
+	return filterInstanceIds(instanceIds, func(instanceID string) bool {
+		volumes := dataVolumes[instanceID]
+		if len(volumes) == 0 {
+			return true
+		}
+		if options.AllowDataVolumes {
+			log.Printf("[WARN] instance %s has data volumes %v, removing protection anyway since `--allow-data-volumes` was provided", instanceID, volumes)
+			return true
+		}
+		log.Printf("[WARN] instance %s has data volumes %v, keeping scale in protection (use `--allow-data-volumes` to override)", instanceID, volumes)
+		return false
+	}), nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// instanceWarmup is how long a new instance of the ASG needs before it counts as replacement
+// capacity: the longer of the ASG's health check grace period and --instance-warmup.
+func instanceWarmup(asg *autoscaling.Group, options *Options) time.Duration {
+	warmup := time.Duration(aws.Int64Value(asg.HealthCheckGracePeriod)) * time.Second
+	if options.InstanceWarmup > warmup {
+		warmup = options.InstanceWarmup
+	}
+	return warmup
+}
+
+// filterWarmedUp returns the latest instances that were launched at least the warmup ago, so
+// instances whose health checks haven't had a chance to fail yet aren't counted as healthy.
+// slowStart is added to the warmup, so replacements have ramped up to their full share of requests.
+func filterWarmedUp(ec2Client *ec2.EC2, asg *autoscaling.Group, instanceIds []string, slowStart time.Duration, options *Options) ([]string, error) {
+	warmup := instanceWarmup(asg, options) + slowStart
+	if warmup == 0 || len(instanceIds) == 0 {
+		return instanceIds, nil
+	}
+
+	instances, err := describeInstances(ec2Client, aws.StringSlice(instanceIds))
+	if err != nil {
+		return nil, err
+	}
+	warm := make([]string, 0, len(instanceIds))
+	for _, instanceID := range instanceIds {
+		instance, ok := instances[instanceID]
+		if !ok || instance.LaunchTime == nil {
+			continue
+		}
+		if age := time.Since(*instance.LaunchTime); age < warmup {
+			log.Printf("[INFO] latest instance %s launched %s ago, still warming up for %s, not counting it as healthy", instanceID, age.Round(time.Second), (warmup - age).Round(time.Second))
+			continue
+		}
+		warm = append(warm, instanceID)
+	}
+	return warm, nil
+}
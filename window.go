@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// maintenanceWindow is a weekly time range in which changes are allowed
+type maintenanceWindow struct {
+	days [7]bool
+	// start and end are minutes since midnight; a window with end before start spans midnight
+	start, end int
+	location   *time.Location
+}
+
+// parseMaintenanceWindow parses "<days> <HH:MM>-<HH:MM> [<time zone>]", where days are a range
+// like "Mon-Fri", a list like "Sat,Sun", or "*" for every day.
+func parseMaintenanceWindow(spec string) (*maintenanceWindow, error) {
+	fields := strings.Fields(spec)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, errors.Errorf("invalid maintenance window %q, expected \"<days> <HH:MM>-<HH:MM> [<time zone>]\"", spec)
+	}
+	w := &maintenanceWindow{location: time.UTC}
+
+	for _, part := range strings.Split(strings.ToLower(fields[0]), ",") {
+		if part == "*" {
+			for i := range w.days {
+				w.days[i] = true
+			}
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		from, ok := weekdays[bounds[0]]
+		if !ok {
+			return nil, errors.Errorf("invalid day %q in maintenance window %q", bounds[0], spec)
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, ok = weekdays[bounds[1]]; !ok {
+				return nil, errors.Errorf("invalid day %q in maintenance window %q", bounds[1], spec)
+			}
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+
+	times := strings.SplitN(fields[1], "-", 2)
+	if len(times) != 2 {
+		return nil, errors.Errorf("invalid time range %q in maintenance window %q", fields[1], spec)
+	}
+	for i, t := range times {
+		parsed, err := time.Parse("15:04", t)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid time %q in maintenance window %q", t, spec)
+		}
+		minutes := parsed.Hour()*60 + parsed.Minute()
+		if i == 0 {
+			w.start = minutes
+		} else {
+			w.end = minutes
+		}
+	}
+
+	if len(fields) == 3 {
+		location, err := time.LoadLocation(fields[2])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid time zone in maintenance window %q", spec)
+		}
+		w.location = location
+	}
+	return w, nil
+}
+
+// contains reports whether t falls in the window. For windows spanning midnight, the day is
+// the one the window starts on.
+func (w *maintenanceWindow) contains(t time.Time) bool {
+	t = t.In(w.location)
+	minutes := t.Hour()*60 + t.Minute()
+	if w.start <= w.end {
+		return w.days[t.Weekday()] && minutes >= w.start && minutes < w.end
+	}
+	if minutes >= w.start {
+		return w.days[t.Weekday()]
+	}
+	return minutes < w.end && w.days[(t.Weekday()+6)%7]
+}
+
+// inMaintenanceWindow reports whether changes are allowed now: always without
+// --maintenance-window, otherwise inside any of the windows
+func inMaintenanceWindow(options *Options, now time.Time) (bool, error) {
+	if len(options.MaintenanceWindows) == 0 {
+		return true, nil
+	}
+	for _, spec := range options.MaintenanceWindows {
+		w, err := parseMaintenanceWindow(spec)
+		if err != nil {
+			return false, err
+		}
+		if w.contains(now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/meirf/gopart"
+	"github.com/pkg/errors"
+)
+
+// findZombies returns the protected instances that are registered in none of the ASG's target
+// groups, so they take no traffic but are kept around by their protection. Instances still
+// warming up, which may not be registered yet, are not reported.
+func findZombies(ec2Client *ec2.EC2, asg *autoscaling.Group, health *targetHealthCache, instanceIds []*string, options *Options) ([]*string, error) {
+	if len(asg.TargetGroupARNs) == 0 || len(instanceIds) == 0 {
+		return nil, nil
+	}
+	instances, err := describeInstances(ec2Client, instanceIds)
+	if err != nil {
+		return nil, err
+	}
+
+	registered := make(map[string]bool)
+	for _, tg := range asg.TargetGroupARNs {
+		descriptions, err := health.describe(*tg)
+		if err != nil {
+			return nil, err
+		}
+		for _, description := range descriptions {
+			registered[aws.StringValue(description.Target.Id)] = true
+		}
+	}
+
+	warmup := instanceWarmup(asg, options)
+	return filterInstanceIds(instanceIds, func(instanceID string) bool {
+		instance, ok := instances[instanceID]
+		if !ok || registered[instanceID] || registered[aws.StringValue(instance.PrivateIpAddress)] {
+			return false
+		}
+		if instance.LaunchTime != nil && time.Since(*instance.LaunchTime) < warmup {
+			return false
+		}
+		log.Printf("[WARN] instance %s is protected from scale in but registered in none of the ASG's target groups", instanceID)
+		return true
+	}), nil
+}
+
+// reapZombies removes scale in protection from instances found by findZombies
+func reapZombies(asgClient *autoscaling.AutoScaling, ec2Client *ec2.EC2, zombies []*string, options *Options) error {
+	for partition := range gopart.Partition(len(zombies), 50) {
+		batch := zombies[partition.Low:partition.High]
+		req, _ := asgClient.SetInstanceProtectionRequest(&autoscaling.SetInstanceProtectionInput{
+			AutoScalingGroupName: aws.String(options.ASG),
+			InstanceIds:          batch,
+			ProtectedFromScaleIn: aws.Bool(false),
+		})
+		if err := mutate(req, options.DryRun); err != nil {
+			return errors.Wrap(err, "could not remove protection from zombie instances")
+		}
+		if err := untagProtectedAt(ec2Client, batch, options.DryRun); err != nil {
+			return err
+		}
+		for _, instanceID := range batch {
+			stats.markState(*instanceID, stateReaped)
+		}
+		if options.DryRun {
+			stats.action("zombies unprotected (dry-run)", len(batch))
+		} else {
+			stats.action("zombies unprotected", len(batch))
+		}
+	}
+	return nil
+}